@@ -2,35 +2,99 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"net/url"
+	"io"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/pgaijin66/phailure/internal/certs"
 	"github.com/pgaijin66/phailure/internal/chaos"
+	"github.com/pgaijin66/phailure/internal/logging"
 	"github.com/pgaijin66/phailure/internal/server"
+	"github.com/pgaijin66/phailure/internal/tracing"
 	"github.com/pgaijin66/phailure/pkg/usage"
 	"github.com/pgaijin66/phailure/pkg/version"
 )
 
+// configFlags maps command line flags to the configuration fields they set.
+// Only flags given explicitly on the command line override other layers.
+var configFlags = map[string]string{
+	"delay-min":       "delay_min",
+	"delay-max":       "delay_max",
+	"delay-prob":      "delay_probability",
+	"error-prob":      "error_probability",
+	"error-codes":     "error_codes",
+	"error-msg":       "error_message",
+	"timeout-dur":     "timeout_duration",
+	"timeout-prob":    "timeout_probability",
+	"target-fraction": "targeting.fraction",
+	"dry-run":         "dry_run",
+	"capture":         "capture.enabled",
+	"target-by":       "",
+}
+
 func main() {
 	flag.Usage = usage.CustomUsage
+	defaults := chaos.DefaultConfig()
+
+	flag.Duration("delay-min", defaults.DelayMin.Duration, "Minimum delay duration")
+	flag.Duration("delay-max", defaults.DelayMax.Duration, "Maximum delay duration")
+	flag.Float64("delay-prob", defaults.DelayProbability, "Probability of delay injection (0.0-1.0)")
+	flag.Float64("error-prob", defaults.ErrorProbability, "Probability of error injection (0.0-1.0)")
+	flag.String("error-codes", "500,502,503,504", "Comma-separated list of error codes to inject")
+	flag.String("error-msg", defaults.ErrorMessage, "Error message for injected errors")
+	flag.Duration("timeout-dur", defaults.TimeoutDuration.Duration, "Timeout duration")
+	flag.Float64("timeout-prob", defaults.TimeoutProbability, "Probability of timeout injection (0.0-1.0)")
+	flag.String("target-by", "", "Client key for sticky targeting: ip, xff, header:NAME, cookie:NAME or jwt:CLAIM")
+	flag.Float64("target-fraction", 1.0, "Fraction of clients affected when -target-by is set (0.0-1.0)")
+	flag.Bool("dry-run", false, "Log and report faults that would be injected without injecting them")
+	flag.Bool("capture", false, "Record proxied traffic for HAR export from /_chaos/capture.har")
+
 	var (
 		port        = flag.String("port", "8080", "Port to run the chaos proxy on")
-		target      = flag.String("target", "", "Target service URL (required)")
-		delayMin    = flag.Duration("delay-min", 100*time.Millisecond, "Minimum delay duration")
-		delayMax    = flag.Duration("delay-max", 2*time.Second, "Maximum delay duration")
-		delayProb   = flag.Float64("delay-prob", 0.1, "Probability of delay injection (0.0-1.0)")
-		errorProb   = flag.Float64("error-prob", 0.05, "Probability of error injection (0.0-1.0)")
-		errorCodes  = flag.String("error-codes", "500,502,503,504", "Comma-separated list of error codes to inject")
-		errorMsg    = flag.String("error-msg", "Chaos engineering fault injection", "Error message for injected errors")
-		timeoutDur  = flag.Duration("timeout-dur", 30*time.Second, "Timeout duration")
-		timeoutProb = flag.Float64("timeout-prob", 0.02, "Probability of timeout injection (0.0-1.0)")
-		configFile  = flag.String("config", "", "JSON configuration file path")
+		mode        = flag.String("mode", "http", "Proxy mode: http, forward for an HTTP_PROXY, tcp to forward raw TCP connections or udp to forward datagrams")
+		listen      = flag.String("listen", "", "Address to listen on instead of :port (127.0.0.1:port in forward mode), host:port or unix:///path/to.sock for a Unix domain socket")
+		socketMode  = flag.String("socket-mode", fmt.Sprintf("%#o", server.DefaultSocketMode), "Permissions of the -listen Unix socket, in octal")
+		adminPort   = flag.String("admin-port", "8081", "Port serving the /_chaos management API in tcp and udp modes")
+		mitm        = flag.Bool("mitm", false, "In forward mode, intercept HTTPS tunnels with certificates from the local CA in ~/.phailure so that HTTP faults apply")
+		mitmHosts   = flag.String("mitm-hosts", "", "Comma-separated hosts intercepted with -mitm, *.example.com for subdomains (empty intercepts every host)")
+		target      = flag.String("target", "", "Target service URL (unix:///path for a Unix socket), or comma-separated URLs of a backend pool (required unless -routes is set)")
+		balance     = flag.String("balance", chaos.BalanceRoundRobin, "Load balancing across -target backends: round_robin, least_conn or random")
+		healthPath  = flag.String("health-path", "", "Path probed on each -target backend for active health checks (empty disables)")
+		healthEvery = flag.Duration("health-interval", 10*time.Second, "How often to probe -target backends when -health-path is set")
+		ejectAfter  = flag.Int("eject-after", 5, "Consecutive failures after which a -target backend is ejected for 30s (negative disables)")
+		routesFile  = flag.String("routes", "", "Routing table file mapping hosts and path prefixes to targets (JSON, YAML or TOML)")
+		tlsCert     = flag.String("tls-cert", "", "Certificate file (PEM) to serve HTTPS on the proxy listener")
+		tlsKey      = flag.String("tls-key", "", "Private key file (PEM) for -tls-cert")
+		tlsSelf     = flag.Bool("tls-self-signed", false, "Serve HTTPS with a certificate for localhost issued by the local CA in ~/.phailure")
+		tlsClientCA = flag.String("tls-client-ca", "", "CA file (PEM) for verifying client certificates; enables mutual TLS")
+		http2       = flag.Bool("http2", true, "Serve HTTP/2: h2 over TLS and cleartext h2c with prior knowledge")
+		upCA        = flag.String("upstream-ca", "", "CA bundle (PEM) trusted for HTTPS targets, in addition to the system roots")
+		upCert      = flag.String("upstream-cert", "", "Client certificate (PEM) presented to HTTPS targets")
+		upKey       = flag.String("upstream-key", "", "Private key (PEM) for -upstream-cert")
+		upSNI       = flag.String("upstream-sni", "", "Server name sent and verified when connecting to HTTPS targets")
+		upInsecure  = flag.Bool("upstream-insecure", false, "Skip certificate verification for HTTPS targets")
+		auditLog    = flag.String("audit-log", "", "File persisting the history of configuration changes, e.g. ~/.phailure/audit.log (empty keeps it in memory only)")
+		configFile  = flag.String("config", "", "Configuration file path (JSON, YAML or TOML, by extension)")
+		configWatch = flag.Duration("config-watch", 2*time.Second, "How often to check the -config file for changes (0 disables; SIGHUP always reloads)")
+		profileName = flag.String("profile", "", "Start from a named chaos profile, e.g. flaky-network or slow-database")
+		profileDir  = flag.String("profile-dir", defaultProfileDir(), "Directory of custom profiles (JSON, YAML or TOML files named after the profile)")
+		printConfig = flag.Bool("print-config", false, "Print the effective configuration and where each value came from, then exit")
+		otlpURL     = flag.String("otlp-endpoint", "", "OTLP/HTTP collector URL for trace export, e.g. http://localhost:4318")
+		serviceName = flag.String("service-name", "phailure", "Service name reported on exported spans")
+		logFormat   = flag.String("log-format", "text", "Log output format: text or json")
+		logLevel    = flag.String("log-level", "info", "Log level: debug, info, warn or error")
 		showVersion = flag.Bool("version", false, "Show version information")
 	)
 	flag.Parse()
@@ -40,53 +104,365 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *target == "" {
+	if err := applyFlagEnv(); err != nil {
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(2)
+	}
+
+	if err := logging.Setup(os.Stderr, *logFormat, *logLevel); err != nil {
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(2)
+	}
+
+	fieldFlags, err := explicitConfigFlags()
+	if err != nil {
+		fatal("invalid flag", "error", err)
+	}
+
+	profiles, err := chaos.LoadProfiles(*profileDir)
+	if err != nil {
+		slog.Warn("some custom profiles were not loaded", "dir", *profileDir, "error", err)
+	}
+
+	var profile *chaos.Profile
+	if *profileName != "" {
+		if profile, err = profiles.Get(*profileName); err != nil {
+			fatal("invalid profile", "error", err)
+		}
+	}
+
+	layers := &chaos.ConfigLayers{
+		Defaults:    defaults,
+		Profile:     profile,
+		DefaultFile: chaos.DefaultConfigPath(),
+		File:        *configFile,
+		Environ:     os.Environ(),
+		Flags:       fieldFlags,
+	}
+
+	if *printConfig {
+		_, sources, err := layers.Load()
+		if err != nil {
+			fatal("invalid configuration", "error", err)
+		}
+		printSources(os.Stdout, sources)
+		os.Exit(0)
+	}
+
+	switch *mode {
+	case "http", "forward", "tcp", "udp":
+	default:
+		fatal("invalid flag", "error", fmt.Errorf("-mode must be http, forward, tcp or udp, got %q", *mode))
+	}
+
+	if *target == "" && *routesFile == "" && *mode != "forward" {
 		fmt.Println("❌ Target service URL is required")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	targetURL, err := url.Parse(*target)
+	if *mode == "forward" {
+		if *target != "" || *healthPath != "" {
+			fatal("invalid flag", "error", errors.New("-target and -health-path are not supported in forward mode, clients name the destination"))
+		}
+	} else if *mitm || *mitmHosts != "" {
+		fatal("invalid flag", "error", errors.New("-mitm and -mitm-hosts require -mode=forward"))
+	}
+	if *mode == "tcp" || *mode == "udp" {
+		if *routesFile != "" || *tlsCert != "" || *tlsSelf || *healthPath != "" || *listen != "" {
+			fatal("invalid flag", "error", fmt.Errorf("-routes, -tls-*, -health-path and -listen are not supported in %s mode", *mode))
+		}
+		*target = rawTargets(*mode, *target)
+	}
+
+	pool := chaos.PoolConfig{
+		Balance: *balance,
+		HealthCheck: chaos.HealthCheckConfig{
+			Path:     *healthPath,
+			Interval: chaos.Duration{Duration: *healthEvery},
+		},
+		Ejection: chaos.EjectionConfig{ConsecutiveFailures: *ejectAfter},
+		TLS: chaos.UpstreamTLSConfig{
+			CAFile:             *upCA,
+			CertFile:           *upCert,
+			KeyFile:            *upKey,
+			ServerName:         *upSNI,
+			InsecureSkipVerify: *upInsecure,
+		},
+	}
+	var fallback *chaos.RouteConfig
+	if *target != "" {
+		fallback = &chaos.RouteConfig{Targets: strings.Split(*target, ","), Pool: pool}
+	}
+
+	var routes *chaos.RoutingTable
+	if *routesFile != "" {
+		if routes, err = chaos.LoadRoutes(*routesFile); err != nil {
+			fatal("invalid routing table", "error", err)
+		}
+	}
+
+	// loadConfig rebuilds the configuration from every layer; it runs at
+	// startup and again on every reload
+	loadConfig := func() (*chaos.ChaosConfig, error) {
+		config, _, err := layers.Load()
+		return config, err
+	}
+
+	config, err := loadConfig()
 	if err != nil {
-		log.Fatalf("❌ Invalid target URL: %v", err)
+		fatal("invalid configuration", "error", err)
+	}
+	if err := config.Validate(); err != nil {
+		fatal("invalid configuration", "error", err)
 	}
 
-	config, err := chaos.NewConfigFromFlags(*delayMin, *delayMax, *delayProb, *errorProb, *errorCodes, *errorMsg, *timeoutDur, *timeoutProb)
+	slog.Info("loaded configuration", "profile", *profileName, "default_file", layers.DefaultFile, "file", layers.File,
+		"delay_min", config.DelayMin.Duration, "delay_max", config.DelayMax.Duration,
+		"timeout_duration", config.TimeoutDuration.Duration)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Endpoint:    *otlpURL,
+		ServiceName: *serviceName,
+	})
 	if err != nil {
-		log.Fatalf("❌ Invalid configuration: %v", err)
+		fatal("failed to set up tracing", "error", err)
 	}
 
-	if *configFile != "" {
-		if err := config.LoadFromFile(*configFile); err != nil {
-			log.Printf("⚠️  Failed to load config file: %v", err)
-		} else {
-			log.Printf("📄 Loaded configuration from %s", *configFile)
-			log.Printf("Config: DelayMin=%v, DelayMax=%v, TimeoutDuration=%v",
-				config.DelayMin.Duration, config.DelayMax.Duration, config.TimeoutDuration.Duration)
-		}
+	var router *chaos.Router
+	if *mode == "forward" {
+		router, err = chaos.NewForwardRouter(config, routes, profiles, pool)
 	} else {
-		log.Printf("🚀 Using command line configuration")
-		log.Printf("Config: DelayMin=%v, DelayMax=%v, TimeoutDuration=%v",
-			config.DelayMin.Duration, config.DelayMax.Duration, config.TimeoutDuration.Duration)
+		router, err = chaos.NewRouter(config, fallback, routes, profiles)
+	}
+	if err != nil {
+		fatal("invalid target or routing table", "error", err)
+	}
+	if *mitm {
+		ca, err := certs.LoadOrCreateCA(defaultCADir())
+		if err != nil {
+			fatal("failed to load the local CA", "error", err)
+		}
+		var hosts []string
+		if *mitmHosts != "" {
+			hosts = strings.Split(*mitmHosts, ",")
+		}
+		router.EnableMITM(ca, hosts)
+		slog.Info("intercepting HTTPS tunnels", "ca", ca.CertPath, "hosts", hosts)
 	}
+	var srv proxyServer
+	switch *mode {
+	case "tcp":
+		srv = server.NewTCP(*port, *adminPort, config, router)
+	case "udp":
+		srv = server.NewUDP(*port, *adminPort, config, router)
+	default:
+		httpSrv := server.NewWithRouter(*port, config, router)
+		addr := *listen
+		// A forward proxy relays to any host and port, internal ones
+		// included, so it is only reachable from other machines when
+		// -listen asks for it
+		if addr == "" && *mode == "forward" {
+			addr = net.JoinHostPort("127.0.0.1", *port)
+		}
+		if addr != "" {
+			perm, err := strconv.ParseUint(*socketMode, 8, 32)
+			if err != nil {
+				fatal("invalid flag", "error", fmt.Errorf("-socket-mode must be octal permissions such as 0660, got %q", *socketMode))
+			}
+			if err := httpSrv.Listen(addr, os.FileMode(perm)); err != nil {
+				fatal("invalid flag", "error", err)
+			}
+		}
+		// CONNECT tunnels are hijacked, which HTTP/2 does not allow
+		if !*http2 || *mode == "forward" {
+			httpSrv.DisableHTTP2()
+		}
+
+		tlsOptions := server.TLSOptions{
+			CertFile:     *tlsCert,
+			KeyFile:      *tlsKey,
+			SelfSigned:   *tlsSelf,
+			ClientCAFile: *tlsClientCA,
+			CADir:        defaultCADir(),
+		}
+		if tlsOptions.Enabled() || tlsOptions.KeyFile != "" || tlsOptions.ClientCAFile != "" {
+			if err := httpSrv.EnableTLS(tlsOptions); err != nil {
+				fatal("invalid TLS configuration", "error", err)
+			}
+		}
+		srv = httpSrv
+	}
+
+	if *auditLog != "" {
+		if err := router.EnableAuditLog(*auditLog); err != nil {
+			slog.Warn("audit log not persisted", "file", *auditLog, "error", err)
+		}
+	}
+
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
 
-	srv := server.New(*port, config, targetURL)
+	// Reloads only happen when a file changed, so that changes made through
+	// the API survive a SIGHUP sent for nothing
+	files := chaos.NewConfigFiles(layers.DefaultFile, layers.File)
+	if *configFile != "" && *configWatch > 0 {
+		go chaos.WatchConfigFiles(watchCtx, router, files, *configWatch, loadConfig)
+	}
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
+	done := make(chan struct{})
 	go func() {
-		<-sigChan
-		log.Println("🛑 Shutting down chaos proxy...")
+		defer close(done)
+
+		for sig := range sigChan {
+			if sig != syscall.SIGHUP {
+				break
+			}
+			changed, err := files.Changed()
+			if err != nil {
+				slog.Error("cannot read config file, keeping current configuration", "error", err)
+				continue
+			}
+			if !changed {
+				slog.Info("received SIGHUP, config files unchanged, keeping current configuration", "files", files.Paths())
+				continue
+			}
+			slog.Info("received SIGHUP, reloading configuration", "files", files.Paths())
+			change := chaos.ConfigChange{Source: chaos.ConfigSourceFile, Actor: "SIGHUP"}
+			if err := router.Reload(loadConfig, change); err != nil {
+				slog.Error("config reload failed, keeping current configuration", "error", err)
+			}
+		}
+
+		slog.Info("shutting down chaos proxy")
+		stopWatching()
 
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
 		if err := srv.Shutdown(ctx); err != nil {
-			log.Printf("❌ Server shutdown error: %v", err)
+			slog.Error("server shutdown error", "error", err)
+		}
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("trace exporter shutdown error", "error", err)
 		}
 	}()
 
 	// Start server (this blocks until shutdown)
 	srv.Start()
+	<-done
+}
+
+// proxyServer is the listener of the selected -mode
+type proxyServer interface {
+	Start()
+	Shutdown(ctx context.Context) error
+}
+
+// rawTargets turns the host:port addresses given with -target in tcp or
+// udp mode into tcp:// or udp:// URLs
+func rawTargets(scheme, target string) string {
+	if target == "" {
+		return ""
+	}
+	targets := strings.Split(target, ",")
+	for i, t := range targets {
+		if !strings.Contains(t, "://") {
+			targets[i] = scheme + "://" + t
+		}
+	}
+	return strings.Join(targets, ",")
+}
+
+// explicitConfigFlags collects the configuration fields set by flags given
+// on the command line, keyed by dotted field name
+func explicitConfigFlags() (map[string]string, error) {
+	fields := map[string]string{}
+	var err error
+
+	flag.Visit(func(f *flag.Flag) {
+		field, ok := configFlags[f.Name]
+		if !ok {
+			return
+		}
+		if f.Name != "target-by" {
+			fields[field] = f.Value.String()
+			return
+		}
+
+		key, name, parseErr := chaos.ParseTargetKey(f.Value.String())
+		if parseErr != nil {
+			err = fmt.Errorf("-target-by: %w", parseErr)
+			return
+		}
+		fields["targeting.enabled"] = "true"
+		fields["targeting.key"] = key
+		fields["targeting.key_name"] = name
+	})
+
+	return fields, err
+}
+
+// applyFlagEnv sets process flags such as -target or -port from PHAILURE_*
+// environment variables (PHAILURE_TARGET, PHAILURE_PORT, ...) unless they
+// were given on the command line. Flags that set configuration fields are
+// left to the configuration layers.
+func applyFlagEnv() error {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, isConfig := configFlags[f.Name]; isConfig || explicit[f.Name] || err != nil {
+			return
+		}
+		name := chaos.EnvPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("%s: %w", name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// printSources writes the effective configuration as a table of fields,
+// values and the layer each value came from
+func printSources(w io.Writer, sources []chaos.FieldSource) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tVALUE\tSOURCE")
+	for _, s := range sources {
+		value, _ := json.Marshal(s.Value)
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Field, value, s.Source)
+	}
+	tw.Flush()
+}
+
+// fatal logs an error and exits with a non-zero status
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// defaultProfileDir returns ~/.phailure/profiles, or an empty path when the
+// home directory is unknown
+func defaultProfileDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".phailure", "profiles")
+}
+
+// defaultCADir returns ~/.phailure, where the local CA is kept, or an empty
+// path when the home directory is unknown
+func defaultCADir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".phailure")
 }
@@ -0,0 +1,178 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File names of the local CA inside its directory
+const (
+	CACertFile = "ca.pem"
+	CAKeyFile  = "ca-key.pem"
+)
+
+// CA is a local certificate authority used to issue certificates for
+// testing: self-signed listener certificates, deliberately broken
+// certificates for TLS faults and interception certificates
+type CA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	// CertPath is where the CA certificate is stored, empty for an
+	// in-memory CA. Clients that trust it accept the issued certificates.
+	CertPath string
+}
+
+// LoadOrCreateCA loads the CA stored in dir, creating and saving a new one
+// if there is none. With an empty dir the CA only lives in memory.
+func LoadOrCreateCA(dir string) (*CA, error) {
+	if dir == "" {
+		return newCA()
+	}
+
+	certPath := filepath.Join(dir, CACertFile)
+	keyPath := filepath.Join(dir, CAKeyFile)
+
+	if ca, err := loadCA(certPath, keyPath); err == nil {
+		return ca, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	ca, err := newCA()
+	if err != nil {
+		return nil, err
+	}
+	if err := ca.save(certPath, keyPath); err != nil {
+		return nil, err
+	}
+	ca.CertPath = certPath
+	return ca, nil
+}
+
+func newCA() (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{Organization: []string{"phailure"}, CommonName: "phailure local CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{cert: cert, key: key}, nil
+}
+
+func loadCA(certPath, keyPath string) (*CA, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		if _, statErr := os.Stat(certPath); errors.Is(statErr, os.ErrNotExist) {
+			return nil, statErr
+		}
+		return nil, fmt.Errorf("loading CA from %s: %w", certPath, err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok || !cert.IsCA {
+		return nil, fmt.Errorf("%s is not an ECDSA CA certificate", certPath)
+	}
+	return &CA{cert: cert, key: key, CertPath: certPath}, nil
+}
+
+func (ca *CA) save(certPath, keyPath string) error {
+	if err := os.MkdirAll(filepath.Dir(certPath), 0o700); err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(ca.key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, ca.CertPEM(), 0o644)
+}
+
+// CertPEM returns the CA certificate in PEM form
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// Issue creates a server certificate for the given names, valid between
+// notBefore and notAfter
+func (ca *CA) Issue(dnsNames []string, ips []net.IP, notBefore, notAfter time.Time) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	commonName := "phailure"
+	if len(dnsNames) > 0 {
+		commonName = dnsNames[0]
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{Organization: []string{"phailure"}, CommonName: commonName},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key}, nil
+}
+
+// IssueFor creates a certificate valid for one year for host, which may be
+// a DNS name or an IP address
+func (ca *CA) IssueFor(hosts ...string) (tls.Certificate, error) {
+	var dnsNames []string
+	var ips []net.IP
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dnsNames = append(dnsNames, host)
+		}
+	}
+	return ca.Issue(dnsNames, ips, time.Now().Add(-time.Hour), time.Now().Add(365*24*time.Hour))
+}
+
+func serialNumber() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
@@ -0,0 +1,222 @@
+package chaos
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sources of configuration changes recorded in the audit log
+const (
+	ConfigSourceStartup  = "startup"
+	ConfigSourceAPI      = "api"
+	ConfigSourceFile     = "file"
+	ConfigSourceRollback = "rollback"
+	ConfigSourceProfile  = "profile"
+)
+
+const maxAuditEntries = 1000
+
+// AuditEntry records a single configuration change
+type AuditEntry struct {
+	Time       time.Time     `json:"time"`
+	Actor      string        `json:"actor"`
+	RemoteAddr string        `json:"remote_addr,omitempty"`
+	Source     string        `json:"source"`
+	Route      string        `json:"route,omitempty"`
+	Version    int           `json:"version,omitempty"`
+	Changes    []FieldChange `json:"changes"`
+}
+
+// FieldChange is one field that differs between the old and new configuration
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// ConfigChange describes who or what is changing the configuration
+type ConfigChange struct {
+	Source     string
+	Actor      string
+	RemoteAddr string
+
+	// IfMatch, when set, makes the update conditional on the current
+	// configuration's ETag, as with the HTTP If-Match header
+	IfMatch string
+}
+
+// changeFromRequest identifies the caller of a management endpoint. Only a
+// verified identity is trusted: the common name of a client certificate
+// checked with mutual TLS, and the remote address otherwise. Names the
+// client merely claims, such as a basic auth user, are ignored.
+func changeFromRequest(r *http.Request) ConfigChange {
+	actor := r.RemoteAddr
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && r.TLS.VerifiedChains[0][0].Subject.CommonName != "" {
+		actor = r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	return ConfigChange{
+		Source:     ConfigSourceAPI,
+		Actor:      actor,
+		RemoteAddr: r.RemoteAddr,
+		IfMatch:    r.Header.Get("If-Match"),
+	}
+}
+
+// auditLog is an append-only history of configuration changes, kept in
+// memory and optionally persisted as JSON lines
+type auditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+	file    *os.File
+}
+
+// openAuditLog loads existing history from path and appends new entries to it
+func openAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		a.entries = append(a.entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("reading audit log: %w", err)
+	}
+	a.trim()
+
+	a.file = file
+	return a, nil
+}
+
+func (a *auditLog) append(e AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.entries = append(a.entries, e)
+	a.trim()
+
+	if a.file == nil {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = a.file.Write(append(data, '\n'))
+	return err
+}
+
+func (a *auditLog) trim() {
+	if len(a.entries) > maxAuditEntries {
+		a.entries = append([]AuditEntry(nil), a.entries[len(a.entries)-maxAuditEntries:]...)
+	}
+}
+
+// history returns up to limit entries, newest first, optionally filtered by source
+func (a *auditLog) history(source, route string, limit int) []AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := []AuditEntry{}
+	for i := len(a.entries) - 1; i >= 0; i-- {
+		if source != "" && a.entries[i].Source != source {
+			continue
+		}
+		// Entries recorded before routing existed belong to the default route
+		if entryRoute := a.entries[i].Route; entryRoute != route && (entryRoute != "" || route != defaultRule) {
+			continue
+		}
+		result = append(result, a.entries[i])
+		if limit > 0 && len(result) == limit {
+			break
+		}
+	}
+	return result
+}
+
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// diffConfigs lists the fields that differ between two configurations,
+// using dotted JSON field names for nested settings
+func diffConfigs(oldConfig, newConfig *ChaosConfig) []FieldChange {
+	oldFields := flattenConfig(oldConfig)
+	newFields := flattenConfig(newConfig)
+
+	names := make(map[string]struct{})
+	for name := range oldFields {
+		names[name] = struct{}{}
+	}
+	for name := range newFields {
+		names[name] = struct{}{}
+	}
+
+	changes := []FieldChange{}
+	for name := range names {
+		if !reflect.DeepEqual(oldFields[name], newFields[name]) {
+			changes = append(changes, FieldChange{Field: name, Old: oldFields[name], New: newFields[name]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+
+	return changes
+}
+
+func flattenConfig(c *ChaosConfig) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if c == nil {
+		return fields
+	}
+
+	data, _ := json.Marshal(c)
+	var tree map[string]interface{}
+	json.Unmarshal(data, &tree)
+
+	flattenInto(fields, "", tree)
+	return fields
+}
+
+func flattenInto(fields map[string]interface{}, prefix string, tree map[string]interface{}) {
+	for key, value := range tree {
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenInto(fields, name, nested)
+			continue
+		}
+		fields[name] = value
+	}
+}
@@ -0,0 +1,58 @@
+package chaos
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChangeFromRequestIgnoresBasicAuth(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPut, "/_chaos/config", nil)
+	r.RemoteAddr = "10.0.0.12:36342"
+	r.SetBasicAuth("alice", "")
+
+	if got := changeFromRequest(r).Actor; got != r.RemoteAddr {
+		t.Errorf("actor = %q, want the remote address %q", got, r.RemoteAddr)
+	}
+}
+
+func TestChangeFromRequestUsesVerifiedClientCertificate(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "deploy-bot"}}
+
+	r := httptest.NewRequest(http.MethodPut, "/_chaos/config", nil)
+	r.RemoteAddr = "10.0.0.12:36342"
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	if got := changeFromRequest(r).Actor; got != "deploy-bot" {
+		t.Errorf("actor = %q, want the verified common name", got)
+	}
+
+	// A certificate the server did not verify proves nothing
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if got := changeFromRequest(r).Actor; got != r.RemoteAddr {
+		t.Errorf("actor = %q for an unverified certificate, want the remote address", got)
+	}
+}
+
+func TestAuditTrailRecordsRemoteAddress(t *testing.T) {
+	cm := newTestProxy(t, quietConfig(), http.NotFoundHandler())
+
+	r := httptest.NewRequest(http.MethodPut, "/_chaos/config", nil)
+	r.RemoteAddr = "192.0.2.7:5000"
+	r.SetBasicAuth("mallory", "")
+	config := quietConfig()
+	config.ErrorProbability = 0.3
+	if _, _, err := cm.UpdateConfig(config, changeFromRequest(r)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := cm.audit.history(ConfigSourceAPI, defaultRule, 1)
+	if len(entries) == 0 {
+		t.Fatal("no audit entry recorded")
+	}
+	if got := entries[0].Actor; got != "192.0.2.7:5000" {
+		t.Errorf("audit actor = %q, want the remote address", got)
+	}
+}
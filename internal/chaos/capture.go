@@ -0,0 +1,417 @@
+package chaos
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pgaijin66/phailure/pkg/version"
+)
+
+const (
+	defaultCaptureEntries   = 500
+	defaultCaptureBodyBytes = 64 * 1024
+	redactedValue           = "[REDACTED]"
+)
+
+// defaultRedactedNames are the headers and query parameters always
+// redacted from captured traffic
+var defaultRedactedNames = []string{
+	"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key",
+	"Api-Key", "Apikey", "Key", "Token", "Access-Token", "Refresh-Token", "Id-Token",
+	"Client-Secret", "Password", "Sig", "Signature",
+}
+
+// CaptureConfig controls recording of proxied traffic for HAR export
+type CaptureConfig struct {
+	Enabled      bool `json:"enabled"`
+	MaxEntries   int  `json:"max_entries,omitempty"`
+	MaxBodyBytes int  `json:"max_body_bytes,omitempty"`
+
+	// RedactHeaders adds to the headers and query parameters redacted
+	RedactHeaders []string `json:"redact_headers,omitempty"`
+}
+
+func (c CaptureConfig) maxEntries() int {
+	if c.MaxEntries <= 0 {
+		return defaultCaptureEntries
+	}
+	return c.MaxEntries
+}
+
+func (c CaptureConfig) maxBodyBytes() int {
+	if c.MaxBodyBytes <= 0 {
+		return defaultCaptureBodyBytes
+	}
+	return c.MaxBodyBytes
+}
+
+// redacted reports whether a header or query parameter is sensitive.
+// Names match regardless of case, and "_" matches "-" so that api_key is
+// redacted like Api-Key.
+func (c CaptureConfig) redacted(name string) bool {
+	normalize := func(s string) string { return strings.ReplaceAll(strings.ToLower(s), "_", "-") }
+	name = normalize(name)
+	for _, list := range [][]string{defaultRedactedNames, c.RedactHeaders} {
+		for _, n := range list {
+			if normalize(n) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// limitedBuffer keeps the first limit bytes written to it
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	size      int64
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.size += int64(len(p))
+	if room := b.limit - b.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// captureReader copies what the proxy reads from the request body
+type captureReader struct {
+	io.ReadCloser
+	buf *limitedBuffer
+}
+
+func (cr *captureReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.buf.Write(p[:n])
+	return n, err
+}
+
+// exchange holds the request and response bodies captured for one request
+type exchange struct {
+	config       CaptureConfig
+	request      *http.Request
+	url          string
+	requestBody  *limitedBuffer
+	responseBody *limitedBuffer
+}
+
+// startCapture prepares to record the request and its response
+func startCapture(r *http.Request, config CaptureConfig) *exchange {
+	ex := &exchange{
+		config:       config,
+		request:      r,
+		url:          requestURL(r, config),
+		requestBody:  &limitedBuffer{limit: config.maxBodyBytes()},
+		responseBody: &limitedBuffer{limit: config.maxBodyBytes()},
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &captureReader{ReadCloser: r.Body, buf: ex.requestBody}
+	}
+	return ex
+}
+
+// requestURL returns the absolute URL of the request with sensitive query
+// parameters redacted
+func requestURL(r *http.Request, config CaptureConfig) string {
+	u := *r.URL
+	u.Host = r.Host
+	u.Scheme = "http"
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	q := u.Query()
+	redacted := false
+	for name, values := range q {
+		if config.redacted(name) {
+			for i := range values {
+				values[i] = redactedValue
+			}
+			redacted = true
+		}
+	}
+	if redacted {
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// HAR 1.2 structures, see http://www.softwareishard.com/blog/har-12-spec/
+
+type harLog struct {
+	Log harContent `json:"log"`
+}
+
+type harContent struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Chaos           harChaos    `json:"_chaos"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harBody        `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harBody struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harChaos is the custom field describing what phailure did to the request
+type harChaos struct {
+	RequestID      string  `json:"request_id"`
+	Rule           string  `json:"rule"`
+	Backend        string  `json:"backend,omitempty"`
+	Targeted       bool    `json:"targeted"`
+	DryRun         bool    `json:"dry_run"`
+	Fault          string  `json:"fault"`
+	DelayMs        float64 `json:"delay_ms,omitempty"`
+	ErrorCode      int     `json:"error_code,omitempty"`
+	GRPCStatus     string  `json:"grpc_status,omitempty"`
+	Timeout        string  `json:"timeout,omitempty"`
+	UpstreamStatus int     `json:"upstream_status,omitempty"`
+}
+
+// entry builds the HAR entry once the response has been written
+func (ex *exchange) entry(rec *requestRecord, responseHeader http.Header) harEntry {
+	r := ex.request
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+	req := harRequest{
+		Method:      r.Method,
+		URL:         ex.url,
+		HTTPVersion: r.Proto,
+		Cookies:     ex.cookies(r.Cookies()),
+		Headers:     ex.headers(r.Header),
+		QueryString: ex.queryString(r.URL.Query()),
+		HeadersSize: -1,
+		BodySize:    ex.requestBody.size,
+	}
+	if ex.requestBody.size > 0 {
+		text, encoding := bodyText(ex.requestBody.Bytes())
+		req.PostData = &harPostData{
+			MimeType: r.Header.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+			Comment:  truncationComment(ex.requestBody),
+		}
+	}
+
+	text, encoding := bodyText(ex.responseBody.Bytes())
+	resp := harResponse{
+		Status:      rec.Status,
+		StatusText:  http.StatusText(rec.Status),
+		HTTPVersion: r.Proto,
+		Cookies:     ex.cookies((&http.Response{Header: responseHeader}).Cookies()),
+		Headers:     ex.headers(responseHeader),
+		Content: harBody{
+			Size:     ex.responseBody.size,
+			MimeType: responseHeader.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+			Comment:  truncationComment(ex.responseBody),
+		},
+		HeadersSize: -1,
+		BodySize:    ex.responseBody.size,
+	}
+
+	chaos := harChaos{
+		RequestID:      rec.ID,
+		Rule:           rec.Rule,
+		Backend:        rec.Backend,
+		Targeted:       rec.Targeted,
+		DryRun:         rec.DryRun,
+		Fault:          rec.fault(),
+		DelayMs:        ms(rec.Decision.Delay),
+		ErrorCode:      rec.Decision.ErrorCode,
+		UpstreamStatus: rec.UpstreamStatus,
+	}
+	if rec.GRPC {
+		// gRPC errors are carried by a 200 response; the injected status
+		// is the gRPC one
+		chaos.ErrorCode = rec.Decision.GRPCStatus
+		chaos.GRPCStatus = rec.GRPCStatus
+	}
+	if rec.Decision.Timeout > 0 {
+		chaos.Timeout = rec.Decision.Timeout.String()
+	}
+
+	wait := rec.Latency
+	if rec.UpstreamStatus != 0 {
+		wait = rec.UpstreamLatency
+	}
+
+	return harEntry{
+		StartedDateTime: rec.Start.Format(time.RFC3339Nano),
+		Time:            ms(rec.Latency),
+		Request:         req,
+		Response:        resp,
+		Timings: harTimings{
+			Blocked: ms(rec.Latency - wait),
+			DNS:     -1,
+			Connect: -1,
+			SSL:     -1,
+			Wait:    ms(wait),
+		},
+		Chaos: chaos,
+	}
+}
+
+func (ex *exchange) headers(h http.Header) []harNameValue {
+	out := []harNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			if ex.config.redacted(name) {
+				v = redactedValue
+			}
+			out = append(out, harNameValue{Name: name, Value: v})
+		}
+	}
+	return out
+}
+
+func (ex *exchange) cookies(cookies []*http.Cookie) []harNameValue {
+	out := []harNameValue{}
+	for _, c := range cookies {
+		value := c.Value
+		if ex.config.redacted("Cookie") {
+			value = redactedValue
+		}
+		out = append(out, harNameValue{Name: c.Name, Value: value})
+	}
+	return out
+}
+
+func (ex *exchange) queryString(q url.Values) []harNameValue {
+	out := []harNameValue{}
+	for name, values := range q {
+		for _, v := range values {
+			if ex.config.redacted(name) {
+				v = redactedValue
+			}
+			out = append(out, harNameValue{Name: name, Value: v})
+		}
+	}
+	return out
+}
+
+// bodyText returns the body as text, base64-encoding it when it is not UTF-8
+func bodyText(b []byte) (text, encoding string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+func truncationComment(b *limitedBuffer) string {
+	if b.truncated {
+		return "body truncated by phailure capture limit"
+	}
+	return ""
+}
+
+// captureBuffer keeps the most recent HAR entries
+type captureBuffer struct {
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+func (cb *captureBuffer) add(e harEntry, max int) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.entries = append(cb.entries, e)
+	if len(cb.entries) > max {
+		cb.entries = append([]harEntry(nil), cb.entries[len(cb.entries)-max:]...)
+	}
+}
+
+func (cb *captureBuffer) har() harLog {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return harLog{Log: harContent{
+		Version: "1.2",
+		Creator: harCreator{Name: "phailure", Version: version.GetVersion()},
+		Entries: append([]harEntry{}, cb.entries...),
+	}}
+}
+
+func (cb *captureBuffer) clear() {
+	cb.mu.Lock()
+	cb.entries = nil
+	cb.mu.Unlock()
+}
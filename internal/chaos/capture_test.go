@@ -0,0 +1,55 @@
+package chaos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCaptureRedactsQueryCredentials(t *testing.T) {
+	config := CaptureConfig{Enabled: true, RedactHeaders: []string{"X-Session"}}
+	r := httptest.NewRequest(http.MethodGet, "/orders?api_key=k1&Token=t1&x_session=s1&page=2", nil)
+	ex := startCapture(r, config)
+	entry := ex.entry(&requestRecord{Status: http.StatusOK}, http.Header{})
+
+	for _, secret := range []string{"k1", "t1", "s1"} {
+		if strings.Contains(entry.Request.URL, secret) {
+			t.Errorf("URL %q contains %q", entry.Request.URL, secret)
+		}
+	}
+	if !strings.Contains(entry.Request.URL, "page=2") {
+		t.Errorf("URL %q lost the page parameter", entry.Request.URL)
+	}
+	for _, p := range entry.Request.QueryString {
+		want := redactedValue
+		if p.Name == "page" {
+			want = "2"
+		}
+		if p.Value != want {
+			t.Errorf("query parameter %s = %q, want %q", p.Name, p.Value, want)
+		}
+	}
+
+	// URLs without sensitive parameters are kept as they came
+	r = httptest.NewRequest(http.MethodGet, "/orders?b=1&a=2", nil)
+	if got := requestURL(r, config); got != "http://example.com/orders?b=1&a=2" {
+		t.Errorf("URL %q, want the original query", got)
+	}
+}
+
+func TestCaptureRecordsGRPCStatus(t *testing.T) {
+	r := grpcRequest("/pkg.Orders/Create")
+	ex := startCapture(r, CaptureConfig{Enabled: true})
+	rec := &requestRecord{
+		Status:     http.StatusOK,
+		GRPC:       true,
+		GRPCStatus: "UNAVAILABLE",
+		Decision:   faultDecision{GRPCStatus: 14},
+	}
+
+	chaos := ex.entry(rec, http.Header{}).Chaos
+	if chaos.ErrorCode != 14 || chaos.GRPCStatus != "UNAVAILABLE" {
+		t.Errorf("error_code %d, grpc_status %q, want 14, UNAVAILABLE", chaos.ErrorCode, chaos.GRPCStatus)
+	}
+}
@@ -2,6 +2,8 @@ package chaos
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
@@ -21,6 +23,19 @@ type ChaosConfig struct {
 	TimeoutEnabled     bool     `json:"timeout_enabled"`
 	TimeoutDuration    Duration `json:"timeout_duration"`
 	TimeoutProbability float64  `json:"timeout_probability"`
+
+	DryRun    bool            `json:"dry_run"`
+	Targeting TargetingConfig `json:"targeting"`
+	Capture   CaptureConfig   `json:"capture"`
+
+	BackendFaults []BackendFault   `json:"backend_faults,omitempty"`
+	TLSFaults     TLSFaultConfig   `json:"tls_faults,omitempty"`
+	HTTP2Faults   HTTP2FaultConfig `json:"http2_faults,omitempty"`
+	GRPC          GRPCConfig       `json:"grpc,omitempty"`
+	WebSocket     WebSocketConfig  `json:"websocket,omitempty"`
+	Streaming     StreamingConfig  `json:"streaming,omitempty"`
+	TCP           TCPConfig        `json:"tcp,omitempty"`
+	UDP           UDPConfig        `json:"udp,omitempty"`
 }
 
 // NewConfigFromFlags creates a new configuration from command line flags
@@ -49,11 +64,117 @@ func NewConfigFromFlags(delayMin, delayMax time.Duration, delayProb, errorProb f
 	}, nil
 }
 
-// LoadFromFile loads configuration from a JSON file
+// LoadFromFile loads configuration from a JSON, YAML or TOML file, chosen
+// by the file extension. Fields missing from the file keep their value.
 func (c *ChaosConfig) LoadFromFile(filename string) error {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(data, c)
+	if err := decodeInto(data, FormatFromPath(filename), c); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
+
+// Clone returns a deep copy of the configuration
+func (c *ChaosConfig) Clone() *ChaosConfig {
+	data, _ := json.Marshal(c)
+	clone := &ChaosConfig{}
+	json.Unmarshal(data, clone)
+	return clone
+}
+
+// probabilityTolerance absorbs rounding when probabilities of exclusive
+// faults are added up
+const probabilityTolerance = 1e-9
+
+// Validate checks that the configuration is internally consistent
+func (c *ChaosConfig) Validate() error {
+	var errs []error
+
+	probabilities := []struct {
+		name  string
+		value float64
+	}{
+		{"delay_probability", c.DelayProbability},
+		{"error_probability", c.ErrorProbability},
+		{"timeout_probability", c.TimeoutProbability},
+	}
+	for _, p := range probabilities {
+		if p.value < 0 || p.value > 1 {
+			errs = append(errs, fmt.Errorf("%s must be between 0 and 1, got %v", p.name, p.value))
+		}
+	}
+
+	if c.DelayMin.Duration < 0 || c.DelayMax.Duration < 0 || c.TimeoutDuration.Duration < 0 {
+		errs = append(errs, errors.New("durations must not be negative"))
+	}
+	if c.DelayMax.Duration < c.DelayMin.Duration {
+		errs = append(errs, fmt.Errorf("delay_max (%v) is less than delay_min (%v)", c.DelayMax.Duration, c.DelayMin.Duration))
+	}
+
+	for _, code := range c.ErrorCodes {
+		if code < 100 || code > 599 {
+			errs = append(errs, fmt.Errorf("error code %d is not a valid HTTP status", code))
+		}
+	}
+	if c.ErrorEnabled && c.ErrorProbability > 0 && len(c.ErrorCodes) == 0 {
+		errs = append(errs, errors.New("error injection is enabled but error_codes is empty"))
+	}
+
+	if c.Targeting.Enabled {
+		switch c.Targeting.Key {
+		case "", TargetKeyIP, TargetKeyForwardedFor:
+		case TargetKeyHeader, TargetKeyCookie, TargetKeyJWTClaim:
+			if c.Targeting.KeyName == "" {
+				errs = append(errs, fmt.Errorf("targeting key %q requires key_name", c.Targeting.Key))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("unknown targeting key %q", c.Targeting.Key))
+		}
+		if c.Targeting.Fraction < 0 || c.Targeting.Fraction > 1 {
+			errs = append(errs, fmt.Errorf("targeting fraction must be between 0 and 1, got %v", c.Targeting.Fraction))
+		}
+	}
+
+	if c.Capture.MaxEntries < 0 || c.Capture.MaxBodyBytes < 0 {
+		errs = append(errs, errors.New("capture limits must not be negative"))
+	}
+
+	if err := c.TLSFaults.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.HTTP2Faults.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.GRPC.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.WebSocket.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.Streaming.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.TCP.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.UDP.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	for i, f := range c.BackendFaults {
+		if err := f.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("backend_faults[%d]: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
 }
@@ -0,0 +1,236 @@
+package chaos
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventBufferSize   = 64
+	eventKeepAlive    = 15 * time.Second
+	faultFilterAny    = "any"
+	faultFilterNone   = "none"
+	statusClassSuffix = "xx"
+)
+
+// Event describes the outcome of a single proxied request
+type Event struct {
+	Time           time.Time `json:"time"`
+	RequestID      string    `json:"request_id"`
+	Method         string    `json:"method"`
+	Path           string    `json:"path"`
+	Rule           string    `json:"rule"`
+	Backend        string    `json:"backend,omitempty"`
+	Targeted       bool      `json:"targeted"`
+	DryRun         bool      `json:"dry_run"`
+	Fault          string    `json:"fault"`
+	Faults         []string  `json:"faults,omitempty"`
+	Status         int       `json:"status"`
+	UpstreamStatus int       `json:"upstream_status,omitempty"`
+	GRPCStatus     string    `json:"grpc_status,omitempty"`
+	LatencyMs      float64   `json:"latency_ms"`
+}
+
+// event converts the record into the form published to live subscribers
+func (rec *requestRecord) event() Event {
+	return Event{
+		Time:           rec.Start,
+		RequestID:      rec.ID,
+		Method:         rec.Method,
+		Path:           rec.Path,
+		Rule:           rec.Rule,
+		Backend:        rec.Backend,
+		Targeted:       rec.Targeted,
+		DryRun:         rec.DryRun,
+		Fault:          rec.fault(),
+		Faults:         rec.Decision.kinds(),
+		Status:         rec.Status,
+		UpstreamStatus: rec.UpstreamStatus,
+		GRPCStatus:     rec.GRPCStatus,
+		LatencyMs:      float64(rec.Latency.Microseconds()) / 1000,
+	}
+}
+
+// eventHub fans request events out to live subscribers. Slow subscribers
+// miss events rather than slowing down the proxy.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan Event]struct{})}
+}
+
+func (h *eventHub) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+func (h *eventHub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// eventFilter selects which events a subscriber receives
+type eventFilter struct {
+	fault      string
+	status     string
+	method     string
+	pathPrefix string
+	rule       string
+	minLatency time.Duration
+}
+
+// parseEventFilter reads filters from query parameters: fault (delay, error,
+// timeout, any or none), status (503 or 5xx), method, path (prefix), rule
+// and min_latency (e.g. 250ms)
+func parseEventFilter(r *http.Request) (eventFilter, error) {
+	q := r.URL.Query()
+	f := eventFilter{
+		fault:      strings.ToLower(q.Get("fault")),
+		status:     strings.ToLower(q.Get("status")),
+		method:     strings.ToUpper(q.Get("method")),
+		pathPrefix: q.Get("path"),
+		rule:       q.Get("rule"),
+	}
+
+	if f.status != "" && !strings.HasSuffix(f.status, statusClassSuffix) {
+		if _, err := strconv.Atoi(f.status); err != nil {
+			return f, fmt.Errorf("invalid status filter %q", f.status)
+		}
+	}
+
+	if v := q.Get("min_latency"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid min_latency %q", v)
+		}
+		f.minLatency = d
+	}
+
+	return f, nil
+}
+
+func (f eventFilter) matches(e Event) bool {
+	switch f.fault {
+	case "":
+	case faultFilterAny:
+		if len(e.Faults) == 0 {
+			return false
+		}
+	case faultFilterNone:
+		if len(e.Faults) != 0 {
+			return false
+		}
+	default:
+		if !containsString(e.Faults, f.fault) {
+			return false
+		}
+	}
+
+	if f.status != "" {
+		code := strconv.Itoa(e.Status)
+		if strings.HasSuffix(f.status, statusClassSuffix) {
+			if !strings.HasPrefix(code, strings.TrimSuffix(f.status, statusClassSuffix)) {
+				return false
+			}
+		} else if code != f.status {
+			return false
+		}
+	}
+
+	if f.method != "" && e.Method != f.method {
+		return false
+	}
+	if f.pathPrefix != "" && !strings.HasPrefix(e.Path, f.pathPrefix) {
+		return false
+	}
+	if f.rule != "" && e.Rule != f.rule {
+		return false
+	}
+	if f.minLatency > 0 && time.Duration(e.LatencyMs*float64(time.Millisecond)) < f.minLatency {
+		return false
+	}
+
+	return true
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// handleEventsEndpoint streams request events as Server-Sent Events
+func (cm *ChaosMiddleware) handleEventsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Subscribed before the response starts, so that the client receives
+	// every request made once it got the headers
+	events, unsubscribe := cm.events.subscribe()
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e := <-events:
+			if !filter.matches(e) {
+				continue
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "id: %s\nevent: request\ndata: %s\n\n", e.RequestID, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package chaos
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startRouter serves a router with the given routes in front of a backend
+// answering 200, which is also the default route
+func startRouter(t *testing.T, routes ...RouteConfig) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(backend.Close)
+	for i := range routes {
+		routes[i].Target = backend.URL
+	}
+
+	router, err := NewRouter(quietConfig(), &RouteConfig{Target: backend.URL}, &RoutingTable{Routes: routes}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { router.Close() })
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// subscribeEvents opens an event stream and returns the rules of the
+// events received on it
+func subscribeEvents(t *testing.T, url string) <-chan string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: status %d", url, resp.StatusCode)
+	}
+
+	rules := make(chan string, 10)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var e Event
+			if json.Unmarshal([]byte(data), &e) == nil {
+				rules <- e.Rule
+			}
+		}
+	}()
+	return rules
+}
+
+// received collects the rules of the events that arrive within a moment
+func received(rules <-chan string) []string {
+	var got []string
+	timeout := time.After(300 * time.Millisecond)
+	for {
+		select {
+		case rule := <-rules:
+			got = append(got, rule)
+		case <-timeout:
+			return got
+		}
+	}
+}
+
+func TestEventsOfEveryRoute(t *testing.T) {
+	srv := startRouter(t,
+		RouteConfig{Name: "orders", PathPrefix: "/orders"},
+		RouteConfig{Name: "payments", PathPrefix: "/payments"},
+	)
+	all := subscribeEvents(t, srv.URL+"/_chaos/events")
+	payments := subscribeEvents(t, srv.URL+"/_chaos/events?rule=payments")
+	orders := subscribeEvents(t, srv.URL+"/_chaos/routes/orders/events")
+
+	for _, path := range []string{"/orders/1", "/payments/1", "/other"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	tests := []struct {
+		name   string
+		rules  <-chan string
+		expect string
+	}{
+		{"all routes", all, "orders,payments,default"},
+		{"rule filter", payments, "payments"},
+		{"route endpoint", orders, "orders"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(received(tt.rules), ","); got != tt.expect {
+			t.Errorf("%s: events of %q, want %q", tt.name, got, tt.expect)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package chaos
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Supported configuration file formats
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// FormatFromPath picks a configuration format from a file extension,
+// defaulting to JSON
+func FormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	default:
+		return FormatJSON
+	}
+}
+
+// formatFromMediaType maps a Content-Type or Accept media type to a format
+func formatFromMediaType(mediaType string) string {
+	mt, _, _ := mime.ParseMediaType(mediaType)
+	switch mt {
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return FormatYAML
+	case "application/toml":
+		return FormatTOML
+	default:
+		return FormatJSON
+	}
+}
+
+// acceptedFormat picks the first supported format listed in an Accept header
+func acceptedFormat(accept string) string {
+	for _, mediaType := range strings.Split(accept, ",") {
+		if format := formatFromMediaType(strings.TrimSpace(mediaType)); format != FormatJSON {
+			return format
+		}
+		if strings.Contains(mediaType, "json") {
+			return FormatJSON
+		}
+	}
+	return FormatJSON
+}
+
+// mediaTypeFor returns the Content-Type used when responding in a format
+func mediaTypeFor(format string) string {
+	switch format {
+	case FormatYAML:
+		return "application/yaml"
+	case FormatTOML:
+		return "application/toml"
+	default:
+		return "application/json"
+	}
+}
+
+// decodeInto decodes data in the given format into v. YAML and TOML are
+// converted to JSON first so every format shares the JSON field names and
+// custom unmarshalers such as Duration, and so fields missing from data
+// keep their current value in v.
+func decodeInto(data []byte, format string, v interface{}) error {
+	var tree map[string]interface{}
+
+	switch format {
+	case FormatJSON:
+		return json.Unmarshal(data, v)
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &tree); err != nil {
+			return err
+		}
+	case FormatTOML:
+		if err := toml.Unmarshal(data, &tree); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported format %q", format)
+	}
+
+	converted, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(converted, v)
+}
+
+// encodeAs encodes v in the given format using its JSON field names
+func encodeAs(v interface{}, format string) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || format == FormatJSON {
+		return data, err
+	}
+
+	var tree map[string]interface{}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatYAML:
+		return yaml.Marshal(tree)
+	case FormatTOML:
+		var buf bytes.Buffer
+		err := toml.NewEncoder(&buf).Encode(tree)
+		return buf.Bytes(), err
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+}
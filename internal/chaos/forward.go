@@ -0,0 +1,268 @@
+package chaos
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pgaijin66/phailure/internal/certs"
+)
+
+// connectTimeout bounds dialing the destination of a CONNECT tunnel
+const connectTimeout = 10 * time.Second
+
+// isProxyRequest reports whether r was sent to a proxy: a CONNECT request
+// or a request for an absolute URL
+func isProxyRequest(r *http.Request) bool {
+	return r.Method == http.MethodConnect || r.URL.IsAbs()
+}
+
+// isManagement reports whether r is for the /_chaos endpoints. A forward
+// proxy passes requests for other hosts on whatever their path.
+func isManagement(r *http.Request, forward bool) bool {
+	return strings.HasPrefix(r.URL.Path, "/_chaos") && !(forward && isProxyRequest(r))
+}
+
+// hostOnly strips the port from a host:port authority
+func hostOnly(authority string) string {
+	if host, _, err := net.SplitHostPort(authority); err == nil {
+		return host
+	}
+	return authority
+}
+
+// NewForwardRouter creates a router for an explicit HTTP proxy. Clients
+// name the destination of each request, either as an absolute URL or with
+// CONNECT, and routes match it by host. Routes without targets, and the
+// default route, send requests to their destination.
+func NewForwardRouter(base *ChaosConfig, table *RoutingTable, profiles *ProfileLibrary, poolConfig PoolConfig) (*Router, error) {
+	return newRouter(base, &RouteConfig{Pool: poolConfig}, table, profiles, true)
+}
+
+// EnableMITM intercepts CONNECT tunnels to hosts, or to every host when
+// hosts is empty, so that HTTP faults apply to the requests inside them.
+// Certificates are issued by ca, which clients must trust. A host may
+// start with "*." to match its subdomains.
+func (rr *Router) EnableMITM(ca *certs.CA, hosts []string) {
+	rr.mitm = &mitm{ca: ca, hosts: hosts, certs: map[string]*tls.Certificate{}}
+}
+
+// connect serves a CONNECT request once chaos was applied to it by
+// opening a tunnel to its destination
+func (rr *Router) connect(w http.ResponseWriter, r *http.Request, b *backend) {
+	rec := recordFrom(r.Context())
+	upstream, err := net.DialTimeout("tcp", b.url.Host, connectTimeout)
+	if err != nil {
+		slog.Warn("upstream request failed", "request_id", rec.ID, "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	rec.UpstreamStatus = http.StatusOK
+	client, err := establish(w)
+	if err != nil {
+		slog.Warn("opening tunnel failed", "request_id", rec.ID, "error", err)
+		return
+	}
+	defer client.Close()
+	tunnel(client, upstream)
+}
+
+// intercept serves a CONNECT request to a host intercepted with MITM. No
+// fault is applied to the tunnel itself: the requests inside it go through
+// the router like any other.
+func (rr *Router) intercept(w http.ResponseWriter, r *http.Request) {
+	client, err := establish(w)
+	if err != nil {
+		slog.Warn("opening tunnel failed", "host", r.Host, "error", err)
+		return
+	}
+	defer client.Close()
+	slog.Debug("intercepting tunnel", "host", r.Host, "remote_addr", r.RemoteAddr)
+	rr.mitm.serve(client, r.Host, rr)
+}
+
+// establish answers a CONNECT request with 200 and takes over the client
+// connection
+func establish(w http.ResponseWriter) (net.Conn, error) {
+	if rw, ok := w.(*responseRecorder); ok {
+		rw.status = http.StatusOK
+	}
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	client := &bufferedConn{Conn: conn, r: buf.Reader}
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// tunnel copies bytes both ways between client and upstream until both
+// directions are done
+func tunnel(client, upstream net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, client)
+		closeWrite(upstream)
+		close(done)
+	}()
+	io.Copy(client, upstream)
+	closeWrite(client)
+	<-done
+}
+
+// closeWrite half-closes a connection so the peer sees EOF while the other
+// direction keeps flowing
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// bufferedConn is a hijacked connection whose first bytes may already sit
+// in the server's read buffer
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// mitm terminates TLS inside CONNECT tunnels with certificates issued by a
+// local CA
+type mitm struct {
+	ca    *certs.CA
+	hosts []string
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// intercepts reports whether tunnels to host are intercepted. Host names
+// are case-insensitive, for wildcards as for exact names.
+func (m *mitm) intercepts(host string) bool {
+	if len(m.hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, h := range m.hosts {
+		h = strings.ToLower(h)
+		if suffix, ok := strings.CutPrefix(h, "*"); ok && strings.HasSuffix(host, suffix) {
+			return true
+		}
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// certificate returns the certificate presented for host, issuing it on
+// first use
+func (m *mitm) certificate(host string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cert, ok := m.certs[host]; ok {
+		return cert, nil
+	}
+	cert, err := m.ca.IssueFor(host)
+	if err != nil {
+		return nil, err
+	}
+	m.certs[host] = &cert
+	return &cert, nil
+}
+
+// serve terminates TLS on an intercepted tunnel and hands the requests
+// inside it to handler as requests for https://authority
+func (m *mitm) serve(conn net.Conn, authority string, handler http.Handler) {
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		host = authority
+	}
+	target := authority
+	if port == "443" {
+		target = host
+	}
+
+	cert, err := m.certificate(host)
+	if err != nil {
+		slog.Warn("issuing interception certificate failed", "host", host, "error", err)
+		return
+	}
+	tlsConn := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{"http/1.1"},
+	})
+
+	ln := newConnListener(tlsConn)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = target
+			handler.ServeHTTP(w, r)
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				ln.Close()
+			}
+		},
+		// Clients that do not trust the CA fail the handshake, which is
+		// not worth more than a debug line
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+	}
+	srv.Serve(ln)
+}
+
+// connListener is a net.Listener yielding a single connection
+type connListener struct {
+	conns chan net.Conn
+	addr  net.Addr
+	once  sync.Once
+	done  chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{conns: make(chan net.Conn, 1), addr: conn.LocalAddr(), done: make(chan struct{})}
+	l.conns <- conn
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,69 @@
+package chaos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMITMIntercepts(t *testing.T) {
+	m := &mitm{hosts: []string{"Payments.example.com", "*.Internal.example.com"}}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"payments.example.com", true},
+		{"PAYMENTS.EXAMPLE.COM", true},
+		{"api.internal.example.com", true},
+		{"API.INTERNAL.EXAMPLE.COM", true},
+		{"search.example.com", false},
+		{"internal.example.com.evil", false},
+	}
+	for _, tt := range tests {
+		if got := m.intercepts(tt.host); got != tt.want {
+			t.Errorf("intercepts(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	if !(&mitm{}).intercepts("anything.example.com") {
+		t.Error("without -mitm-hosts every host must be intercepted")
+	}
+}
+
+func TestForwardIgnoresProxyEnvironment(t *testing.T) {
+	// A client configured through HTTP_PROXY shares its environment with
+	// the proxy, which must not send requests on to itself
+	var reproxied atomic.Bool
+	trap := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reproxied.Store(true)
+	}))
+	defer trap.Close()
+	t.Setenv("HTTP_PROXY", trap.URL)
+	t.Setenv("http_proxy", trap.URL)
+
+	router, err := NewForwardRouter(quietConfig(), nil, nil, PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	// Loopback destinations are never proxied, so name one that only the
+	// trap could answer
+	resp, err := client.Get("http://backend.invalid/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if reproxied.Load() {
+		t.Fatal("forward proxy sent the request to HTTP_PROXY")
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d for an unreachable destination", resp.StatusCode, http.StatusBadGateway)
+	}
+}
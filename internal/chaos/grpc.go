@@ -0,0 +1,330 @@
+package chaos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GRPCStatusCodes maps gRPC status names to their codes
+var GRPCStatusCodes = map[string]int{
+	"OK":                  0,
+	"CANCELLED":           1,
+	"UNKNOWN":             2,
+	"INVALID_ARGUMENT":    3,
+	"DEADLINE_EXCEEDED":   4,
+	"NOT_FOUND":           5,
+	"ALREADY_EXISTS":      6,
+	"PERMISSION_DENIED":   7,
+	"RESOURCE_EXHAUSTED":  8,
+	"FAILED_PRECONDITION": 9,
+	"ABORTED":             10,
+	"OUT_OF_RANGE":        11,
+	"UNIMPLEMENTED":       12,
+	"INTERNAL":            13,
+	"UNAVAILABLE":         14,
+	"DATA_LOSS":           15,
+	"UNAUTHENTICATED":     16,
+}
+
+// grpcStatusDeadlineExceeded is sent when an injected delay or timeout
+// outlasts the client's grpc-timeout
+const grpcStatusDeadlineExceeded = 4
+
+// GRPCConfig controls faults injected on gRPC requests, recognised by
+// their application/grpc content type. gRPC requests get the usual delays,
+// errors and timeouts, but errors are trailers-only responses carrying a
+// grpc-status instead of an HTTP error.
+type GRPCConfig struct {
+	// StatusCodes are the statuses injected as errors, e.g. UNAVAILABLE,
+	// and need no error_codes. When empty, the HTTP error code chosen
+	// from error_codes is mapped to its gRPC status.
+	StatusCodes []string `json:"status_codes,omitempty"`
+
+	// Message is sent as grpc-message; defaults to error_message
+	Message string `json:"message,omitempty"`
+
+	// Methods override the fault settings of matching methods. The first
+	// matching rule applies.
+	Methods []GRPCMethodRule `json:"methods,omitempty"`
+}
+
+// GRPCMethodRule overrides fault settings for some gRPC methods. Unset
+// fields keep the values of the enclosing configuration.
+type GRPCMethodRule struct {
+	// Method is a full method name, /package.Service/Method, or
+	// /package.Service/* for every method of a service
+	Method string `json:"method"`
+
+	DelayProbability   *float64 `json:"delay_probability,omitempty"`
+	ErrorProbability   *float64 `json:"error_probability,omitempty"`
+	TimeoutProbability *float64 `json:"timeout_probability,omitempty"`
+	StatusCodes        []string `json:"status_codes,omitempty"`
+	Message            string   `json:"message,omitempty"`
+}
+
+// matches reports whether the rule applies to the full method name
+func (m GRPCMethodRule) matches(method string) bool {
+	if service, ok := strings.CutSuffix(m.Method, "/*"); ok {
+		return strings.HasPrefix(method, service+"/")
+	}
+	return method == m.Method
+}
+
+func (g GRPCConfig) validate() error {
+	var errs []error
+	if err := validateGRPCStatuses("grpc.status_codes", g.StatusCodes); err != nil {
+		errs = append(errs, err)
+	}
+	for i, m := range g.Methods {
+		field := fmt.Sprintf("grpc.methods[%d]", i)
+		if !strings.HasPrefix(m.Method, "/") || strings.Count(m.Method, "/") != 2 {
+			errs = append(errs, fmt.Errorf("%s.method must look like /package.Service/Method, got %q", field, m.Method))
+		}
+		probabilities := []struct {
+			name  string
+			value *float64
+		}{
+			{"delay_probability", m.DelayProbability},
+			{"error_probability", m.ErrorProbability},
+			{"timeout_probability", m.TimeoutProbability},
+		}
+		for _, p := range probabilities {
+			if p.value != nil && (*p.value < 0 || *p.value > 1) {
+				errs = append(errs, fmt.Errorf("%s.%s must be between 0 and 1, got %v", field, p.name, *p.value))
+			}
+		}
+		if err := validateGRPCStatuses(field+".status_codes", m.StatusCodes); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateGRPCStatuses(field string, names []string) error {
+	for _, name := range names {
+		if code, ok := GRPCStatusCodes[name]; !ok || code == 0 {
+			return fmt.Errorf("%s: %q is not a gRPC error status", field, name)
+		}
+	}
+	return nil
+}
+
+// isGRPC reports whether the request is a gRPC call. gRPC-Web is left
+// alone since it carries its status in the body.
+func isGRPC(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") ||
+		strings.HasPrefix(ct, "application/grpc;")
+}
+
+// forGRPCMethod returns the configuration for a call to method, with the
+// first matching method rule applied
+func (c *ChaosConfig) forGRPCMethod(method string) *ChaosConfig {
+	for _, rule := range c.GRPC.Methods {
+		if !rule.matches(method) {
+			continue
+		}
+		config := *c
+		if rule.DelayProbability != nil {
+			config.DelayProbability = *rule.DelayProbability
+		}
+		if rule.ErrorProbability != nil {
+			config.ErrorProbability = *rule.ErrorProbability
+		}
+		if rule.TimeoutProbability != nil {
+			config.TimeoutProbability = *rule.TimeoutProbability
+		}
+		if len(rule.StatusCodes) > 0 {
+			config.GRPC.StatusCodes = rule.StatusCodes
+		}
+		if rule.Message != "" {
+			config.GRPC.Message = rule.Message
+		}
+		return &config
+	}
+	return c
+}
+
+// pickGRPCStatus chooses the status of an injected gRPC error
+func pickGRPCStatus(config *ChaosConfig, httpCode int) int {
+	if codes := config.GRPC.StatusCodes; len(codes) > 0 {
+		return GRPCStatusCodes[codes[rand.Intn(len(codes))]]
+	}
+	return grpcStatusForHTTP(httpCode)
+}
+
+// grpcStatusForHTTP maps an HTTP status to a gRPC status the way gRPC
+// clients do for responses without a grpc-status
+func grpcStatusForHTTP(code int) int {
+	switch code {
+	case http.StatusBadRequest:
+		return GRPCStatusCodes["INTERNAL"]
+	case http.StatusUnauthorized:
+		return GRPCStatusCodes["UNAUTHENTICATED"]
+	case http.StatusForbidden:
+		return GRPCStatusCodes["PERMISSION_DENIED"]
+	case http.StatusNotFound:
+		return GRPCStatusCodes["UNIMPLEMENTED"]
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return GRPCStatusCodes["UNAVAILABLE"]
+	default:
+		return GRPCStatusCodes["UNKNOWN"]
+	}
+}
+
+// grpcStatusName returns the name of a gRPC status code
+func grpcStatusName(code int) string {
+	for name, c := range GRPCStatusCodes {
+		if c == code {
+			return name
+		}
+	}
+	return strconv.Itoa(code)
+}
+
+// grpcStatusFrom reads the grpc-status sent by the backend, from the
+// headers of a trailers-only response or from the trailers
+func grpcStatusFrom(h http.Header) string {
+	value := h.Get("Grpc-Status")
+	if value == "" {
+		value = h.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	if code, err := strconv.Atoi(value); err == nil {
+		return grpcStatusName(code)
+	}
+	return ""
+}
+
+// applyGRPCError ends the call with a trailers-only response
+func (cm *ChaosMiddleware) applyGRPCError(w http.ResponseWriter, code int, message string) {
+	slog.Debug("injecting gRPC error", "grpc_status", grpcStatusName(code))
+
+	h := w.Header()
+	h.Set("X-Chaos-Injected-Error", grpcStatusName(code))
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	h.Set("Grpc-Message", encodeGRPCMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// applyGRPCDelay waits before the call is proxied, but never past the
+// client's deadline: when the delay outlasts it the call ends with
+// DEADLINE_EXCEEDED and applyGRPCDelay reports false. Otherwise the
+// grpc-timeout sent upstream is reduced by the time spent.
+func (cm *ChaosMiddleware) applyGRPCDelay(w http.ResponseWriter, r *http.Request, delay time.Duration, start time.Time) bool {
+	deadline, hasDeadline := grpcDeadline(r, start)
+	if hasDeadline && time.Now().Add(delay).After(deadline) {
+		slog.Debug("injected delay exceeds gRPC deadline", "delay", delay, "grpc_timeout", r.Header.Get("Grpc-Timeout"))
+		if sleepContext(r.Context(), time.Until(deadline)) {
+			cm.applyGRPCError(w, grpcStatusDeadlineExceeded, "chaos: injected delay exceeded the deadline")
+		}
+		return false
+	}
+
+	slog.Debug("injecting delay", "delay", delay)
+	if !sleepContext(r.Context(), delay) {
+		return false
+	}
+	if hasDeadline {
+		r.Header.Set("Grpc-Timeout", encodeGRPCTimeout(time.Until(deadline)))
+	}
+	return true
+}
+
+// applyGRPCTimeout holds the call for the timeout, or until the client's
+// deadline if that comes first, then fails it with DEADLINE_EXCEEDED
+func (cm *ChaosMiddleware) applyGRPCTimeout(w http.ResponseWriter, r *http.Request, timeout time.Duration, start time.Time) {
+	slog.Debug("injecting timeout", "timeout", timeout)
+
+	if deadline, ok := grpcDeadline(r, start); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	if sleepContext(r.Context(), timeout) {
+		w.Header().Set("X-Chaos-Injected-Timeout", timeout.String())
+		cm.applyGRPCError(w, grpcStatusDeadlineExceeded, "chaos: injected timeout")
+	}
+}
+
+// sleepContext waits for d and reports false if ctx ended first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// grpcTimeoutUnits are the units of the grpc-timeout header, smallest first
+var grpcTimeoutUnits = []struct {
+	unit byte
+	d    time.Duration
+}{
+	{'n', time.Nanosecond},
+	{'u', time.Microsecond},
+	{'m', time.Millisecond},
+	{'S', time.Second},
+	{'M', time.Minute},
+	{'H', time.Hour},
+}
+
+// grpcDeadline returns when the call expires according to its
+// grpc-timeout header, counted from the start of the request
+func grpcDeadline(r *http.Request, start time.Time) (time.Time, bool) {
+	value := r.Header.Get("Grpc-Timeout")
+	if len(value) < 2 || len(value) > 9 {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return time.Time{}, false
+	}
+	for _, u := range grpcTimeoutUnits {
+		if u.unit == value[len(value)-1] {
+			return start.Add(time.Duration(n) * u.d), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// encodeGRPCTimeout formats d for the grpc-timeout header, which allows
+// at most eight digits
+func encodeGRPCTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "0n"
+	}
+	for _, u := range grpcTimeoutUnits {
+		// Round up so the deadline is never brought forward
+		n := (d + u.d - 1) / u.d
+		if n < 1e8 {
+			return strconv.FormatInt(int64(n), 10) + string(u.unit)
+		}
+	}
+	return "99999999H"
+}
+
+// encodeGRPCMessage percent-encodes a grpc-message value
+func encodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
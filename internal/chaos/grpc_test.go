@@ -0,0 +1,161 @@
+package chaos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGRPCDeadline(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		timeout string
+		want    time.Duration
+		ok      bool
+	}{
+		{"100m", 100 * time.Millisecond, true},
+		{"5S", 5 * time.Second, true},
+		{"2M", 2 * time.Minute, true},
+		{"1H", time.Hour, true},
+		{"250u", 250 * time.Microsecond, true},
+		{"99999999n", 99999999 * time.Nanosecond, true},
+		{"", 0, false},
+		{"m", 0, false},
+		{"100", 0, false},
+		{"100x", 0, false},
+		{"-1S", 0, false},
+		{"123456789S", 0, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/pkg.Service/Method", nil)
+		if tt.timeout != "" {
+			r.Header.Set("Grpc-Timeout", tt.timeout)
+		}
+		deadline, ok := grpcDeadline(r, start)
+		if ok != tt.ok || (ok && deadline.Sub(start) != tt.want) {
+			t.Errorf("grpcDeadline(%q) = %v, %v, want %v, %v", tt.timeout, deadline.Sub(start), ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestEncodeGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0n"},
+		{-time.Second, "0n"},
+		{1500 * time.Nanosecond, "1500n"},
+		{time.Second, "1000000u"},
+		{150 * time.Second, "150000m"},
+		{100001*time.Millisecond + 1, "100002m"},
+		{30 * 24 * time.Hour, "2592000S"},
+	}
+	for _, tt := range tests {
+		got := encodeGRPCTimeout(tt.d)
+		if got != tt.want {
+			t.Errorf("encodeGRPCTimeout(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+		if len(got) > 9 {
+			t.Errorf("encodeGRPCTimeout(%v) = %q has more than eight digits", tt.d, got)
+		}
+
+		// The encoded timeout never ends before the original one
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("Grpc-Timeout", got)
+		if deadline, ok := grpcDeadline(r, time.Time{}); !ok || deadline.Sub(time.Time{}) < tt.d {
+			t.Errorf("encodeGRPCTimeout(%v) = %q decodes to %v", tt.d, got, deadline.Sub(time.Time{}))
+		}
+	}
+}
+
+func TestGRPCMethodRules(t *testing.T) {
+	none, half := 0.0, 0.5
+	config := quietConfig()
+	config.DelayProbability = 0.2
+	config.GRPC = GRPCConfig{
+		StatusCodes: []string{"INTERNAL"},
+		Methods: []GRPCMethodRule{
+			{Method: "/pkg.Orders/Create", ErrorProbability: &half, StatusCodes: []string{"UNAVAILABLE"}},
+			{Method: "/pkg.Orders/*", DelayProbability: &none, Message: "orders down"},
+			{Method: "/pkg.Orders/Create", ErrorProbability: &none},
+		},
+	}
+
+	tests := []struct {
+		method   string
+		delay    float64
+		errors   float64
+		statuses string
+		message  string
+	}{
+		{"/pkg.Orders/Create", 0.2, 0.5, "UNAVAILABLE", ""},
+		{"/pkg.Orders/List", 0, 0, "INTERNAL", "orders down"},
+		{"/pkg.Ordersx/List", 0.2, 0, "INTERNAL", ""},
+		{"/pkg.Users/Get", 0.2, 0, "INTERNAL", ""},
+	}
+	for _, tt := range tests {
+		got := config.forGRPCMethod(tt.method)
+		if got.DelayProbability != tt.delay || got.ErrorProbability != tt.errors ||
+			strings.Join(got.GRPC.StatusCodes, ",") != tt.statuses || got.GRPC.Message != tt.message {
+			t.Errorf("%s: delay %v, error %v, statuses %v, message %q, want %v, %v, %v, %q", tt.method,
+				got.DelayProbability, got.ErrorProbability, got.GRPC.StatusCodes, got.GRPC.Message,
+				tt.delay, tt.errors, tt.statuses, tt.message)
+		}
+	}
+	if config.ErrorProbability != 0 || config.GRPC.StatusCodes[0] != "INTERNAL" {
+		t.Error("forGRPCMethod modified the enclosing configuration")
+	}
+}
+
+func grpcRequest(method string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, method, strings.NewReader(""))
+	r.Header.Set("Content-Type", "application/grpc")
+	return r
+}
+
+func TestGRPCErrorIsTrailersOnly(t *testing.T) {
+	always := 1.0
+	config := quietConfig()
+	config.ErrorCodes = nil
+	config.GRPC = GRPCConfig{
+		Message: "chaos: 100% broken",
+		Methods: []GRPCMethodRule{
+			{Method: "/pkg.Orders/*", ErrorProbability: &always, StatusCodes: []string{"UNAVAILABLE"}},
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	var backendCalled atomic.Bool
+	cm := newTestProxy(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalled.Store(true)
+	}))
+
+	w := httptest.NewRecorder()
+	cm.ServeHTTP(w, grpcRequest("/pkg.Orders/Create"))
+	if backendCalled.Load() {
+		t.Error("failed call reached the backend")
+	}
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("status %d with %d body bytes, want 200 without a body", w.Code, w.Body.Len())
+	}
+	h := w.Header()
+	if h.Get("Content-Type") != "application/grpc" || h.Get("Grpc-Status") != "14" ||
+		h.Get("Grpc-Message") != "chaos: 100%25 broken" {
+		t.Errorf("headers %v, want a trailers-only UNAVAILABLE response", h)
+	}
+	if got := cm.stats.snapshot(false)["by_grpc_status"].(map[string]int64)["UNAVAILABLE"]; got != 1 {
+		t.Errorf("UNAVAILABLE calls = %d, want 1", got)
+	}
+
+	// Methods without a rule keep the quiet configuration
+	w = httptest.NewRecorder()
+	cm.ServeHTTP(w, grpcRequest("/pkg.Users/Get"))
+	if !backendCalled.Load() || w.Header().Get("Grpc-Status") != "" {
+		t.Errorf("untouched method: backend called %v, grpc-status %q", backendCalled.Load(), w.Header().Get("Grpc-Status"))
+	}
+}
@@ -2,8 +2,12 @@ package chaos
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -11,11 +15,29 @@ func (cm *ChaosMiddleware) handleManagement(w http.ResponseWriter, r *http.Reque
 	switch r.URL.Path {
 	case "/_chaos/config":
 		cm.handleConfigEndpoint(w, r)
+	case "/_chaos/config/history":
+		cm.handleConfigHistoryEndpoint(w, r)
+	case "/_chaos/config/versions":
+		cm.handleConfigVersionsEndpoint(w, r)
+	case "/_chaos/config/rollback":
+		cm.handleConfigRollbackEndpoint(w, r)
 	case "/_chaos/stats":
 		cm.handleStatsEndpoint(w, r)
 	case "/_chaos/health":
 		cm.handleHealthEndpoint(w, r)
+	case "/_chaos/events":
+		cm.handleEventsEndpoint(w, r)
+	case "/_chaos/capture.har":
+		cm.handleCaptureEndpoint(w, r)
+	case "/_chaos/backends":
+		cm.handleBackendsEndpoint(w, r)
+	case "/_chaos/profiles":
+		cm.handleProfilesEndpoint(w, r)
 	default:
+		if strings.HasPrefix(r.URL.Path, "/_chaos/profiles/") {
+			cm.handleProfileEndpoint(w, r)
+			return
+		}
 		http.NotFound(w, r)
 	}
 }
@@ -23,44 +45,237 @@ func (cm *ChaosMiddleware) handleManagement(w http.ResponseWriter, r *http.Reque
 func (cm *ChaosMiddleware) handleConfigEndpoint(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(cm.config)
+		current := cm.ConfigVersion()
+		setVersionHeaders(w, current)
+		if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, current.ETag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		format := acceptedFormat(r.Header.Get("Accept"))
+		data, err := encodeAs(current.Config, format)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", mediaTypeFor(format))
+		w.Header().Add("Vary", "Accept")
+		w.Write(data)
 	case http.MethodPost, http.MethodPut:
-		var newConfig ChaosConfig
-		if err := json.NewDecoder(r.Body).Decode(&newConfig); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		// Both replace the whole configuration
+		newConfig := &ChaosConfig{}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read body", http.StatusBadRequest)
 			return
 		}
-		cm.config = &newConfig
-		log.Printf("🔧 Configuration updated")
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
+		format := formatFromMediaType(r.Header.Get("Content-Type"))
+		if err := decodeInto(body, format, newConfig); err != nil {
+			http.Error(w, "Invalid "+strings.ToUpper(format)+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := newConfig.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		version, changes, err := cm.UpdateConfig(newConfig, changeFromRequest(r))
+		cm.writeUpdateResult(w, version, changes, err)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func (cm *ChaosMiddleware) handleStatsEndpoint(w http.ResponseWriter, r *http.Request) {
-	stats := map[string]interface{}{
-		"total_requests":   cm.statsTotal,
-		"delays_injected":  cm.statsDelay,
-		"errors_injected":  cm.statsError,
-		"delay_percentage": float64(cm.statsDelay) / float64(cm.statsTotal) * 100,
-		"error_percentage": float64(cm.statsError) / float64(cm.statsTotal) * 100,
-		"uptime":           time.Since(cm.startTime).String(),
-		"config":           cm.config,
+func (cm *ChaosMiddleware) handleConfigVersionsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cm.mu.RLock()
+	versions := cm.versions.list()
+	cm.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"current":  versions[len(versions)-1].Version,
+		"versions": versions,
+	})
+}
+
+func (cm *ChaosMiddleware) handleConfigRollbackEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	target, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil {
+		http.Error(w, "Invalid or missing version", http.StatusBadRequest)
+		return
+	}
+
+	version, changes, err := cm.Rollback(target, changeFromRequest(r))
+	if errors.Is(err, ErrUnknownVersion) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	cm.writeUpdateResult(w, version, changes, err)
+}
+
+// writeUpdateResult reports the outcome of a configuration change
+func (cm *ChaosMiddleware) writeUpdateResult(w http.ResponseWriter, version ConfigVersion, changes []FieldChange, err error) {
+	if errors.Is(err, ErrVersionConflict) {
+		setVersionHeaders(w, cm.ConfigVersion())
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setVersionHeaders(w, version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "updated",
+		"version": version.Version,
+		"etag":    version.ETag,
+		"changes": changes,
+	})
+}
+
+func setVersionHeaders(w http.ResponseWriter, version ConfigVersion) {
+	w.Header().Set("ETag", version.ETag)
+	w.Header().Set("X-Chaos-Config-Version", strconv.Itoa(version.Version))
+}
+
+func (cm *ChaosMiddleware) handleConfigHistoryEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": cm.audit.history(r.URL.Query().Get("source"), cm.name, limit),
+	})
+}
+
+func (cm *ChaosMiddleware) handleBackendsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"balance":  cm.pool.config.Balance,
+		"backends": cm.pool.status(),
+	})
+}
+
+func (cm *ChaosMiddleware) handleProfilesEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"profiles": cm.profiles.List(),
+	})
+}
+
+// handleProfileEndpoint serves GET /_chaos/profiles/{name} and
+// POST /_chaos/profiles/{name}/apply
+func (cm *ChaosMiddleware) handleProfileEndpoint(w http.ResponseWriter, r *http.Request) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/_chaos/profiles/"), "/")
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		profile, err := cm.profiles.Get(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profile)
+	case action == "apply" && r.Method == http.MethodPost:
+		version, changes, err := cm.ApplyProfile(name, changeFromRequest(r))
+		if errors.Is(err, ErrUnknownProfile) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil && !errors.Is(err, ErrVersionConflict) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cm.writeUpdateResult(w, version, changes, err)
+	case action == "" || action == "apply":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (cm *ChaosMiddleware) handleStatsEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		stats := cm.stats.snapshot(cm.Config().DryRun)
+		stats["uptime"] = time.Since(cm.startTime).String()
+		stats["config"] = cm.Config()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	case http.MethodDelete:
+		cm.stats.reset()
+		slog.Info("statistics reset")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "reset"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (cm *ChaosMiddleware) handleCaptureEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="phailure-capture.har"`)
+		json.NewEncoder(w).Encode(cm.capture.har())
+	case http.MethodDelete:
+		cm.capture.clear()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "cleared"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
 }
 
 func (cm *ChaosMiddleware) handleHealthEndpoint(w http.ResponseWriter, r *http.Request) {
+	mode := "enabled"
+	if cm.Config().DryRun {
+		mode = "dry-run"
+	}
+
 	health := map[string]interface{}{
 		"status":    "healthy",
-		"chaos":     "enabled",
+		"chaos":     mode,
 		"timestamp": time.Now().Format(time.RFC3339),
-		"target":    cm.targetURL.String(),
+		"target":    cm.pool.String(),
+	}
+	if len(cm.pool.backends) > 1 {
+		health["backends_available"] = cm.pool.available()
+		health["backends_total"] = len(cm.pool.backends)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,115 @@
+package chaos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// configRequest sends a request to /_chaos/config, with If-Match when
+// ifMatch is set
+func configRequest(cm *ChaosMiddleware, method, body, ifMatch string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/_chaos/config", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	cm.ServeHTTP(w, r)
+	return w
+}
+
+func TestConfigUpdateReplacesWholeConfiguration(t *testing.T) {
+	for _, method := range []string{http.MethodPost, http.MethodPut} {
+		t.Run(method, func(t *testing.T) {
+			config := quietConfig()
+			config.DelayProbability = 0.5
+			cm := newTestProxy(t, config, http.NotFoundHandler())
+
+			w := configRequest(cm, method, `{"error_enabled": true, "error_probability": 0.2, "error_codes": [503]}`, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			got := cm.Config()
+			if got.ErrorProbability != 0.2 || len(got.ErrorCodes) != 1 || got.ErrorCodes[0] != 503 {
+				t.Errorf("error settings %v %v, want 0.2 [503]", got.ErrorProbability, got.ErrorCodes)
+			}
+			if got.DelayProbability != 0 {
+				t.Errorf("delay_probability = %v, want 0 since the body left it out", got.DelayProbability)
+			}
+		})
+	}
+}
+
+func TestConfigUpdateRejectsInvalidConfiguration(t *testing.T) {
+	cm := newTestProxy(t, quietConfig(), http.NotFoundHandler())
+	before := cm.ConfigVersion()
+
+	for _, body := range []string{`{"error_probability": 2}`, `{not json`} {
+		if w := configRequest(cm, http.MethodPut, body, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, w.Code)
+		}
+	}
+	if after := cm.ConfigVersion(); after.Version != before.Version {
+		t.Errorf("version %d after rejected updates, want %d", after.Version, before.Version)
+	}
+}
+
+func TestConfigETag(t *testing.T) {
+	cm := newTestProxy(t, quietConfig(), http.NotFoundHandler())
+
+	w := configRequest(cm, http.MethodGet, "", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Header().Get("X-Chaos-Config-Version") != "1" {
+		t.Fatalf("GET: status %d, ETag %q, version %q", w.Code, etag, w.Header().Get("X-Chaos-Config-Version"))
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/_chaos/config", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	cm.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("GET with the current ETag: status %d, want 304 without a body", w.Code)
+	}
+
+	// An update gets a new ETag, returned with the response
+	w = configRequest(cm, http.MethodPut, `{"delay_probability": 0.1}`, "")
+	if updated := w.Header().Get("ETag"); w.Code != http.StatusOK || updated == "" || updated == etag {
+		t.Errorf("PUT: status %d, ETag %q, want a new one", w.Code, updated)
+	}
+	if got := cm.ConfigVersion().ETag; got != w.Header().Get("ETag") {
+		t.Errorf("current ETag %q differs from the one returned %q", got, w.Header().Get("ETag"))
+	}
+}
+
+func TestConfigIfMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		ifMatch func(current string) string
+		status  int
+	}{
+		{"current", func(current string) string { return current }, http.StatusOK},
+		{"weak current", func(current string) string { return "W/" + current }, http.StatusOK},
+		{"any", func(string) string { return "*" }, http.StatusOK},
+		{"one of several", func(current string) string { return `"stale", ` + current }, http.StatusOK},
+		{"stale", func(string) string { return `"stale"` }, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := newTestProxy(t, quietConfig(), http.NotFoundHandler())
+			current := cm.ConfigVersion()
+
+			w := configRequest(cm, http.MethodPut, `{"delay_probability": 0.1}`, tt.ifMatch(current.ETag))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusPreconditionFailed {
+				// The conflict reports the version to start again from
+				if w.Header().Get("ETag") != current.ETag || cm.ConfigVersion().Version != current.Version {
+					t.Errorf("conflict applied the update or reported ETag %q, want %q", w.Header().Get("ETag"), current.ETag)
+				}
+			}
+		})
+	}
+}
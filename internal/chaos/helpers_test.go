@@ -0,0 +1,40 @@
+package chaos
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Every proxied request logs a line; keep test output readable
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// quietConfig returns a valid configuration that injects no fault
+func quietConfig() *ChaosConfig {
+	config := DefaultConfig()
+	config.DelayProbability = 0
+	config.ErrorProbability = 0
+	config.TimeoutProbability = 0
+	return config
+}
+
+// newTestProxy starts backend and returns a middleware proxying to it
+func newTestProxy(t *testing.T, config *ChaosConfig, backend http.Handler) *ChaosMiddleware {
+	t.Helper()
+	srv := httptest.NewServer(backend)
+	t.Cleanup(srv.Close)
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := NewChaosMiddleware(config, target)
+	t.Cleanup(func() { cm.Close() })
+	return cm
+}
@@ -0,0 +1,192 @@
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// HTTP/2 faults injected on the streams of the proxy listener
+const (
+	HTTP2FaultRSTStream  = "rst_stream"
+	HTTP2FaultGoAway     = "goaway"
+	HTTP2FaultStarvation = "flow_control_starvation"
+)
+
+// HTTP2ErrorCodes maps the error code names accepted in configuration to
+// their values (RFC 9113, section 7)
+var HTTP2ErrorCodes = map[string]uint32{
+	"NO_ERROR":            0x0,
+	"PROTOCOL_ERROR":      0x1,
+	"INTERNAL_ERROR":      0x2,
+	"FLOW_CONTROL_ERROR":  0x3,
+	"SETTINGS_TIMEOUT":    0x4,
+	"STREAM_CLOSED":       0x5,
+	"FRAME_SIZE_ERROR":    0x6,
+	"REFUSED_STREAM":      0x7,
+	"CANCEL":              0x8,
+	"COMPRESSION_ERROR":   0x9,
+	"CONNECT_ERROR":       0xa,
+	"ENHANCE_YOUR_CALM":   0xb,
+	"INADEQUATE_SECURITY": 0xc,
+	"HTTP_1_1_REQUIRED":   0xd,
+}
+
+// h2cScheme marks targets reached with cleartext HTTP/2 (prior knowledge)
+const h2cScheme = "h2c"
+
+// HTTP2FaultConfig sets the probability of each HTTP/2 fault per stream
+// opened on the proxy listener. A stream gets at most one fault, so the
+// probabilities add up to at most 1. It has no effect on HTTP/1 clients.
+type HTTP2FaultConfig struct {
+	// RSTStreamProbability resets the stream with RSTStreamCode
+	// (default INTERNAL_ERROR) as soon as the request arrives
+	RSTStreamProbability float64 `json:"rst_stream_probability,omitempty"`
+	RSTStreamCode        string  `json:"rst_stream_code,omitempty"`
+
+	// GoAwayProbability sends GOAWAY with GoAwayCode (default NO_ERROR),
+	// rejecting the stream and every later one on the connection
+	GoAwayProbability float64 `json:"goaway_probability,omitempty"`
+	GoAwayCode        string  `json:"goaway_code,omitempty"`
+
+	// StarvationProbability withholds WINDOW_UPDATE frames of the stream in
+	// both directions for StarvationDuration (default 5s), stalling bodies
+	// larger than the peer's flow-control window
+	StarvationProbability float64  `json:"starvation_probability,omitempty"`
+	StarvationDuration    Duration `json:"starvation_duration,omitempty"`
+}
+
+// Enabled reports whether any HTTP/2 fault can be injected
+func (h HTTP2FaultConfig) Enabled() bool {
+	return h.RSTStreamProbability > 0 || h.GoAwayProbability > 0 || h.StarvationProbability > 0
+}
+
+func (h HTTP2FaultConfig) validate() error {
+	var errs []error
+	probabilities := []struct {
+		name  string
+		value float64
+	}{
+		{"rst_stream_probability", h.RSTStreamProbability},
+		{"goaway_probability", h.GoAwayProbability},
+		{"starvation_probability", h.StarvationProbability},
+	}
+	var total float64
+	for _, p := range probabilities {
+		if p.value < 0 || p.value > 1 {
+			errs = append(errs, fmt.Errorf("http2_faults.%s must be between 0 and 1, got %v", p.name, p.value))
+		}
+		total += p.value
+	}
+	// A stream gets at most one fault
+	if total > 1+probabilityTolerance {
+		errs = append(errs, fmt.Errorf("http2_faults probabilities add up to %v, more than 1", total))
+	}
+	for name, code := range map[string]string{"rst_stream_code": h.RSTStreamCode, "goaway_code": h.GoAwayCode} {
+		if _, ok := HTTP2ErrorCodes[code]; code != "" && !ok {
+			errs = append(errs, fmt.Errorf("http2_faults.%s: unknown HTTP/2 error code %q", name, code))
+		}
+	}
+	if h.StarvationDuration.Duration < 0 {
+		errs = append(errs, errors.New("http2_faults.starvation_duration must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// HTTP2Fault is the fault chosen for one HTTP/2 stream
+type HTTP2Fault struct {
+	Kind string
+
+	// Code is the error code of RST_STREAM and GOAWAY frames
+	Code uint32
+
+	// Duration is how long flow control is starved
+	Duration time.Duration
+}
+
+// DecideHTTP2Fault picks the HTTP/2 fault for a stream opened with request
+// r, which carries the request headers but no body. It reports false when
+// the stream must be left alone, including in dry run.
+func (cm *ChaosMiddleware) DecideHTTP2Fault(r *http.Request) (HTTP2Fault, bool) {
+	config := cm.Config()
+	faults := config.HTTP2Faults
+	if !faults.Enabled() || !cm.shouldApplyChaos(config, r) {
+		return HTTP2Fault{}, false
+	}
+
+	// A single draw picks at most one fault, each with its own
+	// probability, against thresholds adding up the probabilities
+	draw, threshold := rand.Float64(), 0.0
+	below := func(p float64) bool {
+		threshold += p
+		return draw < threshold
+	}
+	var fault HTTP2Fault
+	switch {
+	case below(faults.GoAwayProbability):
+		fault = HTTP2Fault{Kind: HTTP2FaultGoAway, Code: HTTP2ErrorCodes[faults.GoAwayCode]}
+	case below(faults.RSTStreamProbability):
+		fault = HTTP2Fault{Kind: HTTP2FaultRSTStream, Code: HTTP2ErrorCodes["INTERNAL_ERROR"]}
+		if faults.RSTStreamCode != "" {
+			fault.Code = HTTP2ErrorCodes[faults.RSTStreamCode]
+		}
+	case below(faults.StarvationProbability):
+		fault = HTTP2Fault{Kind: HTTP2FaultStarvation, Duration: faults.StarvationDuration.Duration}
+		if fault.Duration == 0 {
+			fault.Duration = 5 * time.Second
+		}
+	default:
+		return HTTP2Fault{}, false
+	}
+
+	attrs := []any{"fault", fault.Kind, "rule", cm.name, "method", r.Method,
+		"path", r.URL.Path, "remote_addr", r.RemoteAddr}
+	if fault.Kind == HTTP2FaultStarvation {
+		attrs = append(attrs, "duration", fault.Duration)
+	} else {
+		attrs = append(attrs, "code", fault.Code)
+	}
+	if config.DryRun {
+		slog.Info("dry run, would inject HTTP/2 fault", attrs...)
+		return HTTP2Fault{}, false
+	}
+	slog.Info("injecting HTTP/2 fault", attrs...)
+	cm.stats.recordHTTP2Fault(fault.Kind)
+	return fault, true
+}
+
+// upstreamTransport sends requests for h2c:// targets over cleartext
+// HTTP/2, requests for unix:// targets over their socket and every other
+// request over base
+type upstreamTransport struct {
+	base http.RoundTripper
+	h2c  http.RoundTripper
+	unix http.RoundTripper
+}
+
+func newUpstreamTransport(base http.RoundTripper) *upstreamTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	h2c := http.DefaultTransport.(*http.Transport).Clone()
+	h2c.Protocols = new(http.Protocols)
+	h2c.Protocols.SetUnencryptedHTTP2(true)
+	return &upstreamTransport{base: base, h2c: h2c, unix: newUnixTransport()}
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.URL.Scheme {
+	case h2cScheme:
+		out := req.Clone(req.Context())
+		out.URL.Scheme = "http"
+		return t.h2c.RoundTrip(out)
+	case unixScheme:
+		return t.unix.RoundTrip(req)
+	default:
+		return t.base.RoundTrip(req)
+	}
+}
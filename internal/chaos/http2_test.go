@@ -0,0 +1,31 @@
+package chaos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTP2FaultsAreExclusive(t *testing.T) {
+	config := quietConfig()
+	config.HTTP2Faults = HTTP2FaultConfig{GoAwayProbability: 0.5, RSTStreamProbability: 0.5}
+	cm := newTestProxy(t, config, http.NotFoundHandler())
+
+	// The probabilities add up to 1, so every stream gets one fault
+	kinds := map[string]int{}
+	for i := 0; i < 200; i++ {
+		fault, ok := cm.DecideHTTP2Fault(httptest.NewRequest(http.MethodGet, "/", nil))
+		if !ok {
+			t.Fatalf("stream %d got no fault", i)
+		}
+		kinds[fault.Kind]++
+	}
+	if kinds[HTTP2FaultGoAway] == 0 || kinds[HTTP2FaultRSTStream] == 0 {
+		t.Errorf("faults %v, want both kinds", kinds)
+	}
+
+	config.HTTP2Faults.StarvationProbability = 0.1
+	if err := config.Validate(); err == nil {
+		t.Error("probabilities adding up to more than 1 accepted")
+	}
+}
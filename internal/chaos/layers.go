@@ -0,0 +1,294 @@
+package chaos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is the prefix of environment variables that set configuration
+// fields, e.g. PHAILURE_ERROR_PROBABILITY=0.2 or PHAILURE_TARGETING__FRACTION=0.1
+// (a double underscore separates nested fields)
+const EnvPrefix = "PHAILURE_"
+
+// Source names reported by ConfigLayers.Load, lowest precedence first
+const (
+	SourceDefaults    = "defaults"
+	SourceProfile     = "profile"
+	SourceDefaultFile = "default-file"
+	SourceFile        = "file"
+	SourceEnv         = "env"
+	SourceFlag        = "flag"
+)
+
+// DefaultConfig returns the built-in configuration used before any file,
+// environment variable or flag is applied
+func DefaultConfig() *ChaosConfig {
+	config, _ := NewConfigFromFlags(100*time.Millisecond, 2*time.Second, 0.1, 0.05,
+		"500,502,503,504", "Chaos engineering fault injection", 30*time.Second, 0.02)
+	// Once enabled, targeting covers every client until narrowed down
+	config.Targeting.Fraction = 1
+	return config
+}
+
+// DefaultConfigPath returns the first existing file among
+// ~/.phailure/config.{json,yaml,yml,toml}, or "" if there is none
+func DefaultConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	for _, ext := range []string{".json", ".yaml", ".yml", ".toml"} {
+		path := filepath.Join(home, ".phailure", "config"+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// ConfigLayers builds a configuration from, in increasing precedence:
+// built-in defaults, the selected profile, the default config file, the
+// -config file, PHAILURE_* environment variables and explicitly set flags
+type ConfigLayers struct {
+	Defaults    *ChaosConfig
+	Profile     *Profile
+	DefaultFile string
+	File        string
+	Environ     []string
+
+	// Flags maps dotted field names (e.g. "targeting.fraction") to the raw
+	// values of flags that were set explicitly on the command line
+	Flags map[string]string
+}
+
+// FieldSource records which layer set a configuration field
+type FieldSource struct {
+	Field  string
+	Value  interface{}
+	Source string
+}
+
+// Load merges every layer into a configuration and reports, for each field,
+// the layer its value came from
+func (l *ConfigLayers) Load() (*ChaosConfig, []FieldSource, error) {
+	fields := configFields(reflect.TypeOf(ChaosConfig{}), "")
+	values := map[string]interface{}{}
+	sources := map[string]string{}
+
+	set := func(tree map[string]interface{}, source string) {
+		flat := map[string]interface{}{}
+		flattenInto(flat, "", tree)
+		for name, value := range flat {
+			values[name] = value
+			sources[name] = source
+		}
+	}
+
+	defaults := l.Defaults
+	if defaults == nil {
+		defaults = DefaultConfig()
+	}
+	set(configTree(defaults), SourceDefaults)
+	if l.Profile != nil {
+		set(l.Profile.Values, SourceProfile+" "+l.Profile.Name)
+	}
+
+	for _, file := range []struct{ path, source string }{
+		{l.DefaultFile, SourceDefaultFile},
+		{l.File, SourceFile},
+	} {
+		if file.path == "" {
+			continue
+		}
+		tree, err := readConfigTree(file.path)
+		if err != nil {
+			return nil, nil, err
+		}
+		set(tree, file.source+" "+file.path)
+	}
+
+	var errs []error
+	for _, kv := range l.Environ {
+		name, raw, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		field := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(name, EnvPrefix), "__", "."))
+		kind, ok := fields[field]
+		if !ok {
+			continue
+		}
+		value, err := parseFieldValue(kind, raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		values[field] = value
+		sources[field] = SourceEnv + " " + name
+	}
+
+	for field, raw := range l.Flags {
+		kind, ok := fields[field]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown configuration field %q", field))
+			continue
+		}
+		value, err := parseFieldValue(kind, raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("flag for %s: %w", field, err))
+			continue
+		}
+		values[field] = value
+		sources[field] = SourceFlag
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, nil, err
+	}
+
+	data, err := json.Marshal(unflatten(values))
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &ChaosConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, nil, err
+	}
+
+	// Report the effective value of every field, including those only
+	// present as zero values after decoding
+	effective := map[string]interface{}{}
+	flattenInto(effective, "", configTree(config))
+	report := make([]FieldSource, 0, len(effective))
+	for name, value := range effective {
+		source := sources[name]
+		if source == "" {
+			source = SourceDefaults
+		}
+		report = append(report, FieldSource{Field: name, Value: value, Source: source})
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Field < report[j].Field })
+
+	return config, report, nil
+}
+
+// readConfigTree decodes a configuration file of any supported format into
+// a generic tree keyed by JSON field names
+func readConfigTree(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tree := map[string]interface{}{}
+	if err := decodeInto(data, FormatFromPath(path), &tree); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return tree, nil
+}
+
+func configTree(c *ChaosConfig) map[string]interface{} {
+	data, _ := json.Marshal(c)
+	tree := map[string]interface{}{}
+	json.Unmarshal(data, &tree)
+	return tree
+}
+
+// unflatten turns dotted field names back into nested objects
+func unflatten(values map[string]interface{}) map[string]interface{} {
+	tree := map[string]interface{}{}
+	for name, value := range values {
+		parts := strings.Split(name, ".")
+		node := tree
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[part] = child
+			}
+			node = child
+		}
+		node[parts[len(parts)-1]] = value
+	}
+	return tree
+}
+
+var durationType = reflect.TypeOf(Duration{})
+
+// configFields lists every settable field of a configuration struct by its
+// dotted JSON name
+func configFields(t reflect.Type, prefix string) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft != durationType {
+			for nested, kind := range configFields(ft, name) {
+				fields[nested] = kind
+			}
+			continue
+		}
+		fields[name] = ft
+	}
+	return fields
+}
+
+// parseFieldValue converts a raw string from the environment or a flag
+// into a JSON-compatible value for a field of type t. Lists are
+// comma-separated.
+func parseFieldValue(t reflect.Type, raw string) (interface{}, error) {
+	if t == durationType {
+		return raw, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return strconv.ParseBool(raw)
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		return strconv.Atoi(strings.TrimSpace(raw))
+	case reflect.Float64, reflect.Float32:
+		return strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	case reflect.String:
+		return raw, nil
+	case reflect.Slice:
+		items := []interface{}{}
+		for _, item := range strings.Split(raw, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			value, err := parseFieldValue(t.Elem(), item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		return items, nil
+	case reflect.Map:
+		tree := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(raw), &tree); err != nil {
+			return nil, fmt.Errorf("expected a JSON object: %w", err)
+		}
+		return tree, nil
+	default:
+		return nil, fmt.Errorf("unsupported field type %s", t)
+	}
+}
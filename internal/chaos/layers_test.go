@@ -0,0 +1,57 @@
+package chaos
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigLayersPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	defaultFile := write("default.json", `{"error_probability": 0.1}`)
+	file := write("config.yaml", "error_probability: 0.2\n")
+	env := []string{"PHAILURE_ERROR_PROBABILITY=0.3", "HOME=/nowhere"}
+	flags := map[string]string{"error_probability": "0.4"}
+
+	tests := []struct {
+		name   string
+		layers ConfigLayers
+		want   float64
+		source string
+	}{
+		{"defaults", ConfigLayers{}, 0.05, SourceDefaults},
+		{"default file", ConfigLayers{DefaultFile: defaultFile}, 0.1, SourceDefaultFile},
+		{"file over default file", ConfigLayers{DefaultFile: defaultFile, File: file}, 0.2, SourceFile},
+		{"env over file", ConfigLayers{File: file, Environ: env}, 0.3, SourceEnv},
+		{"flag over env", ConfigLayers{File: file, Environ: env, Flags: flags}, 0.4, SourceFlag},
+		{"flag over file", ConfigLayers{File: file, Flags: flags}, 0.4, SourceFlag},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, report, err := tt.layers.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.ErrorProbability != tt.want {
+				t.Errorf("error_probability = %v, want %v", config.ErrorProbability, tt.want)
+			}
+			for _, fs := range report {
+				if fs.Field == "error_probability" && !strings.HasPrefix(fs.Source, tt.source) {
+					t.Errorf("source %q, want %s", fs.Source, tt.source)
+				}
+			}
+			// Fields no layer sets keep their default
+			if config.DelayProbability != 0.1 {
+				t.Errorf("delay_probability = %v, want the default 0.1", config.DelayProbability)
+			}
+		})
+	}
+}
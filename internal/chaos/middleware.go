@@ -3,66 +3,356 @@ package chaos
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // ChaosMiddleware represents the chaos engineering middleware
 type ChaosMiddleware struct {
-	config     *ChaosConfig
-	next       http.Handler
-	proxy      *httputil.ReverseProxy
-	targetURL  *url.URL
-	statsDelay int64
-	statsError int64
-	statsTotal int64
-	startTime  time.Time
+	// name identifies the route this middleware serves; it is reported as
+	// the rule in logs, stats, events and the audit trail
+	name        string
+	stripPrefix string
+
+	mu        sync.RWMutex
+	config    *ChaosConfig
+	versions  versionStore
+	next      http.Handler
+	proxy     *httputil.ReverseProxy
+	pool      *pool
+	startTime time.Time
+
+	// connect serves CONNECT requests once chaos was applied; it is only
+	// set in forward mode
+	connect func(w http.ResponseWriter, r *http.Request, b *backend)
+
+	stats    *statsCollector
+	events   *eventHub
+	capture  *captureBuffer
+	audit    *auditLog
+	profiles *ProfileLibrary
 }
 
 // NewChaosMiddleware creates a new chaos middleware
 func NewChaosMiddleware(config *ChaosConfig, targetURL *url.URL) *ChaosMiddleware {
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	return NewPoolMiddleware(config, []*url.URL{targetURL}, PoolConfig{})
+}
 
-	originalDirector := proxy.Director
-	proxy.Director = func(req *http.Request) {
-		originalDirector(req)
-		req.Host = targetURL.Host
-	}
+// NewPoolMiddleware creates a chaos middleware balancing requests over
+// several backends
+func NewPoolMiddleware(config *ChaosConfig, targets []*url.URL, poolConfig PoolConfig) *ChaosMiddleware {
+	return newMiddleware(config, newPool(targets, poolConfig, false))
+}
+
+// NewForwardMiddleware creates a chaos middleware for an explicit proxy,
+// sending each request to the destination it names
+func NewForwardMiddleware(config *ChaosConfig, poolConfig PoolConfig) *ChaosMiddleware {
+	return newMiddleware(config, newForwardPool(poolConfig))
+}
 
-	return &ChaosMiddleware{
+func newMiddleware(config *ChaosConfig, pool *pool) *ChaosMiddleware {
+	cm := &ChaosMiddleware{
+		name:      defaultRule,
 		config:    config,
-		proxy:     proxy,
-		targetURL: targetURL,
+		pool:      pool,
 		startTime: time.Now(),
+		stats:     newStatsCollector(),
+		events:    newEventHub(),
+		capture:   &captureBuffer{},
+		audit:     &auditLog{},
+		profiles:  BuiltinProfiles(),
 	}
+
+	proxy := &httputil.ReverseProxy{Transport: cm.pool.transport}
+	proxy.Director = func(req *http.Request) {
+		if cm.stripPrefix != "" {
+			req.URL.Path = "/" + strings.TrimLeft(strings.TrimPrefix(req.URL.Path, cm.stripPrefix), "/")
+			req.URL.RawPath = ""
+		}
+		var b *backend
+		if rec := recordFrom(req.Context()); rec != nil && rec.backend != nil {
+			b = rec.backend
+		} else if cm.pool.forward {
+			b = cm.pool.pickFor(req)
+		} else {
+			b = cm.pool.backends[0]
+		}
+		b.director(req)
+		req.Host = b.url.Host
+	}
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if rec := recordFrom(resp.Request.Context()); rec != nil {
+			rec.UpstreamStatus = resp.StatusCode
+			if resp.StatusCode == http.StatusSwitchingProtocols && rec.webSocket != nil {
+				if conn, ok := resp.Body.(io.ReadWriteCloser); ok {
+					resp.Body = newWebSocketStream(conn, rec.webSocket, cm.stats, rec.ID)
+				}
+			}
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		var id string
+		if rec := recordFrom(r.Context()); rec != nil {
+			id = rec.ID
+		}
+		slog.Warn("upstream request failed", "request_id", id, "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	cm.proxy = proxy
+	cm.versions.add(config, ConfigChange{Source: ConfigSourceStartup})
+
+	return cm
+}
+
+// Config returns the configuration currently in effect
+func (cm *ChaosMiddleware) Config() *ChaosConfig {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.config
+}
+
+// UpdateConfig swaps in a new configuration as a new version and records
+// the change in the audit log. It returns the new version and the fields
+// that changed, or ErrVersionConflict if change.IfMatch is set and does
+// not match the current version.
+func (cm *ChaosMiddleware) UpdateConfig(newConfig *ChaosConfig, change ConfigChange) (ConfigVersion, []FieldChange, error) {
+	cm.mu.Lock()
+	if change.IfMatch != "" && !etagMatches(change.IfMatch, cm.versions.current().ETag) {
+		cm.mu.Unlock()
+		return ConfigVersion{}, nil, ErrVersionConflict
+	}
+	oldConfig := cm.config
+	cm.config = newConfig
+	version := cm.versions.add(newConfig, change)
+	cm.mu.Unlock()
+
+	changes := diffConfigs(oldConfig, newConfig)
+	entry := AuditEntry{
+		Time:       version.AppliedAt,
+		Actor:      change.Actor,
+		RemoteAddr: change.RemoteAddr,
+		Source:     change.Source,
+		Version:    version.Version,
+		Changes:    changes,
+	}
+	if cm.name != defaultRule {
+		entry.Route = cm.name
+	}
+	if err := cm.audit.append(entry); err != nil {
+		slog.Error("failed to write audit log", "error", err)
+	}
+
+	slog.Info("configuration updated", "route", cm.name, "source", change.Source, "actor", change.Actor,
+		"version", version.Version, "changed_fields", len(changes))
+	return version, changes, nil
+}
+
+// Rollback re-applies a previously stored configuration version as a new version
+func (cm *ChaosMiddleware) Rollback(version int, change ConfigChange) (ConfigVersion, []FieldChange, error) {
+	cm.mu.RLock()
+	v, ok := cm.versions.get(version)
+	cm.mu.RUnlock()
+	if !ok {
+		return ConfigVersion{}, nil, ErrUnknownVersion
+	}
+
+	change.Source = ConfigSourceRollback
+	return cm.UpdateConfig(v.Config.Clone(), change)
+}
+
+// ConfigVersion returns the version of the configuration currently in effect
+func (cm *ChaosMiddleware) ConfigVersion() ConfigVersion {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.versions.current()
+}
+
+// EnableAuditLog persists configuration history to path, loading any
+// history already recorded there
+func (cm *ChaosMiddleware) EnableAuditLog(path string) error {
+	audit, err := openAuditLog(path)
+	if err != nil {
+		return err
+	}
+	cm.audit = audit
+	return nil
+}
+
+// ApplyProfile applies the named profile on top of the configuration in
+// effect as a new version
+func (cm *ChaosMiddleware) ApplyProfile(name string, change ConfigChange) (ConfigVersion, []FieldChange, error) {
+	profile, err := cm.profiles.Get(name)
+	if err != nil {
+		return ConfigVersion{}, nil, err
+	}
+	newConfig, err := profile.ApplyTo(cm.Config())
+	if err != nil {
+		return ConfigVersion{}, nil, err
+	}
+	if err := newConfig.Validate(); err != nil {
+		return ConfigVersion{}, nil, err
+	}
+
+	slog.Info("applying profile", "profile", name)
+	change.Source = ConfigSourceProfile
+	return cm.UpdateConfig(newConfig, change)
+}
+
+// RecordTLSFault reports a fault injected on a TLS handshake of the
+// listener in front of this middleware
+func (cm *ChaosMiddleware) RecordTLSFault(kind, remoteAddr string, dryRun bool) {
+	if dryRun {
+		slog.Info("dry run, would inject TLS fault", "fault", kind, "remote_addr", remoteAddr)
+		return
+	}
+	slog.Info("injecting TLS fault", "fault", kind, "remote_addr", remoteAddr)
+	cm.stats.recordTLSFault(kind)
+}
+
+// Close releases resources held by the middleware
+func (cm *ChaosMiddleware) Close() error {
+	cm.pool.close()
+	return cm.audit.close()
 }
 
 // ServeHTTP implements the http.Handler interface
 func (cm *ChaosMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	cm.statsTotal++
-
-	if strings.HasPrefix(r.URL.Path, "/_chaos") {
+	if isManagement(r, cm.pool.forward) {
 		cm.handleManagement(w, r)
 		return
 	}
 
-	if cm.shouldApplyChaos() {
-		if cm.config.TimeoutEnabled && cm.shouldApplyTimeout() {
-			cm.applyTimeout(w, r)
+	// Every decision for this request is made against the same snapshot,
+	// even if the configuration is swapped while it is in flight
+	config := cm.Config()
+
+	rec := newRecord(r)
+	rec.Rule = cm.name
+	if isGRPC(r) {
+		rec.GRPC = true
+		config = config.forGRPCMethod(r.URL.Path)
+	}
+	rw := newResponseRecorder(w)
+
+	var ex *exchange
+	if config.Capture.Enabled {
+		ex = startCapture(r, config.Capture)
+		rw.body = ex.responseBody
+	}
+
+	r, span := startSpan(r, rec)
+	r = r.WithContext(withRecord(r.Context(), rec))
+
+	defer func() {
+		rec.Status = rw.status
+		if rec.GRPC && rec.GRPCStatus == "" {
+			rec.GRPCStatus = grpcStatusFrom(rw.Header())
+		}
+		rec.Latency = time.Since(rec.Start)
+		rec.annotate(span)
+		span.End()
+		rec.log()
+		cm.stats.record(rec)
+		cm.events.publish(rec.event())
+		if ex != nil {
+			cm.capture.add(ex.entry(rec, rw.Header()), config.Capture.maxEntries())
+		}
+	}()
+
+	cm.serveChaos(rw, r, config, rec)
+}
+
+// serveChaos applies the faults chosen for the request, then proxies it
+// unless a fault already produced the response
+func (cm *ChaosMiddleware) serveChaos(w http.ResponseWriter, r *http.Request, config *ChaosConfig, rec *requestRecord) {
+	b := cm.pool.pickFor(r)
+	rec.backend = b
+	if len(cm.pool.backends) > 1 || cm.pool.forward {
+		rec.Backend = b.url.String()
+	}
+
+	var decision faultDecision
+	var backendError bool
+	var stream *streamPlan
+	rec.Targeted = cm.shouldApplyChaos(config, r)
+	if rec.Targeted {
+		decision = cm.decide(config, rec.GRPC)
+		if decision.Timeout == 0 {
+			backendError = cm.pool.decideBackendFaults(config, b, &decision)
+		}
+		stream = cm.planStream(config)
+		if isWebSocket(r) {
+			var reject int
+			rec.webSocket, reject = cm.planWebSocket(config, rec)
+			if reject != 0 && decision.Timeout == 0 && !decision.failed() {
+				decision.ErrorCode = reject
+				if !config.DryRun {
+					cm.stats.recordWebSocketFault(WebSocketFaultReject)
+				}
+			}
+		}
+		if rec.GRPC && decision.ErrorCode != 0 && decision.GRPCStatus == 0 {
+			decision.GRPCStatus = pickGRPCStatus(config, decision.ErrorCode)
+		}
+	}
+	rec.Decision = decision
+	rec.DryRun = config.DryRun
+
+	w.Header().Set("X-Request-ID", rec.ID)
+
+	if config.DryRun {
+		cm.recordDryRun(w, r, decision)
+	} else {
+		if decision.Timeout > 0 {
+			addFaultEvent(r, "chaos.timeout", attribute.String("chaos.timeout", decision.Timeout.String()))
+			if rec.GRPC {
+				cm.applyGRPCTimeout(w, r, decision.Timeout, rec.Start)
+			} else {
+				cm.applyTimeout(w, r, decision.Timeout)
+			}
 			return
 		}
 
-		if cm.config.DelayEnabled && cm.shouldApplyDelay() {
-			cm.applyDelay()
+		if decision.Delay > 0 {
+			addFaultEvent(r, "chaos.delay", attribute.Int64("chaos.delay_ms", decision.Delay.Milliseconds()))
+			if !rec.GRPC {
+				cm.applyDelay(decision.Delay)
+			} else if !cm.applyGRPCDelay(w, r, decision.Delay, rec.Start) {
+				return
+			}
 		}
 
-		if cm.config.ErrorEnabled && cm.shouldApplyError() {
-			cm.applyError(w, r)
+		if decision.GRPCStatus != 0 {
+			addFaultEvent(r, "chaos.error", attribute.String("chaos.grpc_status", grpcStatusName(decision.GRPCStatus)))
+			message := config.GRPC.Message
+			if message == "" {
+				message = config.ErrorMessage
+			}
+			cm.applyGRPCError(w, decision.GRPCStatus, message)
+			if backendError {
+				cm.pool.report(b, false)
+			}
+			return
+		}
+
+		if decision.ErrorCode != 0 {
+			addFaultEvent(r, "chaos.error", attribute.Int("chaos.error_code", decision.ErrorCode))
+			cm.applyError(w, r, decision.ErrorCode, config.ErrorMessage)
+			if backendError {
+				cm.pool.report(b, false)
+			}
 			return
 		}
 	}
@@ -70,49 +360,108 @@ func (cm *ChaosMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Chaos-Applied", "true")
 	w.Header().Set("X-Chaos-Timestamp", time.Now().Format(time.RFC3339))
 
-	cm.proxy.ServeHTTP(w, r)
+	upstreamStart := time.Now()
+	b.active.Add(1)
+	// Deferred because the reverse proxy and stream resets abort the handler
+	// with http.ErrAbortHandler, which would otherwise leak the connection
+	// count of the backend
+	defer func() {
+		b.active.Add(-1)
+		rec.UpstreamLatency = time.Since(upstreamStart)
+		// Requests abandoned by the client say nothing about the backend
+		if r.Context().Err() == nil {
+			cm.pool.report(b, rec.UpstreamStatus != 0 && rec.UpstreamStatus < 500)
+		}
+	}()
+
+	if r.Method == http.MethodConnect && cm.connect != nil {
+		cm.connect(w, r, b)
+	} else if stream != nil {
+		cm.proxyStream(w, r, stream, rec)
+	} else {
+		cm.proxy.ServeHTTP(w, r)
+	}
+}
+
+// decide evaluates every chaos rule for a targeted request without applying
+// anything. gRPC calls can fail with a configured gRPC status even when no
+// HTTP error codes are set.
+func (cm *ChaosMiddleware) decide(config *ChaosConfig, grpc bool) faultDecision {
+	var decision faultDecision
+
+	if config.TimeoutEnabled && cm.shouldApplyTimeout(config) {
+		decision.Timeout = config.TimeoutDuration.Duration
+		return decision
+	}
+
+	if config.DelayEnabled && cm.shouldApplyDelay(config) {
+		decision.Delay = cm.pickDelay(config)
+	}
+
+	grpcStatuses := grpc && len(config.GRPC.StatusCodes) > 0
+	if config.ErrorEnabled && (len(config.ErrorCodes) > 0 || grpcStatuses) && cm.shouldApplyError(config) {
+		if grpcStatuses {
+			decision.GRPCStatus = pickGRPCStatus(config, 0)
+		} else {
+			decision.ErrorCode = config.ErrorCodes[rand.Intn(len(config.ErrorCodes))]
+		}
+	}
+
+	return decision
+}
+
+// recordDryRun reports the faults that would have been injected
+func (cm *ChaosMiddleware) recordDryRun(w http.ResponseWriter, r *http.Request, decision faultDecision) {
+	if decision.empty() {
+		return
+	}
+
+	slog.Debug("dry run, would inject fault", "fault", decision.String())
+	addFaultEvent(r, "chaos.dry_run", attribute.String("chaos.would_apply", decision.String()))
+	w.Header().Set("X-Chaos-Would-Apply", decision.String())
 }
 
-func (cm *ChaosMiddleware) shouldApplyChaos() bool {
-	return true
+func (cm *ChaosMiddleware) shouldApplyChaos(config *ChaosConfig, r *http.Request) bool {
+	return config.Targeting.Matches(r)
 }
 
-func (cm *ChaosMiddleware) shouldApplyDelay() bool {
-	return rand.Float64() < cm.config.DelayProbability
+func (cm *ChaosMiddleware) shouldApplyDelay(config *ChaosConfig) bool {
+	return rand.Float64() < config.DelayProbability
 }
 
-func (cm *ChaosMiddleware) shouldApplyError() bool {
-	return rand.Float64() < cm.config.ErrorProbability
+func (cm *ChaosMiddleware) shouldApplyError(config *ChaosConfig) bool {
+	return rand.Float64() < config.ErrorProbability
 }
 
-func (cm *ChaosMiddleware) shouldApplyTimeout() bool {
-	return rand.Float64() < cm.config.TimeoutProbability
+func (cm *ChaosMiddleware) shouldApplyTimeout(config *ChaosConfig) bool {
+	return rand.Float64() < config.TimeoutProbability
 }
 
-func (cm *ChaosMiddleware) applyDelay() {
-	minDelay := cm.config.DelayMin.Duration
-	maxDelay := cm.config.DelayMax.Duration
+func (cm *ChaosMiddleware) pickDelay(config *ChaosConfig) time.Duration {
+	minDelay := config.DelayMin.Duration
+	maxDelay := config.DelayMax.Duration
 
 	delayRange := maxDelay - minDelay
-	delay := minDelay + time.Duration(rand.Int63n(int64(delayRange)))
+	if delayRange <= 0 {
+		return minDelay
+	}
+	return minDelay + time.Duration(rand.Int63n(int64(delayRange)))
+}
 
-	cm.statsDelay++
-	log.Printf("💥 Injecting delay: %v", delay)
+func (cm *ChaosMiddleware) applyDelay(delay time.Duration) {
+	slog.Debug("injecting delay", "delay", delay)
 	time.Sleep(delay)
 }
 
-func (cm *ChaosMiddleware) applyError(w http.ResponseWriter, r *http.Request) {
-	statusCode := cm.config.ErrorCodes[rand.Intn(len(cm.config.ErrorCodes))]
-	cm.statsError++
-
-	log.Printf("💥 Injecting error: HTTP %d", statusCode)
+func (cm *ChaosMiddleware) applyError(w http.ResponseWriter, r *http.Request, statusCode int, message string) {
+	slog.Debug("injecting error", "status", statusCode)
 
 	w.Header().Set("X-Chaos-Injected-Error", fmt.Sprintf("%d", statusCode))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 
 	errorResponse := map[string]interface{}{
-		"error":     cm.config.ErrorMessage,
+		"error":     message,
 		"code":      statusCode,
 		"chaos":     true,
 		"timestamp": time.Now().Format(time.RFC3339),
@@ -122,19 +471,19 @@ func (cm *ChaosMiddleware) applyError(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(errorResponse)
 }
 
-func (cm *ChaosMiddleware) applyTimeout(w http.ResponseWriter, r *http.Request) {
-	log.Printf("💥 Injecting timeout: %v", cm.config.TimeoutDuration)
+func (cm *ChaosMiddleware) applyTimeout(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+	slog.Debug("injecting timeout", "timeout", timeout)
 
-	time.Sleep(cm.config.TimeoutDuration.Duration)
+	time.Sleep(timeout)
 
-	w.Header().Set("X-Chaos-Injected-Timeout", cm.config.TimeoutDuration.String())
+	w.Header().Set("X-Chaos-Injected-Timeout", timeout.String())
 	w.WriteHeader(http.StatusGatewayTimeout)
 
 	errorResponse := map[string]interface{}{
 		"error":     "Request timeout due to chaos engineering",
 		"code":      504,
 		"chaos":     true,
-		"timeout":   cm.config.TimeoutDuration.String(),
+		"timeout":   timeout.String(),
 		"timestamp": time.Now().Format(time.RFC3339),
 	}
 
@@ -0,0 +1,78 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// sseBackend sends events events and then holds the stream open until the
+// request is cancelled
+func sseBackend(events int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < events; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+		}
+		http.NewResponseController(w).Flush()
+		<-r.Context().Done()
+	})
+}
+
+// waitIdle waits until no request is in flight to the first backend of cm
+func waitIdle(t *testing.T, cm *ChaosMiddleware) {
+	t.Helper()
+	b := cm.pool.backends[0]
+	deadline := time.Now().Add(2 * time.Second)
+	for b.active.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("backend still counts %d active requests", b.active.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestActiveCountAfterStreamReset(t *testing.T) {
+	config := quietConfig()
+	config.Streaming = StreamingConfig{CutProbability: 1, CutAfterEvents: 1, CutMode: StreamCutReset}
+	cm := newTestProxy(t, config, sseBackend(3))
+	srv := httptest.NewServer(cm)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	waitIdle(t, cm)
+}
+
+func TestActiveCountAfterClientAbort(t *testing.T) {
+	cm := newTestProxy(t, quietConfig(), sseBackend(1))
+	srv := httptest.NewServer(cm)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The backend already answered; abandoning the body makes the reverse
+	// proxy abort the handler mid-copy
+	buf := make([]byte, 1)
+	if _, err := resp.Body.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	resp.Body.Close()
+	waitIdle(t, cm)
+}
@@ -0,0 +1,483 @@
+package chaos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load balancing strategies for a pool of backends
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConn  = "least_conn"
+	BalanceRandom     = "random"
+)
+
+// PoolConfig controls how requests reach the backends of a target and how
+// they are spread over several backends
+type PoolConfig struct {
+	Balance     string            `json:"balance,omitempty"`
+	HealthCheck HealthCheckConfig `json:"health_check,omitempty"`
+	Ejection    EjectionConfig    `json:"ejection,omitempty"`
+	TLS         UpstreamTLSConfig `json:"tls,omitempty"`
+}
+
+// HealthCheckConfig configures active health checks. Checks are disabled
+// when Path is empty.
+type HealthCheckConfig struct {
+	Path               string   `json:"path,omitempty"`
+	Interval           Duration `json:"interval,omitempty"`
+	Timeout            Duration `json:"timeout,omitempty"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold,omitempty"`
+	HealthyThreshold   int      `json:"healthy_threshold,omitempty"`
+}
+
+// EjectionConfig configures passive ejection: a backend that fails
+// ConsecutiveFailures requests in a row (transport errors or 5xx) is taken
+// out of rotation for Duration. A negative ConsecutiveFailures disables it.
+type EjectionConfig struct {
+	ConsecutiveFailures int      `json:"consecutive_failures,omitempty"`
+	Duration            Duration `json:"duration,omitempty"`
+}
+
+// Validate checks the pool settings
+func (p PoolConfig) Validate() error {
+	var errs []error
+	switch p.Balance {
+	case "", BalanceRoundRobin, BalanceLeastConn, BalanceRandom:
+	default:
+		errs = append(errs, fmt.Errorf("unknown balance strategy %q", p.Balance))
+	}
+	if p.HealthCheck.Path != "" && !strings.HasPrefix(p.HealthCheck.Path, "/") {
+		errs = append(errs, errors.New("health_check.path must start with '/'"))
+	}
+	if p.HealthCheck.Interval.Duration < 0 || p.HealthCheck.Timeout.Duration < 0 || p.Ejection.Duration.Duration < 0 {
+		errs = append(errs, errors.New("pool durations must not be negative"))
+	}
+	if p.HealthCheck.UnhealthyThreshold < 0 || p.HealthCheck.HealthyThreshold < 0 {
+		errs = append(errs, errors.New("health check thresholds must not be negative"))
+	}
+	if p.TLS.enabled() {
+		if _, err := p.TLS.clientConfig(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// withDefaults fills in unset pool settings
+func (p PoolConfig) withDefaults() PoolConfig {
+	if p.Balance == "" {
+		p.Balance = BalanceRoundRobin
+	}
+	if p.HealthCheck.Interval.Duration == 0 {
+		p.HealthCheck.Interval.Duration = 10 * time.Second
+	}
+	if p.HealthCheck.Timeout.Duration == 0 {
+		p.HealthCheck.Timeout.Duration = 2 * time.Second
+	}
+	if p.HealthCheck.UnhealthyThreshold == 0 {
+		p.HealthCheck.UnhealthyThreshold = 2
+	}
+	if p.HealthCheck.HealthyThreshold == 0 {
+		p.HealthCheck.HealthyThreshold = 1
+	}
+	if p.Ejection.ConsecutiveFailures == 0 {
+		p.Ejection.ConsecutiveFailures = 5
+	}
+	if p.Ejection.Duration.Duration == 0 {
+		p.Ejection.Duration.Duration = 30 * time.Second
+	}
+	return p
+}
+
+// BackendStatus reports the state of one backend of a pool
+type BackendStatus struct {
+	Index               int        `json:"index"`
+	URL                 string     `json:"url"`
+	Healthy             bool       `json:"healthy"`
+	EjectedUntil        *time.Time `json:"ejected_until,omitempty"`
+	Active              int64      `json:"active"`
+	Requests            int64      `json:"requests"`
+	Failures            int64      `json:"failures"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastCheckError      string     `json:"last_check_error,omitempty"`
+}
+
+// backend is one target URL of a pool
+type backend struct {
+	index    int
+	url      *url.URL
+	director func(*http.Request)
+	active   atomic.Int64
+
+	// Guarded by the pool's mutex
+	healthy             bool
+	checkStreak         int
+	consecutiveFailures int
+	ejectedUntil        time.Time
+	requests            int64
+	failures            int64
+	lastCheckError      string
+}
+
+// pool balances requests over backends, skipping those that failed their
+// health checks or were ejected. When no backend is available every
+// backend is used again rather than failing all requests.
+type pool struct {
+	config    PoolConfig
+	transport http.RoundTripper
+	client    *http.Client
+	stop      context.CancelFunc
+
+	mu       sync.Mutex
+	backends []*backend
+	next     int
+
+	// forward pools have no backends of their own: each request goes to
+	// the destination it names, as sent to an explicit proxy
+	forward bool
+}
+
+func newPool(targets []*url.URL, config PoolConfig, forward bool) *pool {
+	config = config.withDefaults()
+
+	// The configuration was validated, so building the transport cannot fail
+	transport, _ := config.TLS.transport()
+	if forward {
+		transport = forwardTransport(transport)
+	}
+	for _, target := range targets {
+		if target.Scheme == h2cScheme || target.Scheme == unixScheme {
+			transport = newUpstreamTransport(transport)
+			break
+		}
+	}
+	p := &pool{
+		config:    config,
+		transport: transport,
+		client:    &http.Client{Transport: transport, Timeout: config.HealthCheck.Timeout.Duration},
+		stop:      func() {},
+		forward:   forward,
+	}
+	for i, target := range targets {
+		p.backends = append(p.backends, &backend{
+			index:    i + 1,
+			url:      target,
+			director: httputil.NewSingleHostReverseProxy(dialURL(target)).Director,
+			healthy:  true,
+		})
+	}
+
+	if config.HealthCheck.Path != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		p.stop = cancel
+		go p.runHealthChecks(ctx)
+	}
+	return p
+}
+
+// newForwardPool creates the pool of a forward proxy route
+func newForwardPool(config PoolConfig) *pool {
+	return newPool(nil, config, true)
+}
+
+// forwardTransport returns base, or the default transport, without proxy
+// settings. Clients reach a forward proxy through HTTP_PROXY and
+// HTTPS_PROXY, so honouring them would send requests back into it.
+func forwardTransport(base http.RoundTripper) http.RoundTripper {
+	t, ok := base.(*http.Transport)
+	if !ok {
+		t = http.DefaultTransport.(*http.Transport)
+	}
+	t = t.Clone()
+	t.Proxy = nil
+	return t
+}
+
+// String lists the backend URLs
+func (p *pool) String() string {
+	if p.forward {
+		return "(forward proxy)"
+	}
+	urls := make([]string, len(p.backends))
+	for i, b := range p.backends {
+		urls[i] = b.url.String()
+	}
+	return strings.Join(urls, ",")
+}
+
+// pickFor chooses the backend for a request. In a forward pool it is the
+// destination of the request, which is not kept in the pool.
+func (p *pool) pickFor(r *http.Request) *backend {
+	if !p.forward {
+		return p.pick()
+	}
+	u := &url.URL{Scheme: r.URL.Scheme, Host: r.URL.Host}
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	return &backend{url: u, director: httputil.NewSingleHostReverseProxy(u).Director, healthy: true}
+}
+
+// pick chooses the backend for a request
+func (p *pool) pick() *backend {
+	if len(p.backends) == 1 {
+		return p.backends[0]
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	available := make([]*backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.healthy && now.After(b.ejectedUntil) {
+			available = append(available, b)
+		}
+	}
+	if len(available) == 0 {
+		available = p.backends
+	}
+
+	switch p.config.Balance {
+	case BalanceRandom:
+		return available[rand.Intn(len(available))]
+	case BalanceLeastConn:
+		best := available[0]
+		for _, b := range available[1:] {
+			if b.active.Load() < best.active.Load() {
+				best = b
+			}
+		}
+		return best
+	default:
+		p.next++
+		return available[p.next%len(available)]
+	}
+}
+
+// find returns the backend matching a URL or a 1-based position
+func (p *pool) find(ref string) *backend {
+	if i, err := strconv.Atoi(ref); err == nil {
+		if i >= 1 && i <= len(p.backends) {
+			return p.backends[i-1]
+		}
+		return nil
+	}
+	for _, b := range p.backends {
+		if strings.TrimSuffix(b.url.String(), "/") == strings.TrimSuffix(ref, "/") {
+			return b
+		}
+	}
+	return nil
+}
+
+// report records the outcome of a request for passive ejection
+func (p *pool) report(b *backend, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b.requests++
+	if ok {
+		b.consecutiveFailures = 0
+		return
+	}
+	b.failures++
+	b.consecutiveFailures++
+
+	threshold := p.config.Ejection.ConsecutiveFailures
+	if threshold > 0 && len(p.backends) > 1 && b.consecutiveFailures >= threshold && time.Now().After(b.ejectedUntil) {
+		b.ejectedUntil = time.Now().Add(p.config.Ejection.Duration.Duration)
+		slog.Warn("backend ejected", "backend", b.url.String(), "consecutive_failures", b.consecutiveFailures,
+			"until", b.ejectedUntil.Format(time.RFC3339))
+	}
+}
+
+func (p *pool) runHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(p.config.HealthCheck.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		for _, b := range p.backends {
+			p.check(ctx, b)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check probes one backend and updates its health once the configured
+// number of consecutive checks agree
+func (p *pool) check(ctx context.Context, b *backend) {
+	err := p.probe(ctx, b)
+	if ctx.Err() != nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	passed := err == nil
+	if passed == b.healthy {
+		b.checkStreak = 0
+	} else {
+		b.checkStreak++
+	}
+	if err != nil {
+		b.lastCheckError = err.Error()
+	} else {
+		b.lastCheckError = ""
+	}
+
+	threshold := p.config.HealthCheck.UnhealthyThreshold
+	if passed {
+		threshold = p.config.HealthCheck.HealthyThreshold
+	}
+	if b.checkStreak >= threshold {
+		b.healthy = passed
+		b.checkStreak = 0
+		if passed {
+			slog.Info("backend healthy", "backend", b.url.String())
+		} else {
+			slog.Warn("backend unhealthy", "backend", b.url.String(), "error", err)
+		}
+	}
+}
+
+func (p *pool) probe(ctx context.Context, b *backend) error {
+	target := dialURL(b.url).JoinPath(p.config.HealthCheck.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// status reports the state of every backend
+func (p *pool) status() []BackendStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	statuses := make([]BackendStatus, 0, len(p.backends))
+	for _, b := range p.backends {
+		s := BackendStatus{
+			Index:               b.index,
+			URL:                 b.url.String(),
+			Healthy:             b.healthy,
+			Active:              b.active.Load(),
+			Requests:            b.requests,
+			Failures:            b.failures,
+			ConsecutiveFailures: b.consecutiveFailures,
+			LastCheckError:      b.lastCheckError,
+		}
+		if b.ejectedUntil.After(now) {
+			until := b.ejectedUntil
+			s.EjectedUntil = &until
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// available counts the backends currently in rotation
+func (p *pool) available() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	n := 0
+	for _, b := range p.backends {
+		if b.healthy && now.After(b.ejectedUntil) {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *pool) close() {
+	p.stop()
+}
+
+// BackendFault adds faults to requests sent to one backend of a pool, on
+// top of the regular chaos rules, e.g. to make a single instance slow.
+// Injected errors count as backend failures for passive ejection.
+type BackendFault struct {
+	// Backend is the backend URL or its position in the pool, starting at 1
+	Backend          string   `json:"backend"`
+	DelayMin         Duration `json:"delay_min,omitempty"`
+	DelayMax         Duration `json:"delay_max,omitempty"`
+	DelayProbability float64  `json:"delay_probability,omitempty"`
+	ErrorCodes       []int    `json:"error_codes,omitempty"`
+	ErrorProbability float64  `json:"error_probability,omitempty"`
+}
+
+// validate checks a backend fault
+func (f BackendFault) validate() error {
+	var errs []error
+	if f.Backend == "" {
+		errs = append(errs, errors.New("backend is required"))
+	}
+	if f.DelayProbability < 0 || f.DelayProbability > 1 || f.ErrorProbability < 0 || f.ErrorProbability > 1 {
+		errs = append(errs, errors.New("probabilities must be between 0 and 1"))
+	}
+	if f.DelayMin.Duration < 0 || f.DelayMax.Duration < f.DelayMin.Duration {
+		errs = append(errs, errors.New("delay_max must not be less than delay_min"))
+	}
+	for _, code := range f.ErrorCodes {
+		if code < 100 || code > 599 {
+			errs = append(errs, fmt.Errorf("error code %d is not a valid HTTP status", code))
+		}
+	}
+	if f.ErrorProbability > 0 && len(f.ErrorCodes) == 0 {
+		errs = append(errs, errors.New("error_probability requires error_codes"))
+	}
+	return errors.Join(errs...)
+}
+
+// decideBackendFaults adds the faults configured for backend b to decision.
+// It reports whether an error was injected for the backend.
+func (p *pool) decideBackendFaults(config *ChaosConfig, b *backend, decision *faultDecision) bool {
+	for _, f := range config.BackendFaults {
+		if p.find(f.Backend) != b {
+			continue
+		}
+		if f.DelayProbability > 0 && rand.Float64() < f.DelayProbability {
+			delay := f.DelayMin.Duration
+			if spread := f.DelayMax.Duration - f.DelayMin.Duration; spread > 0 {
+				delay += time.Duration(rand.Int63n(int64(spread)))
+			}
+			decision.Delay += delay
+		}
+		if !decision.failed() && f.ErrorProbability > 0 && rand.Float64() < f.ErrorProbability {
+			decision.ErrorCode = f.ErrorCodes[rand.Intn(len(f.ErrorCodes))]
+			return true
+		}
+	}
+	return false
+}
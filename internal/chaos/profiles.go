@@ -0,0 +1,154 @@
+package chaos
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ProfileSourceBuiltin marks profiles shipped with the binary
+const ProfileSourceBuiltin = "builtin"
+
+// ErrUnknownProfile is returned when no profile has the requested name
+var ErrUnknownProfile = errors.New("unknown profile")
+
+//go:embed profiles/*.yaml
+var builtinProfileFiles embed.FS
+
+// Profile is a named set of configuration values. Applying a profile sets
+// only the fields it lists, so targeting, dry-run and capture settings are
+// kept.
+type Profile struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Source      string                 `json:"source"`
+	Values      map[string]interface{} `json:"config"`
+}
+
+// ApplyTo returns a copy of config with the profile's values applied
+func (p *Profile) ApplyTo(config *ChaosConfig) (*ChaosConfig, error) {
+	data, err := json.Marshal(p.Values)
+	if err != nil {
+		return nil, err
+	}
+	applied := config.Clone()
+	if err := json.Unmarshal(data, applied); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	return applied, nil
+}
+
+// parseProfile decodes a profile file: configuration fields plus an
+// optional top-level description
+func parseProfile(name, source string, data []byte, format string) (*Profile, error) {
+	values := map[string]interface{}{}
+	if err := decodeInto(data, format, &values); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", name, err)
+	}
+
+	p := &Profile{Name: name, Source: source, Values: values}
+	if description, ok := values["description"].(string); ok {
+		p.Description = description
+	}
+	delete(values, "description")
+	delete(values, "name")
+
+	// Reject profiles that would not produce a valid configuration
+	applied, err := p.ApplyTo(DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	if err := applied.Validate(); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", name, err)
+	}
+	return p, nil
+}
+
+// ProfileLibrary holds the built-in profiles and any custom profiles loaded
+// from a directory. Custom profiles replace built-ins of the same name.
+type ProfileLibrary struct {
+	profiles map[string]*Profile
+}
+
+// BuiltinProfiles returns a library containing only the built-in profiles
+func BuiltinProfiles() *ProfileLibrary {
+	lib := &ProfileLibrary{profiles: map[string]*Profile{}}
+
+	entries, _ := builtinProfileFiles.ReadDir("profiles")
+	for _, entry := range entries {
+		data, err := builtinProfileFiles.ReadFile(path.Join("profiles", entry.Name()))
+		if err != nil {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), path.Ext(entry.Name()))
+		p, err := parseProfile(name, ProfileSourceBuiltin, data, FormatYAML)
+		if err != nil {
+			panic(err)
+		}
+		lib.profiles[name] = p
+	}
+	return lib
+}
+
+// LoadProfiles returns the built-in profiles plus every .json, .yaml, .yml
+// or .toml file in dir, named after the file. A missing dir is not an error.
+func LoadProfiles(dir string) (*ProfileLibrary, error) {
+	lib := BuiltinProfiles()
+	if dir == "" {
+		return lib, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return lib, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".json" && ext != ".yaml" && ext != ".yml" && ext != ".toml") {
+			continue
+		}
+		file := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(file)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		p, err := parseProfile(strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())), file, data, FormatFromPath(file))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		lib.profiles[p.Name] = p
+	}
+	return lib, errors.Join(errs...)
+}
+
+// Get returns the profile with the given name
+func (l *ProfileLibrary) Get(name string) (*Profile, error) {
+	p, ok := l.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownProfile, name)
+	}
+	return p, nil
+}
+
+// List returns every profile sorted by name
+func (l *ProfileLibrary) List() []*Profile {
+	profiles := make([]*Profile, 0, len(l.profiles))
+	for _, p := range l.profiles {
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
@@ -0,0 +1,176 @@
+package chaos
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+type recordKey struct{}
+
+// defaultRule names the rule applied when no routing table is configured
+const defaultRule = "default"
+
+// requestRecord collects everything known about a single proxied request
+type requestRecord struct {
+	ID             string
+	Method         string
+	Path           string
+	Rule           string
+	Backend        string
+	Targeted       bool
+	DryRun         bool
+	Decision       faultDecision
+	Status         int
+	UpstreamStatus int
+
+	// GRPC marks gRPC calls; GRPCStatus is the status they ended with
+	GRPC            bool
+	GRPCStatus      string
+	UpstreamLatency time.Duration
+	Start           time.Time
+	Latency         time.Duration
+
+	backend *backend
+
+	// webSocket holds the stream faults of an upgraded connection
+	webSocket *webSocketPlan
+}
+
+// newRecord starts a record for the request, reusing an incoming
+// X-Request-ID when the client supplied one
+func newRecord(r *http.Request) *requestRecord {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" {
+		id = newRequestID()
+		r.Header.Set("X-Request-ID", id)
+	}
+
+	return &requestRecord{
+		ID:     id,
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Rule:   defaultRule,
+		Start:  time.Now(),
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withRecord(ctx context.Context, rec *requestRecord) context.Context {
+	return context.WithValue(ctx, recordKey{}, rec)
+}
+
+func recordFrom(ctx context.Context) *requestRecord {
+	rec, _ := ctx.Value(recordKey{}).(*requestRecord)
+	return rec
+}
+
+// fault returns a short label for the fault applied to the request
+func (rec *requestRecord) fault() string {
+	if rec.Decision.empty() {
+		return "none"
+	}
+	return rec.Decision.String()
+}
+
+// log emits the single structured event describing the request
+func (rec *requestRecord) log() {
+	attrs := []slog.Attr{
+		slog.String("request_id", rec.ID),
+		slog.String("method", rec.Method),
+		slog.String("path", rec.Path),
+		slog.String("rule", rec.Rule),
+	}
+	if rec.Backend != "" {
+		attrs = append(attrs, slog.String("backend", rec.Backend))
+	}
+	attrs = append(attrs,
+		slog.Bool("targeted", rec.Targeted),
+		slog.String("fault", rec.fault()),
+		slog.Bool("dry_run", rec.DryRun),
+	)
+
+	if rec.Decision.Delay > 0 {
+		attrs = append(attrs, slog.Duration("delay", rec.Decision.Delay))
+	}
+	if rec.Decision.ErrorCode != 0 {
+		attrs = append(attrs, slog.Int("error_code", rec.Decision.ErrorCode))
+	}
+	if rec.Decision.Timeout > 0 {
+		attrs = append(attrs, slog.Duration("timeout", rec.Decision.Timeout))
+	}
+
+	if rec.GRPCStatus != "" {
+		attrs = append(attrs, slog.String("grpc_status", rec.GRPCStatus))
+	}
+
+	attrs = append(attrs,
+		slog.Int("status", rec.Status),
+		slog.Int("upstream_status", rec.UpstreamStatus),
+		slog.Duration("upstream_latency", rec.UpstreamLatency),
+		slog.Duration("latency", rec.Latency),
+	)
+
+	slog.LogAttrs(context.Background(), slog.LevelInfo, "request", attrs...)
+}
+
+// responseRecorder captures the status code written to the client and,
+// when body is set, a copy of the response body
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	body   io.Writer
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w}
+}
+
+func (rw *responseRecorder) WriteHeader(code int) {
+	if rw.status == 0 {
+		rw.status = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	if rw.body != nil {
+		rw.body.Write(b[:n])
+	}
+	return n, err
+}
+
+// Flush implements http.Flusher so streaming responses keep working
+func (rw *responseRecorder) Flush() {
+	http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+// Hijack implements http.Hijacker so protocol upgrades keep working
+func (rw *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusSwitchingProtocols
+	}
+	return http.NewResponseController(rw.ResponseWriter).Hijack()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
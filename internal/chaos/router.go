@@ -0,0 +1,467 @@
+package chaos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// RouteConfig maps requests matching a host and/or path prefix to a target
+// service with its own chaos configuration. A route with several targets
+// balances requests over them as a pool.
+type RouteConfig struct {
+	Name        string     `json:"name"`
+	Host        string     `json:"host,omitempty"`
+	PathPrefix  string     `json:"path_prefix,omitempty"`
+	StripPrefix bool       `json:"strip_prefix,omitempty"`
+	Target      string     `json:"target,omitempty"`
+	Targets     []string   `json:"targets,omitempty"`
+	Pool        PoolConfig `json:"pool,omitempty"`
+
+	// Profile and Chaos adjust the base configuration for this route: the
+	// named profile is applied first, then the fields listed in Chaos
+	Profile string                 `json:"profile,omitempty"`
+	Chaos   map[string]interface{} `json:"chaos,omitempty"`
+}
+
+// RoutingTable is the content of a -routes file
+type RoutingTable struct {
+	Routes []RouteConfig `json:"routes"`
+}
+
+// LoadRoutes reads a routing table from a JSON, YAML or TOML file. The
+// routes are checked when the router is built, since a forward proxy
+// accepts routes without targets.
+func LoadRoutes(path string) (*RoutingTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	table := &RoutingTable{}
+	if err := decodeInto(data, FormatFromPath(path), table); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return table, nil
+}
+
+// Validate checks that every route has a unique name, a target URL and
+// something to match on
+func (t *RoutingTable) Validate() error {
+	return t.validate(false)
+}
+
+// validate checks the table; in forward mode routes may leave out their
+// targets to send requests to the destination they name
+func (t *RoutingTable) validate(forward bool) error {
+	var errs []error
+	seen := map[string]bool{}
+
+	for i, route := range t.Routes {
+		switch {
+		case route.Name == "":
+			errs = append(errs, fmt.Errorf("route %d: name is required", i))
+		case route.Name == defaultRule:
+			errs = append(errs, fmt.Errorf("route %d: name %q is reserved for -target", i, defaultRule))
+		case strings.Contains(route.Name, "/"):
+			errs = append(errs, fmt.Errorf("route %s: name must not contain '/'", route.Name))
+		case seen[route.Name]:
+			errs = append(errs, fmt.Errorf("route %s: duplicate name", route.Name))
+		}
+		seen[route.Name] = true
+
+		if route.Host == "" && route.PathPrefix == "" {
+			errs = append(errs, fmt.Errorf("route %s: host or path_prefix is required", route.Name))
+		}
+		if route.PathPrefix != "" && !strings.HasPrefix(route.PathPrefix, "/") {
+			errs = append(errs, fmt.Errorf("route %s: path_prefix must start with '/'", route.Name))
+		}
+		if strings.HasPrefix(route.PathPrefix, "/_chaos") {
+			errs = append(errs, fmt.Errorf("route %s: path_prefix must not shadow /_chaos", route.Name))
+		}
+		if route.StripPrefix && route.PathPrefix == "" {
+			errs = append(errs, fmt.Errorf("route %s: strip_prefix requires path_prefix", route.Name))
+		}
+		if forward && route.forwards() {
+			// Requests go to their own destination
+		} else if _, err := route.targetURLs(); err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %w", route.Name, err))
+		}
+		if err := route.Pool.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %w", route.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// forwards reports whether the route has no targets of its own, which in
+// forward mode sends requests to their destination
+func (c RouteConfig) forwards() bool {
+	return c.Target == "" && len(c.Targets) == 0
+}
+
+// targetURLs parses Target and Targets into the backends of the route
+func (c RouteConfig) targetURLs() ([]*url.URL, error) {
+	targets := c.Targets
+	if c.Target != "" {
+		targets = append([]string{c.Target}, targets...)
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("target or targets is required")
+	}
+
+	urls := make([]*url.URL, 0, len(targets))
+	for _, target := range targets {
+		u, err := url.Parse(target)
+		if err == nil && u.Scheme == unixScheme {
+			if u.Host != "" || u.Path == "" {
+				return nil, fmt.Errorf("unix socket target must be unix:///path/to.sock, got %q", target)
+			}
+		} else if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("target must be an absolute URL, got %q", target)
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// Route is one entry of the routing table with the middleware serving it
+type Route struct {
+	RouteConfig
+	chaos *ChaosMiddleware
+}
+
+// Middleware returns the middleware applying this route's chaos configuration
+func (rt *Route) Middleware() *ChaosMiddleware {
+	return rt.chaos
+}
+
+// Backends lists the target URLs of the route, comma-separated
+func (rt *Route) Backends() string {
+	return rt.chaos.pool.String()
+}
+
+// adjust derives this route's configuration from the base configuration
+func (rt *Route) adjust(base *ChaosConfig, profiles *ProfileLibrary) (*ChaosConfig, error) {
+	config := base
+	if rt.Profile != "" {
+		profile, err := profiles.Get(rt.Profile)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", rt.Name, err)
+		}
+		if config, err = profile.ApplyTo(config); err != nil {
+			return nil, fmt.Errorf("route %s: %w", rt.Name, err)
+		}
+	}
+	if len(rt.Chaos) > 0 {
+		overrides := &Profile{Name: rt.Name, Values: rt.Chaos}
+		var err error
+		if config, err = overrides.ApplyTo(config); err != nil {
+			return nil, fmt.Errorf("route %s: %w", rt.Name, err)
+		}
+	}
+	return config.Clone(), nil
+}
+
+// matches reports whether the route serves the request
+func (rt *Route) matches(r *http.Request) bool {
+	if rt.Host != "" {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if !strings.EqualFold(host, rt.Host) {
+			return false
+		}
+	}
+	if rt.PathPrefix == "" || rt.PathPrefix == "/" {
+		return true
+	}
+	prefix := strings.TrimSuffix(rt.PathPrefix, "/")
+	return r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/")
+}
+
+// Router sends each request to the chaos middleware of the first matching
+// route. Routes with a host are tried before routes without one, and longer
+// path prefixes before shorter ones. Requests matching no route go to the
+// default route built from -target, if any.
+//
+// /_chaos/routes lists the routes, /_chaos/routes/{name}/... serves the
+// management API of one route and every other /_chaos endpoint belongs to
+// the default route, or to the first route when there is no -target.
+type Router struct {
+	routes   []*Route
+	fallback *Route
+	profiles *ProfileLibrary
+
+	// forward is set for an explicit proxy, where requests name their
+	// destination; mitm intercepts CONNECT tunnels when enabled
+	forward bool
+	mitm    *mitm
+}
+
+// NewRouter builds a middleware per route from the base configuration.
+// fallback describes the targets given with -target and may be nil when
+// every request is covered by the routing table.
+func NewRouter(base *ChaosConfig, fallback *RouteConfig, table *RoutingTable, profiles *ProfileLibrary) (*Router, error) {
+	return newRouter(base, fallback, table, profiles, false)
+}
+
+func newRouter(base *ChaosConfig, fallback *RouteConfig, table *RoutingTable, profiles *ProfileLibrary, forward bool) (*Router, error) {
+	if profiles == nil {
+		profiles = BuiltinProfiles()
+	}
+	router := &Router{profiles: profiles, forward: forward}
+
+	if fallback != nil {
+		cfg := *fallback
+		cfg.Name = defaultRule
+		if err := cfg.Pool.Validate(); err != nil {
+			return nil, err
+		}
+		router.fallback = &Route{RouteConfig: cfg}
+		if forward {
+			router.fallback.chaos = NewForwardMiddleware(base.Clone(), cfg.Pool)
+		} else {
+			targets, err := cfg.targetURLs()
+			if err != nil {
+				return nil, err
+			}
+			router.fallback.chaos = NewPoolMiddleware(base.Clone(), targets, cfg.Pool)
+		}
+	}
+
+	if table != nil {
+		if err := table.validate(forward); err != nil {
+			return nil, err
+		}
+		for _, cfg := range table.Routes {
+			rt := &Route{RouteConfig: cfg}
+			config, err := rt.adjust(base, profiles)
+			if err != nil {
+				return nil, err
+			}
+			if err := config.Validate(); err != nil {
+				return nil, fmt.Errorf("route %s: %w", cfg.Name, err)
+			}
+			if forward && cfg.forwards() {
+				rt.chaos = NewForwardMiddleware(config, cfg.Pool)
+			} else {
+				targets, _ := cfg.targetURLs()
+				rt.chaos = NewPoolMiddleware(config, targets, cfg.Pool)
+			}
+			rt.chaos.name = cfg.Name
+			if cfg.StripPrefix {
+				rt.chaos.stripPrefix = strings.TrimSuffix(cfg.PathPrefix, "/")
+			}
+			router.routes = append(router.routes, rt)
+		}
+	}
+
+	if router.fallback == nil && len(router.routes) == 0 {
+		return nil, errors.New("no target: set -target or define at least one route")
+	}
+
+	sort.SliceStable(router.routes, func(i, j int) bool {
+		a, b := router.routes[i], router.routes[j]
+		if (a.Host != "") != (b.Host != "") {
+			return a.Host != ""
+		}
+		return len(a.PathPrefix) > len(b.PathPrefix)
+	})
+
+	// Events of every route go through one hub, so that subscribers can
+	// follow all of them or pick some by rule
+	events := newEventHub()
+	for _, rt := range router.Routes() {
+		rt.chaos.profiles = profiles
+		rt.chaos.events = events
+		if forward {
+			rt.chaos.connect = router.connect
+		}
+	}
+	return router, nil
+}
+
+// Routes returns every route, including the default route, in match order
+func (rr *Router) Routes() []*Route {
+	routes := append([]*Route{}, rr.routes...)
+	if rr.fallback != nil {
+		routes = append(routes, rr.fallback)
+	}
+	return routes
+}
+
+// Route returns the route with the given name
+func (rr *Router) Route(name string) (*Route, bool) {
+	for _, rt := range rr.Routes() {
+		if rt.Name == name {
+			return rt, true
+		}
+	}
+	return nil, false
+}
+
+// Default returns the route serving the unqualified /_chaos endpoints
+func (rr *Router) Default() *Route {
+	if rr.fallback != nil {
+		return rr.fallback
+	}
+	return rr.routes[0]
+}
+
+// EnableAuditLog persists the configuration history of every route to a
+// single file at path
+func (rr *Router) EnableAuditLog(path string) error {
+	audit, err := openAuditLog(path)
+	if err != nil {
+		return err
+	}
+	for _, rt := range rr.Routes() {
+		rt.chaos.audit = audit
+	}
+	return nil
+}
+
+// Reload rebuilds the configuration of every route from the base
+// configuration returned by load. Routes whose new configuration is
+// invalid keep their current one.
+func (rr *Router) Reload(load ConfigLoader, change ConfigChange) error {
+	base, err := load()
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+
+	var errs []error
+	for _, rt := range rr.Routes() {
+		routeLoad := func() (*ChaosConfig, error) {
+			if rt == rr.fallback {
+				return base.Clone(), nil
+			}
+			return rt.adjust(base, rr.profiles)
+		}
+		if err := rt.chaos.Reload(routeLoad, change); err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %w", rt.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close releases resources held by every route
+func (rr *Router) Close() error {
+	var errs []error
+	for _, rt := range rr.Routes() {
+		errs = append(errs, rt.chaos.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// ServeHTTP implements the http.Handler interface
+func (rr *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isManagement(r, rr.forward) {
+		rr.handleManagement(w, r)
+		return
+	}
+
+	if r.Method == http.MethodConnect && rr.mitm != nil && rr.mitm.intercepts(hostOnly(r.Host)) {
+		rr.intercept(w, r)
+		return
+	}
+
+	if rr.forward && !isProxyRequest(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "This is a forward proxy: send absolute URLs or CONNECT requests",
+			"path":  r.URL.Path,
+		})
+		return
+	}
+
+	if rt := rr.Match(r); rt != nil {
+		rt.chaos.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadGateway)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": "No route matches the request",
+		"host":  r.Host,
+		"path":  r.URL.Path,
+	})
+}
+
+// Match returns the route serving a proxied request, or nil when no route
+// matches and there is no default route
+func (rr *Router) Match(r *http.Request) *Route {
+	for _, rt := range rr.routes {
+		if rt.matches(r) {
+			return rt
+		}
+	}
+	return rr.fallback
+}
+
+func (rr *Router) handleManagement(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/_chaos/routes" {
+		rr.handleRoutesEndpoint(w, r)
+		return
+	}
+
+	rest, ok := strings.CutPrefix(r.URL.Path, "/_chaos/routes/")
+	if !ok {
+		rr.Default().chaos.ServeHTTP(w, r)
+		return
+	}
+
+	name, endpoint, _ := strings.Cut(rest, "/")
+	rt, ok := rr.Route(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown route %q", name), http.StatusNotFound)
+		return
+	}
+
+	r = r.Clone(r.Context())
+	r.URL.Path = strings.TrimSuffix("/_chaos/"+endpoint, "/")
+	r.URL.RawPath = ""
+	if r.URL.Path == "/_chaos/events" {
+		q := r.URL.Query()
+		q.Set("rule", rt.Name)
+		r.URL.RawQuery = q.Encode()
+	}
+	rt.chaos.ServeHTTP(w, r)
+}
+
+func (rr *Router) handleRoutesEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	routes := []map[string]interface{}{}
+	for _, rt := range rr.Routes() {
+		version := rt.chaos.ConfigVersion()
+		routes = append(routes, map[string]interface{}{
+			"name":           rt.Name,
+			"host":           rt.Host,
+			"path_prefix":    rt.PathPrefix,
+			"strip_prefix":   rt.StripPrefix,
+			"target":         rt.Backends(),
+			"profile":        rt.Profile,
+			"config_version": version.Version,
+			"requests":       rt.chaos.stats.totalRequests(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"routes": routes,
+	})
+}
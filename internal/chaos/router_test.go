@@ -0,0 +1,80 @@
+package chaos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouterMatchOrder(t *testing.T) {
+	const target = "http://127.0.0.1:1"
+	// Listed shortest and hostless first, so that only the sorting puts
+	// them in match order
+	table := &RoutingTable{Routes: []RouteConfig{
+		{Name: "root", PathPrefix: "/", Target: target},
+		{Name: "api", PathPrefix: "/api", Target: target},
+		{Name: "api-orders", PathPrefix: "/api/orders/", Target: target},
+		{Name: "admin-host", Host: "admin.example.com", Target: target},
+		{Name: "admin-api", Host: "admin.example.com", PathPrefix: "/api", Target: target},
+	}}
+
+	tests := []struct {
+		host, path string
+		want       string
+	}{
+		{"example.com", "/api/orders/42", "api-orders"},
+		{"example.com", "/api/orders", "api-orders"},
+		{"example.com", "/api/ordersx", "api"},
+		{"example.com", "/api", "api"},
+		{"example.com", "/apix", "root"},
+		{"example.com", "/", "root"},
+		{"admin.example.com", "/api/orders/42", "admin-api"},
+		{"ADMIN.example.com:8080", "/api", "admin-api"},
+		{"admin.example.com", "/users", "admin-host"},
+	}
+
+	router, err := NewRouter(quietConfig(), nil, table, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { router.Close() })
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		r.Host = tt.host
+		rt := router.Match(r)
+		if rt == nil || rt.Name != tt.want {
+			t.Errorf("%s%s matched %v, want %s", tt.host, tt.path, rt, tt.want)
+		}
+	}
+}
+
+func TestRouterMatchFallback(t *testing.T) {
+	const target = "http://127.0.0.1:1"
+	table := &RoutingTable{Routes: []RouteConfig{{Name: "api", PathPrefix: "/api", Target: target}}}
+
+	tests := []struct {
+		name     string
+		fallback *RouteConfig
+		want     string
+	}{
+		{"default route", &RouteConfig{Target: target}, defaultRule},
+		{"no default route", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, err := NewRouter(quietConfig(), tt.fallback, table, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { router.Close() })
+
+			got := ""
+			if rt := router.Match(httptest.NewRequest(http.MethodGet, "/users", nil)); rt != nil {
+				got = rt.Name
+			}
+			if got != tt.want {
+				t.Errorf("unmatched request went to %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
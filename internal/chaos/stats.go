@@ -0,0 +1,372 @@
+package chaos
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxLatencySamples = 20000
+
+// latencyWindows are the sliding windows reported by /_chaos/stats
+var latencyWindows = []struct {
+	name string
+	size time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+}
+
+var (
+	uuidSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegment     = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// routeTemplate collapses identifier-like path segments so that requests to
+// /users/42 and /users/7 are counted together as /users/:id
+func routeTemplate(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if numericSegment.MatchString(seg) || uuidSegment.MatchString(seg) || hexSegment.MatchString(seg) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// breakdown counts requests, faults and final statuses for one dimension value
+type breakdown struct {
+	Requests int64            `json:"requests"`
+	Faults   map[string]int64 `json:"faults"`
+	Statuses map[string]int64 `json:"statuses"`
+}
+
+func newBreakdown() *breakdown {
+	return &breakdown{Faults: map[string]int64{}, Statuses: map[string]int64{}}
+}
+
+// clone returns a copy that later requests do not modify
+func (b *breakdown) clone() *breakdown {
+	return &breakdown{Requests: b.Requests, Faults: copyCounts(b.Faults), Statuses: copyCounts(b.Statuses)}
+}
+
+func (b *breakdown) add(faults []string, status int) {
+	b.Requests++
+	for _, f := range faults {
+		b.Faults[f]++
+	}
+	b.Statuses[strconv.Itoa(status)]++
+}
+
+type latencySample struct {
+	at          time.Time
+	upstream    time.Duration
+	hasUpstream bool
+	injected    time.Duration
+}
+
+// statsCollector aggregates request outcomes for the stats endpoint
+type statsCollector struct {
+	mu    sync.Mutex
+	since time.Time
+
+	total    int64
+	faults   map[string]int64
+	dryRun   map[string]int64
+	byRoute  map[string]*breakdown
+	byMethod map[string]*breakdown
+	byStatus map[string]int64
+
+	// byGRPCStatus counts the statuses gRPC calls ended with
+	byGRPCStatus map[string]int64
+
+	// tlsFaults counts faults injected on TLS handshakes, which happen
+	// before any request exists
+	tlsFaults map[string]int64
+
+	// http2Faults counts faults injected on HTTP/2 frames
+	http2Faults map[string]int64
+
+	// webSocketFaults counts upgrades rejected and faults injected on
+	// WebSocket streams
+	webSocketFaults map[string]int64
+
+	// streamFaults counts faults injected in streaming responses
+	streamFaults map[string]int64
+
+	// tcpConnections and tcpFaults count connections accepted and faults
+	// injected in tcp mode
+	tcpConnections int64
+	tcpFaults      map[string]int64
+
+	// udpFlows and udpFaults count client flows and faults in udp mode
+	udpFlows  int64
+	udpFaults map[string]int64
+
+	samples []latencySample
+	next    int
+}
+
+func newStatsCollector() *statsCollector {
+	s := &statsCollector{}
+	s.reset()
+	return s
+}
+
+// reset clears every counter and latency sample
+func (s *statsCollector) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.since = time.Now()
+	s.total = 0
+	s.faults = map[string]int64{}
+	s.dryRun = map[string]int64{}
+	s.byRoute = map[string]*breakdown{}
+	s.byMethod = map[string]*breakdown{}
+	s.byStatus = map[string]int64{}
+	s.tlsFaults = map[string]int64{}
+	s.http2Faults = map[string]int64{}
+	s.webSocketFaults = map[string]int64{}
+	s.streamFaults = map[string]int64{}
+	s.tcpConnections = 0
+	s.tcpFaults = map[string]int64{}
+	s.udpFlows = 0
+	s.udpFaults = map[string]int64{}
+	s.byGRPCStatus = map[string]int64{}
+	s.samples = make([]latencySample, 0, 1024)
+	s.next = 0
+}
+
+// record adds a finished request to the statistics
+func (s *statsCollector) record(rec *requestRecord) {
+	kinds := rec.Decision.kinds()
+
+	sample := latencySample{
+		at:          rec.Start,
+		upstream:    rec.UpstreamLatency,
+		hasUpstream: rec.UpstreamStatus != 0,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.total++
+
+	applied := kinds
+	if rec.DryRun {
+		for _, k := range kinds {
+			s.dryRun[k]++
+		}
+		applied = nil
+	} else {
+		for _, k := range kinds {
+			s.faults[k]++
+		}
+		sample.injected = rec.Decision.Delay + rec.Decision.Timeout
+	}
+	if len(applied) == 0 {
+		s.faults[faultFilterNone]++
+	}
+
+	route := rec.Method + " " + routeTemplate(rec.Path)
+	if s.byRoute[route] == nil {
+		s.byRoute[route] = newBreakdown()
+	}
+	s.byRoute[route].add(applied, rec.Status)
+
+	if s.byMethod[rec.Method] == nil {
+		s.byMethod[rec.Method] = newBreakdown()
+	}
+	s.byMethod[rec.Method].add(applied, rec.Status)
+
+	s.byStatus[strconv.Itoa(rec.Status)]++
+	if rec.GRPCStatus != "" {
+		s.byGRPCStatus[rec.GRPCStatus]++
+	}
+
+	if len(s.samples) < maxLatencySamples {
+		s.samples = append(s.samples, sample)
+	} else {
+		s.samples[s.next] = sample
+		s.next = (s.next + 1) % maxLatencySamples
+	}
+}
+
+// recordTLSFault counts a fault injected on a TLS handshake
+func (s *statsCollector) recordTLSFault(kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tlsFaults[kind]++
+}
+
+// recordHTTP2Fault counts a fault injected on an HTTP/2 stream
+func (s *statsCollector) recordHTTP2Fault(kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.http2Faults[kind]++
+}
+
+// recordWebSocketFault counts a fault injected on a WebSocket connection
+func (s *statsCollector) recordWebSocketFault(kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.webSocketFaults[kind]++
+}
+
+// recordStreamFault counts a fault injected in a streaming response
+func (s *statsCollector) recordStreamFault(kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streamFaults[kind]++
+}
+
+// recordTCPConnection counts a connection accepted in tcp mode
+func (s *statsCollector) recordTCPConnection() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tcpConnections++
+}
+
+// recordTCPFault counts a fault injected on a TCP connection
+func (s *statsCollector) recordTCPFault(kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tcpFaults[kind]++
+}
+
+// recordUDPFlow counts a new client flow in udp mode
+func (s *statsCollector) recordUDPFlow() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.udpFlows++
+}
+
+// recordUDPFault counts a fault injected on a datagram
+func (s *statsCollector) recordUDPFault(kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.udpFaults[kind]++
+}
+
+// totalRequests returns the number of requests recorded since the last reset
+func (s *statsCollector) totalRequests() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
+
+// snapshot renders the collected statistics. Every map is copied under the
+// lock, so the result can be encoded while requests keep being recorded.
+func (s *statsCollector) snapshot(dryRunEnabled bool) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return map[string]interface{}{
+		"total_requests":     s.total,
+		"delays_injected":    s.faults["delay"],
+		"errors_injected":    s.faults["error"],
+		"timeouts_injected":  s.faults["timeout"],
+		"delay_percentage":   percentage(s.faults["delay"], s.total),
+		"error_percentage":   percentage(s.faults["error"], s.total),
+		"timeout_percentage": percentage(s.faults["timeout"], s.total),
+		"since":              s.since.Format(time.RFC3339),
+		"by_route":           copyBreakdowns(s.byRoute),
+		"by_method":          copyBreakdowns(s.byMethod),
+		"by_fault":           copyCounts(s.faults),
+		"by_status":          copyCounts(s.byStatus),
+		"by_grpc_status":     copyCounts(s.byGRPCStatus),
+		"tls_faults":         copyCounts(s.tlsFaults),
+		"http2_faults":       copyCounts(s.http2Faults),
+		"websocket_faults":   copyCounts(s.webSocketFaults),
+		"stream_faults":      copyCounts(s.streamFaults),
+		"tcp_connections":    s.tcpConnections,
+		"tcp_faults":         copyCounts(s.tcpFaults),
+		"udp_flows":          s.udpFlows,
+		"udp_faults":         copyCounts(s.udpFaults),
+		"latency":            s.latencyWindows(),
+		"dry_run": map[string]interface{}{
+			"enabled":       dryRunEnabled,
+			"would_delay":   s.dryRun["delay"],
+			"would_error":   s.dryRun["error"],
+			"would_timeout": s.dryRun["timeout"],
+		},
+	}
+}
+
+func copyCounts(counts map[string]int64) map[string]int64 {
+	c := make(map[string]int64, len(counts))
+	for k, v := range counts {
+		c[k] = v
+	}
+	return c
+}
+
+func copyBreakdowns(breakdowns map[string]*breakdown) map[string]*breakdown {
+	c := make(map[string]*breakdown, len(breakdowns))
+	for k, b := range breakdowns {
+		c[k] = b.clone()
+	}
+	return c
+}
+
+// latencyWindows computes upstream and injected latency percentiles over
+// each sliding window
+func (s *statsCollector) latencyWindows() map[string]interface{} {
+	now := time.Now()
+	windows := make(map[string]interface{}, len(latencyWindows))
+
+	for _, w := range latencyWindows {
+		var upstream, injected []time.Duration
+		for _, sample := range s.samples {
+			if now.Sub(sample.at) > w.size {
+				continue
+			}
+			if sample.hasUpstream {
+				upstream = append(upstream, sample.upstream)
+			}
+			injected = append(injected, sample.injected)
+		}
+
+		windows[w.name] = map[string]interface{}{
+			"requests": len(injected),
+			"upstream": percentiles(upstream),
+			"injected": percentiles(injected),
+		}
+	}
+
+	return windows
+}
+
+// percentiles returns p50/p90/p99 in milliseconds using the nearest-rank method
+func percentiles(values []time.Duration) map[string]float64 {
+	result := map[string]float64{"p50_ms": 0, "p90_ms": 0, "p99_ms": 0}
+	if len(values) == 0 {
+		return result
+	}
+
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	for name, p := range map[string]float64{"p50_ms": 50, "p90_ms": 90, "p99_ms": 99} {
+		rank := int(math.Ceil(p/100*float64(len(values)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		result[name] = float64(values[rank].Microseconds()) / 1000
+	}
+
+	return result
+}
+
+func percentage(part, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total) * 100
+}
@@ -0,0 +1,108 @@
+package chaos
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func statsRecord(path string, status int, decision faultDecision) *requestRecord {
+	return &requestRecord{
+		Method:   http.MethodGet,
+		Path:     path,
+		Status:   status,
+		Decision: decision,
+		Start:    time.Now(),
+	}
+}
+
+func TestSnapshotIsACopy(t *testing.T) {
+	s := newStatsCollector()
+	s.record(statsRecord("/users/1", 503, faultDecision{ErrorCode: 503}))
+	s.recordWebSocketFault(WebSocketFaultClose)
+
+	snap := s.snapshot(false)
+
+	s.record(statsRecord("/users/2", 503, faultDecision{ErrorCode: 503}))
+	s.recordWebSocketFault(WebSocketFaultClose)
+
+	route := snap["by_route"].(map[string]*breakdown)["GET /users/:id"]
+	if route.Requests != 1 || route.Faults["error"] != 1 || route.Statuses["503"] != 1 {
+		t.Errorf("by_route changed after snapshot: %+v", route)
+	}
+	if got := snap["by_fault"].(map[string]int64)["error"]; got != 1 {
+		t.Errorf("by_fault error = %d after snapshot, want 1", got)
+	}
+	if got := snap["websocket_faults"].(map[string]int64)[WebSocketFaultClose]; got != 1 {
+		t.Errorf("websocket_faults closed = %d after snapshot, want 1", got)
+	}
+}
+
+func TestSnapshotWhileRecording(t *testing.T) {
+	// Run with -race: encoding a snapshot must not read maps being written
+	s := newStatsCollector()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				s.record(statsRecord(fmt.Sprintf("/r%d/%d", n%7, n), 200+n%5, faultDecision{ErrorCode: 500 + n%4}))
+				s.recordTCPFault(TCPFaultReset)
+				s.recordUDPFault(UDPFaultLoss)
+				s.recordStreamFault(fmt.Sprint("kind", n%3))
+			}
+		}(i)
+	}
+
+	for i := 0; i < 200; i++ {
+		if _, err := json.Marshal(s.snapshot(false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestStatsEndpointUnderLoad(t *testing.T) {
+	cm := newTestProxy(t, quietConfig(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; ; n++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			cm.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, fmt.Sprintf("/items/%d", n), nil))
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		w := httptest.NewRecorder()
+		cm.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_chaos/stats", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("stats returned %d", w.Code)
+		}
+		var stats map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,373 @@
+package chaos
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"mime"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Streaming faults, as counted in statistics
+const (
+	StreamFaultCut       = "cut"
+	StreamFaultDuplicate = "duplicated"
+	StreamFaultReorder   = "reordered"
+	StreamFaultStall     = "stalled"
+)
+
+// Ways to end a cut stream
+const (
+	StreamCutClose = "close"
+	StreamCutReset = "reset"
+)
+
+// maxEventSize bounds the partial event buffered while looking for its
+// end. A stream whose event outgrows it is forwarded unchanged from then
+// on, since it is not split into events the way its type promises.
+const maxEventSize = 1 << 20
+
+// errStreamCut makes the proxy stop copying a cut stream
+var errStreamCut = errors.New("chaos: stream cut")
+
+// StreamingConfig controls faults injected in the middle of streaming
+// responses: Server-Sent Events and newline-delimited JSON. Each event is
+// a unit for these faults; other responses are never affected.
+type StreamingConfig struct {
+	// CutProbability stops forwarding the stream after CutAfterEvents
+	// events, or after a random duration between CutAfterMin and
+	// CutAfterMax, whichever comes first. CutMode "close" (default) ends
+	// the response cleanly, "reset" aborts the connection.
+	CutProbability float64  `json:"cut_probability,omitempty"`
+	CutAfterEvents int      `json:"cut_after_events,omitempty"`
+	CutAfterMin    Duration `json:"cut_after_min,omitempty"`
+	CutAfterMax    Duration `json:"cut_after_max,omitempty"`
+	CutMode        string   `json:"cut_mode,omitempty"`
+
+	// DuplicateProbability sends an event twice
+	DuplicateProbability float64 `json:"duplicate_probability,omitempty"`
+
+	// ReorderProbability holds an event back and sends it after the next one
+	ReorderProbability float64 `json:"reorder_probability,omitempty"`
+
+	// StallProbability pauses the stream before an event for a random
+	// duration between StallMin and StallMax, keeping the connection open
+	StallProbability float64  `json:"stall_probability,omitempty"`
+	StallMin         Duration `json:"stall_min,omitempty"`
+	StallMax         Duration `json:"stall_max,omitempty"`
+}
+
+// Enabled reports whether any streaming fault can be injected
+func (c StreamingConfig) Enabled() bool {
+	return c.CutProbability > 0 || c.DuplicateProbability > 0 ||
+		c.ReorderProbability > 0 || c.StallProbability > 0
+}
+
+func (c StreamingConfig) validate() error {
+	var errs []error
+	probabilities := []struct {
+		name  string
+		value float64
+	}{
+		{"cut_probability", c.CutProbability},
+		{"duplicate_probability", c.DuplicateProbability},
+		{"reorder_probability", c.ReorderProbability},
+		{"stall_probability", c.StallProbability},
+	}
+	for _, p := range probabilities {
+		if p.value < 0 || p.value > 1 {
+			errs = append(errs, fmt.Errorf("streaming.%s must be between 0 and 1, got %v", p.name, p.value))
+		}
+	}
+	if c.CutAfterEvents < 0 {
+		errs = append(errs, errors.New("streaming.cut_after_events must not be negative"))
+	}
+	if c.CutAfterMin.Duration > c.CutAfterMax.Duration {
+		errs = append(errs, errors.New("streaming.cut_after_min must not exceed cut_after_max"))
+	}
+	if c.CutProbability > 0 && c.CutAfterEvents == 0 && c.CutAfterMax.Duration <= 0 {
+		errs = append(errs, errors.New("streaming.cut_probability needs cut_after_events or cut_after_max"))
+	}
+	if c.CutMode != "" && c.CutMode != StreamCutClose && c.CutMode != StreamCutReset {
+		errs = append(errs, fmt.Errorf("streaming.cut_mode must be %q or %q, got %q", StreamCutClose, StreamCutReset, c.CutMode))
+	}
+	if c.StallMin.Duration > c.StallMax.Duration {
+		errs = append(errs, errors.New("streaming.stall_min must not exceed stall_max"))
+	}
+	if c.StallProbability > 0 && c.StallMax.Duration <= 0 {
+		errs = append(errs, errors.New("streaming.stall_max is required when stall_probability is set"))
+	}
+	return errors.Join(errs...)
+}
+
+// streamPlan holds the streaming faults chosen for one request
+type streamPlan struct {
+	config   StreamingConfig
+	cutAt    int
+	cutAfter time.Duration
+	dryRun   bool
+}
+
+// planStream decides the streaming faults of a request, or returns nil when
+// its response will be left alone whatever it turns out to be
+func (cm *ChaosMiddleware) planStream(config *ChaosConfig) *streamPlan {
+	sc := config.Streaming
+	if !sc.Enabled() {
+		return nil
+	}
+	plan := &streamPlan{config: sc, dryRun: config.DryRun}
+	if rand.Float64() < sc.CutProbability {
+		plan.cutAt = sc.CutAfterEvents
+		if sc.CutAfterMax.Duration > 0 {
+			plan.cutAfter = pickBetween(sc.CutAfterMin.Duration, sc.CutAfterMax.Duration)
+		}
+	}
+	return plan
+}
+
+// proxyStream proxies the request through a streamWriter. A cut stream
+// makes the reverse proxy abort the handler; unless the cut should reset
+// the connection, the abort is swallowed so the response ends cleanly.
+func (cm *ChaosMiddleware) proxyStream(w http.ResponseWriter, r *http.Request, plan *streamPlan, rec *requestRecord) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	sw := &streamWriter{ResponseWriter: w, plan: plan, stats: cm.stats, requestID: rec.ID, ctx: ctx, cancel: cancel}
+	defer func() {
+		sw.stop()
+		if sw.cut.Load() && plan.config.CutMode != StreamCutReset {
+			if v := recover(); v != nil && v != http.ErrAbortHandler {
+				panic(v)
+			}
+		}
+	}()
+
+	cm.proxy.ServeHTTP(sw, r.WithContext(ctx))
+	sw.finish()
+}
+
+// streamWriter splits a streaming response into events and disturbs them
+// on their way to the client
+type streamWriter struct {
+	http.ResponseWriter
+	plan      *streamPlan
+	stats     *statsCollector
+	requestID string
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	wroteHeader bool
+	split       func([]byte) int
+	buf         []byte
+	held        []byte
+	events      atomic.Int64
+	timer       *time.Timer
+	cut         atomic.Bool
+}
+
+func (sw *streamWriter) WriteHeader(code int) {
+	if sw.wroteHeader {
+		return
+	}
+	sw.wroteHeader = true
+
+	if code == http.StatusOK {
+		sw.split = eventSplitter(sw.Header().Get("Content-Type"))
+	}
+	if sw.split != nil && sw.plan.dryRun {
+		if sw.plan.cutAt > 0 || sw.plan.cutAfter > 0 {
+			slog.Info("dry run, would cut stream", "request_id", sw.requestID,
+				"after_events", sw.plan.cutAt, "after", sw.plan.cutAfter)
+		}
+		sw.split = nil
+	}
+	if sw.split != nil && sw.plan.cutAfter > 0 {
+		sw.timer = time.AfterFunc(sw.plan.cutAfter, sw.cutStream)
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if sw.cut.Load() {
+		return 0, errStreamCut
+	}
+	if sw.split == nil {
+		return sw.ResponseWriter.Write(p)
+	}
+
+	sw.buf = append(sw.buf, p...)
+	for !sw.cut.Load() {
+		n := sw.split(sw.buf)
+		if n == 0 {
+			break
+		}
+		event := sw.buf[:n:n]
+		sw.buf = sw.buf[n:]
+		if err := sw.event(event); err != nil {
+			return 0, err
+		}
+	}
+	if sw.cut.Load() {
+		return 0, errStreamCut
+	}
+	if len(sw.buf) > maxEventSize {
+		slog.Warn("stream event too large, no longer splitting", "request_id", sw.requestID,
+			"buffered", len(sw.buf))
+		sw.split = nil
+		err := sw.forward(sw.buf)
+		sw.buf = nil
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	sw.buf = append([]byte(nil), sw.buf...)
+	return len(p), nil
+}
+
+// Flush implements http.Flusher; an event held back for reordering stays
+// held until the next one
+func (sw *streamWriter) Flush() {
+	if !sw.cut.Load() {
+		http.NewResponseController(sw.ResponseWriter).Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (sw *streamWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// event applies the faults to one complete event and forwards it
+func (sw *streamWriter) event(event []byte) error {
+	if isSSEComment(event) {
+		_, err := sw.ResponseWriter.Write(event)
+		return err
+	}
+	n := sw.events.Add(1)
+	config := sw.plan.config
+
+	if rand.Float64() < config.StallProbability {
+		stall := pickBetween(config.StallMin.Duration, config.StallMax.Duration)
+		slog.Debug("stalling stream", "request_id", sw.requestID, "stall", stall)
+		sw.stats.recordStreamFault(StreamFaultStall)
+		http.NewResponseController(sw.ResponseWriter).Flush()
+		if !sleepContext(sw.ctx, stall) {
+			return errStreamCut
+		}
+	}
+
+	switch {
+	case sw.held == nil && rand.Float64() < config.ReorderProbability:
+		slog.Debug("holding back stream event", "request_id", sw.requestID, "event", n)
+		sw.stats.recordStreamFault(StreamFaultReorder)
+		sw.held = event
+	case rand.Float64() < config.DuplicateProbability:
+		slog.Debug("duplicating stream event", "request_id", sw.requestID, "event", n)
+		sw.stats.recordStreamFault(StreamFaultDuplicate)
+		if err := sw.forward(event, event); err != nil {
+			return err
+		}
+	default:
+		if err := sw.forward(event); err != nil {
+			return err
+		}
+	}
+
+	if sw.plan.cutAt > 0 && n >= int64(sw.plan.cutAt) {
+		// The events before the cut reach the client even when the
+		// connection is reset
+		http.NewResponseController(sw.ResponseWriter).Flush()
+		sw.cutStream()
+	}
+	return nil
+}
+
+// forward writes events followed by the one held back, if any
+func (sw *streamWriter) forward(events ...[]byte) error {
+	if sw.held != nil {
+		events = append(events, sw.held)
+		sw.held = nil
+	}
+	for _, e := range events {
+		if _, err := sw.ResponseWriter.Write(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cutStream stops the stream: writes fail from now on and the upstream
+// request is cancelled
+func (sw *streamWriter) cutStream() {
+	if !sw.cut.CompareAndSwap(false, true) {
+		return
+	}
+	slog.Info("cutting stream", "request_id", sw.requestID, "events", sw.events.Load(),
+		"mode", sw.plan.config.CutMode)
+	sw.stats.recordStreamFault(StreamFaultCut)
+	sw.cancel()
+}
+
+// finish forwards what is left once the upstream stream ended
+func (sw *streamWriter) finish() {
+	if sw.cut.Load() || sw.split == nil {
+		return
+	}
+	sw.forward(sw.buf)
+}
+
+func (sw *streamWriter) stop() {
+	if sw.timer != nil {
+		sw.timer.Stop()
+	}
+}
+
+// eventSplitter returns how to find the end of the first event for a
+// streaming content type, or nil when the type is not streamed by events
+func eventSplitter(contentType string) func([]byte) int {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/event-stream":
+		return splitSSE
+	case "application/x-ndjson", "application/jsonl", "application/stream+json":
+		return splitLines
+	}
+	return nil
+}
+
+// splitSSE finds the blank line ending an event
+func splitSSE(b []byte) int {
+	end := 0
+	if i := bytes.Index(b, []byte("\n\n")); i >= 0 {
+		end = i + 2
+	}
+	if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 && (end == 0 || i+4 < end) {
+		end = i + 4
+	}
+	return end
+}
+
+func splitLines(b []byte) int {
+	return bytes.IndexByte(b, '\n') + 1
+}
+
+// isSSEComment reports whether an event holds only comment lines, such as
+// keep-alives, which are passed through untouched
+func isSSEComment(event []byte) bool {
+	lines := bytes.Split(bytes.TrimRight(event, "\r\n"), []byte("\n"))
+	for _, line := range lines {
+		if !bytes.HasPrefix(line, []byte(":")) {
+			return false
+		}
+	}
+	return true
+}
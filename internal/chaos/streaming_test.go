@@ -0,0 +1,243 @@
+package chaos
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitters(t *testing.T) {
+	tests := []struct {
+		name  string
+		split func([]byte) int
+		in    string
+		want  int
+	}{
+		{"sse", splitSSE, "data: a\n\ndata: b\n\n", 9},
+		{"sse crlf", splitSSE, "data: a\r\n\r\ndata: b", 11},
+		{"sse first of mixed endings", splitSSE, "data: a\n\ndata: b\r\n\r\n", 9},
+		{"sse incomplete", splitSSE, "data: a\n", 0},
+		{"ndjson", splitLines, "{\"a\":1}\n{\"b\"", 8},
+		{"ndjson incomplete", splitLines, "{\"a\":1}", 0},
+	}
+	for _, tt := range tests {
+		if got := tt.split([]byte(tt.in)); got != tt.want {
+			t.Errorf("%s: split(%q) = %d, want %d", tt.name, tt.in, got, tt.want)
+		}
+	}
+
+	for contentType, streamed := range map[string]bool{
+		"text/event-stream; charset=utf-8": true,
+		"application/x-ndjson":             true,
+		"application/jsonl":                true,
+		"application/json":                 false,
+		"text/plain":                       false,
+	} {
+		if got := eventSplitter(contentType) != nil; got != streamed {
+			t.Errorf("eventSplitter(%q) streamed = %v, want %v", contentType, got, streamed)
+		}
+	}
+
+	if !isSSEComment([]byte(": keep-alive\n\n")) || isSSEComment([]byte(": note\ndata: x\n\n")) {
+		t.Error("isSSEComment misclassifies comment-only events")
+	}
+}
+
+// streamBackend sends events with the given content type, each split
+// across two flushed writes so that events straddle write boundaries
+func streamBackend(contentType string, events ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		rc := http.NewResponseController(w)
+		for _, e := range events {
+			half := len(e) / 2
+			io.WriteString(w, e[:half])
+			rc.Flush()
+			io.WriteString(w, e[half:])
+			rc.Flush()
+		}
+	})
+}
+
+func sseEvents(n int) []string {
+	events := make([]string, n)
+	for i := range events {
+		events[i] = "data: " + string(rune('0'+i)) + "\n\n"
+	}
+	return events
+}
+
+// streamThrough proxies one request through a middleware with the given
+// streaming faults and returns the body received and the read error
+func streamThrough(t *testing.T, sc StreamingConfig, backend http.Handler) (*ChaosMiddleware, string, error) {
+	t.Helper()
+	config := quietConfig()
+	config.Streaming = sc
+	cm := newTestProxy(t, config, backend)
+	srv := httptest.NewServer(cm)
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		return cm, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return cm, string(body), err
+}
+
+func streamFaults(cm *ChaosMiddleware) map[string]int64 {
+	return cm.stats.snapshot(false)["stream_faults"].(map[string]int64)
+}
+
+func TestStreamCut(t *testing.T) {
+	events := sseEvents(4)
+	tests := []struct {
+		mode    string
+		wantErr bool
+	}{
+		{StreamCutClose, false},
+		{StreamCutReset, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			sc := StreamingConfig{CutProbability: 1, CutAfterEvents: 2, CutMode: tt.mode}
+			cm, body, err := streamThrough(t, sc, streamBackend("text/event-stream", events...))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("read error %v, want error %v", err, tt.wantErr)
+			}
+			if want := events[0] + events[1]; body != want {
+				t.Errorf("body %q, want the first two events %q", body, want)
+			}
+			if got := streamFaults(cm)[StreamFaultCut]; got != 1 {
+				t.Errorf("cut streams = %d, want 1", got)
+			}
+			waitIdle(t, cm)
+		})
+	}
+}
+
+func TestStreamCutAfterDuration(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, "{\"n\":1}\n")
+		http.NewResponseController(w).Flush()
+		<-r.Context().Done()
+	})
+	sc := StreamingConfig{CutProbability: 1, CutAfterMin: Duration{Duration: 20 * time.Millisecond}, CutAfterMax: Duration{Duration: 20 * time.Millisecond}}
+	start := time.Now()
+	cm, body, err := streamThrough(t, sc, backend)
+	if err != nil || body != "{\"n\":1}\n" {
+		t.Errorf("body %q, error %v", body, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("cut after %v, want about 20ms", elapsed)
+	}
+	waitIdle(t, cm)
+}
+
+func TestStreamDuplicateNDJSON(t *testing.T) {
+	lines := []string{"{\"n\":1}\n", "{\"n\":2}\n"}
+	cm, body, err := streamThrough(t, StreamingConfig{DuplicateProbability: 1},
+		streamBackend("application/x-ndjson", lines...))
+	want := lines[0] + lines[0] + lines[1] + lines[1]
+	if err != nil || body != want {
+		t.Fatalf("body %q, error %v, want %q", body, err, want)
+	}
+	if got := streamFaults(cm)[StreamFaultDuplicate]; got != 2 {
+		t.Errorf("duplicated events = %d, want 2", got)
+	}
+}
+
+func TestStreamReorderFlushesHeldEventAtEnd(t *testing.T) {
+	// Every event that can be held is: 0 is sent after 1, and 2, held
+	// last, must still arrive when the stream ends
+	events := sseEvents(3)
+	_, body, err := streamThrough(t, StreamingConfig{ReorderProbability: 1},
+		streamBackend("text/event-stream", events...))
+	want := events[1] + events[0] + events[2]
+	if err != nil || body != want {
+		t.Fatalf("body %q, error %v, want %q", body, err, want)
+	}
+}
+
+func TestStreamCommentsPassThrough(t *testing.T) {
+	events := []string{": keep-alive\n\n", "data: x\n\n"}
+	_, body, err := streamThrough(t, StreamingConfig{DuplicateProbability: 1},
+		streamBackend("text/event-stream", events...))
+	want := events[0] + events[1] + events[1]
+	if err != nil || body != want {
+		t.Fatalf("body %q, error %v, want %q", body, err, want)
+	}
+}
+
+func TestStreamLeavesOtherResponsesAlone(t *testing.T) {
+	chunks := []string{"line one\n", "line two\n"}
+	_, body, err := streamThrough(t, StreamingConfig{DuplicateProbability: 1, ReorderProbability: 1},
+		streamBackend("text/plain", chunks...))
+	if err != nil || body != strings.Join(chunks, "") {
+		t.Fatalf("body %q, error %v", body, err)
+	}
+}
+
+func TestStreamStall(t *testing.T) {
+	const stall = 50 * time.Millisecond
+	events := sseEvents(2)
+	start := time.Now()
+	cm, body, err := streamThrough(t, StreamingConfig{StallProbability: 1, StallMin: Duration{Duration: stall}, StallMax: Duration{Duration: stall}},
+		streamBackend("text/event-stream", events...))
+	if err != nil || body != strings.Join(events, "") {
+		t.Fatalf("body %q, error %v", body, err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*stall {
+		t.Errorf("stream took %v, want at least %v", elapsed, 2*stall)
+	}
+	if got := streamFaults(cm)[StreamFaultStall]; got != 2 {
+		t.Errorf("stalls = %d, want 2", got)
+	}
+}
+
+// hijackRecorder is a ResponseRecorder that can be hijacked
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (h *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h.hijacked = true
+	return nil, nil, nil
+}
+
+func TestStreamWriterPassesFlushAndHijack(t *testing.T) {
+	w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	sw := &streamWriter{ResponseWriter: w, plan: &streamPlan{}, stats: newStatsCollector()}
+	rc := http.NewResponseController(sw)
+
+	if err := rc.Flush(); err != nil || !w.Flushed {
+		t.Errorf("Flush did not reach the client writer: %v", err)
+	}
+	if _, _, err := rc.Hijack(); err != nil || !w.hijacked {
+		t.Errorf("Hijack did not reach the client writer: %v", err)
+	}
+}
+
+func TestStreamStopsSplittingOversizeEvents(t *testing.T) {
+	huge := strings.Repeat("x", maxEventSize+maxEventSize/2) + "\n"
+	lines := []string{"{\"n\":1}\n", huge, "{\"n\":2}\n"}
+	cm, body, err := streamThrough(t, StreamingConfig{DuplicateProbability: 1},
+		streamBackend("application/x-ndjson", lines...))
+	// Only the event before the oversize one is duplicated; the rest is
+	// forwarded as it came
+	want := lines[0] + lines[0] + lines[1] + lines[2]
+	if err != nil || body != want {
+		t.Fatalf("body of %d bytes, error %v, want %d bytes", len(body), err, len(want))
+	}
+	if got := streamFaults(cm)[StreamFaultDuplicate]; got != 1 {
+		t.Errorf("duplicated events = %d, want 1", got)
+	}
+}
@@ -0,0 +1,154 @@
+package chaos
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Targeting key kinds
+const (
+	TargetKeyIP           = "ip"
+	TargetKeyForwardedFor = "x-forwarded-for"
+	TargetKeyHeader       = "header"
+	TargetKeyCookie       = "cookie"
+	TargetKeyJWTClaim     = "jwt_claim"
+)
+
+// targetingBucketCount is the number of buckets client keys are hashed into
+const targetingBucketCount = 10000
+
+// TargetingConfig restricts chaos to a consistent slice of clients. Each
+// client key is hashed into a fixed bucket so the same client always gets
+// the same decision. Fraction is the share of clients targeted, from 0.0
+// to 1.0 like every probability in the configuration.
+type TargetingConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Key      string   `json:"key"`
+	KeyName  string   `json:"key_name,omitempty"`
+	Fraction float64  `json:"fraction"`
+	Allow    []string `json:"allow,omitempty"`
+	Deny     []string `json:"deny,omitempty"`
+}
+
+// ParseTargetKey parses a compact key specification such as "ip",
+// "header:X-User-ID", "cookie:session" or "jwt:sub"
+func ParseTargetKey(spec string) (key, name string, err error) {
+	kind, name, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	switch strings.ToLower(kind) {
+	case TargetKeyIP, TargetKeyForwardedFor:
+		return strings.ToLower(kind), "", nil
+	case "xff":
+		return TargetKeyForwardedFor, "", nil
+	case TargetKeyHeader, TargetKeyCookie:
+		key = strings.ToLower(kind)
+	case "jwt", TargetKeyJWTClaim:
+		key = TargetKeyJWTClaim
+	default:
+		return "", "", fmt.Errorf("unknown targeting key %q", kind)
+	}
+	if name == "" {
+		return "", "", fmt.Errorf("targeting key %q requires a name, e.g. %s:NAME", kind, kind)
+	}
+	return key, name, nil
+}
+
+// Matches reports whether the request belongs to the targeted slice of clients
+func (t *TargetingConfig) Matches(r *http.Request) bool {
+	if !t.Enabled {
+		return true
+	}
+
+	key := t.clientKey(r)
+	if key == "" {
+		return false
+	}
+
+	for _, denied := range t.Deny {
+		if denied == key {
+			return false
+		}
+	}
+	for _, allowed := range t.Allow {
+		if allowed == key {
+			return true
+		}
+	}
+
+	return bucketFor(key) < int(t.Fraction*targetingBucketCount)
+}
+
+// clientKey extracts the configured client key from the request
+func (t *TargetingConfig) clientKey(r *http.Request) string {
+	switch t.Key {
+	case TargetKeyIP, "":
+		return remoteIP(r)
+	case TargetKeyForwardedFor:
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			return strings.TrimSpace(first)
+		}
+		return remoteIP(r)
+	case TargetKeyHeader:
+		return r.Header.Get(t.KeyName)
+	case TargetKeyCookie:
+		if cookie, err := r.Cookie(t.KeyName); err == nil {
+			return cookie.Value
+		}
+	case TargetKeyJWTClaim:
+		return jwtClaim(r, t.KeyName)
+	}
+	return ""
+}
+
+// bucketFor hashes a client key into one of targetingBucketCount buckets
+func bucketFor(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % targetingBucketCount)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// jwtClaim reads a claim from the bearer token without verifying its
+// signature; the token is only used as a stable client identifier
+func jwtClaim(r *http.Request, claim string) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+
+	parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+
+	switch value := claims[claim].(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,111 @@
+package chaos
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func userRequest(userID string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-User-ID", userID)
+	return r
+}
+
+func headerTargeting(fraction float64) *TargetingConfig {
+	return &TargetingConfig{Enabled: true, Key: TargetKeyHeader, KeyName: "X-User-ID", Fraction: fraction}
+}
+
+func TestBucketStableForSameKey(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		want := bucketFor(key)
+		for j := 0; j < 10; j++ {
+			if got := bucketFor(key); got != want {
+				t.Fatalf("bucketFor(%q) = %d, then %d", key, want, got)
+			}
+		}
+	}
+}
+
+func TestTargetingDecisionStableForSameKey(t *testing.T) {
+	targeting := headerTargeting(0.5)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		want := targeting.Matches(userRequest(key))
+		for j := 0; j < 10; j++ {
+			if got := targeting.Matches(userRequest(key)); got != want {
+				t.Fatalf("Matches(%q) = %v, then %v", key, want, got)
+			}
+		}
+	}
+}
+
+func TestTargetingFraction(t *testing.T) {
+	const clients = 10000
+	tests := []struct {
+		fraction float64
+		min, max int
+	}{
+		{0, 0, 0},
+		{0.1, 800, 1200},
+		{0.5, 4600, 5400},
+		{1, clients, clients},
+	}
+	for _, tt := range tests {
+		targeting := headerTargeting(tt.fraction)
+		n := 0
+		for i := 0; i < clients; i++ {
+			if targeting.Matches(userRequest(fmt.Sprintf("user-%d", i))) {
+				n++
+			}
+		}
+		if n < tt.min || n > tt.max {
+			t.Errorf("fraction %v targeted %d of %d clients, want %d-%d", tt.fraction, n, clients, tt.min, tt.max)
+		}
+	}
+}
+
+func TestTargetingGrowsWithFraction(t *testing.T) {
+	// Raising the fraction only adds clients: nobody targeted before drops out
+	small, large := headerTargeting(0.2), headerTargeting(0.6)
+	for i := 0; i < 1000; i++ {
+		r := userRequest(fmt.Sprintf("user-%d", i))
+		if small.Matches(r) && !large.Matches(r) {
+			t.Fatalf("user-%d targeted at 0.2 but not at 0.6", i)
+		}
+	}
+}
+
+func TestTargetingAllowDenyAndMissingKey(t *testing.T) {
+	targeting := headerTargeting(0)
+	targeting.Allow = []string{"qa"}
+	if !targeting.Matches(userRequest("qa")) {
+		t.Error("allowed key not targeted")
+	}
+
+	targeting = headerTargeting(1)
+	targeting.Deny = []string{"ceo"}
+	if targeting.Matches(userRequest("ceo")) {
+		t.Error("denied key targeted")
+	}
+	if targeting.Matches(httptest.NewRequest(http.MethodGet, "/", nil)) {
+		t.Error("request without the key targeted")
+	}
+}
+
+func TestTargetingFractionValidation(t *testing.T) {
+	for _, fraction := range []float64{-0.1, 1.5, 10} {
+		config := DefaultConfig()
+		config.Targeting = *headerTargeting(fraction)
+		if err := config.Validate(); err == nil {
+			t.Errorf("fraction %v accepted", fraction)
+		}
+	}
+	config := DefaultConfig()
+	config.Targeting = *headerTargeting(0.1)
+	if err := config.Validate(); err != nil {
+		t.Errorf("fraction 0.1 rejected: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// TCP faults, as counted in statistics
+const (
+	TCPFaultRefuse    = "refused"
+	TCPFaultLatency   = "latency"
+	TCPFaultBandwidth = "bandwidth"
+	TCPFaultHalfOpen  = "half_open"
+	TCPFaultReset     = "reset"
+)
+
+// TCPConfig controls connection-level faults in tcp mode. The request
+// level settings such as delay_probability do not apply to raw TCP.
+type TCPConfig struct {
+	// RefuseProbability closes new connections with a reset before the
+	// backend is dialed
+	RefuseProbability float64 `json:"refuse_probability,omitempty"`
+
+	// LatencyProbability holds a chunk of data, in either direction, for a
+	// random duration between LatencyMin and LatencyMax
+	LatencyProbability float64  `json:"latency_probability,omitempty"`
+	LatencyMin         Duration `json:"latency_min,omitempty"`
+	LatencyMax         Duration `json:"latency_max,omitempty"`
+
+	// BandwidthBytesPerSec limits each direction of every connection
+	BandwidthBytesPerSec int64 `json:"bandwidth_bytes_per_sec,omitempty"`
+
+	// HalfOpenProbability silently drops the backend after HalfOpenAfter:
+	// the client connection stays open but nothing is forwarded anymore
+	HalfOpenProbability float64  `json:"half_open_probability,omitempty"`
+	HalfOpenAfter       Duration `json:"half_open_after,omitempty"`
+
+	// ResetProbability resets both connections after a random duration
+	// between ResetAfterMin and ResetAfterMax
+	ResetProbability float64  `json:"reset_probability,omitempty"`
+	ResetAfterMin    Duration `json:"reset_after_min,omitempty"`
+	ResetAfterMax    Duration `json:"reset_after_max,omitempty"`
+}
+
+func (c TCPConfig) validate() error {
+	var errs []error
+	probabilities := []struct {
+		name  string
+		value float64
+	}{
+		{"refuse_probability", c.RefuseProbability},
+		{"latency_probability", c.LatencyProbability},
+		{"half_open_probability", c.HalfOpenProbability},
+		{"reset_probability", c.ResetProbability},
+	}
+	for _, p := range probabilities {
+		if p.value < 0 || p.value > 1 {
+			errs = append(errs, fmt.Errorf("tcp.%s must be between 0 and 1, got %v", p.name, p.value))
+		}
+	}
+	if c.LatencyMin.Duration > c.LatencyMax.Duration {
+		errs = append(errs, errors.New("tcp.latency_min must not exceed latency_max"))
+	}
+	if c.LatencyProbability > 0 && c.LatencyMax.Duration <= 0 {
+		errs = append(errs, errors.New("tcp.latency_max is required when latency_probability is set"))
+	}
+	if c.BandwidthBytesPerSec < 0 {
+		errs = append(errs, errors.New("tcp.bandwidth_bytes_per_sec must not be negative"))
+	}
+	if c.HalfOpenAfter.Duration < 0 {
+		errs = append(errs, errors.New("tcp.half_open_after must not be negative"))
+	}
+	if c.ResetAfterMin.Duration > c.ResetAfterMax.Duration {
+		errs = append(errs, errors.New("tcp.reset_after_min must not exceed reset_after_max"))
+	}
+	return errors.Join(errs...)
+}
+
+// TCPConnection is a client connection accepted in tcp mode, with the
+// backend it is forwarded to and the faults decided for it
+type TCPConnection struct {
+	ID      string
+	Backend string
+
+	// Refuse means the connection must be reset without dialing Backend
+	Refuse bool
+	// Bandwidth limits each direction in bytes per second; 0 is unlimited
+	Bandwidth int64
+	// HalfOpen drops the backend after HalfOpenAfter
+	HalfOpen      bool
+	HalfOpenAfter time.Duration
+	// Reset resets both connections after ResetAfter
+	Reset      bool
+	ResetAfter time.Duration
+
+	cm       *ChaosMiddleware
+	b        *backend
+	config   TCPConfig
+	targeted bool
+	remote   string
+	start    time.Time
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+// AcceptTCP picks the backend of a new TCP connection and decides its
+// faults. In dry run, or when the client is not targeted, no fault is set.
+func (cm *ChaosMiddleware) AcceptTCP(remoteAddr string) *TCPConnection {
+	config := cm.Config()
+	b := cm.pool.pick()
+	b.active.Add(1)
+
+	c := &TCPConnection{
+		ID:      newRequestID(),
+		Backend: b.url.Host,
+		cm:      cm,
+		b:       b,
+		config:  config.TCP,
+		remote:  remoteAddr,
+		start:   time.Now(),
+	}
+	cm.stats.recordTCPConnection()
+
+	// Only the ip targeting key exists for raw connections
+	r := &http.Request{RemoteAddr: remoteAddr, Header: http.Header{}, URL: &url.URL{}}
+	if !cm.shouldApplyChaos(config, r) {
+		return c
+	}
+
+	tcp := config.TCP
+	var faults []string
+	if rand.Float64() < tcp.RefuseProbability {
+		c.Refuse = true
+		faults = append(faults, TCPFaultRefuse)
+	} else {
+		if tcp.BandwidthBytesPerSec > 0 {
+			c.Bandwidth = tcp.BandwidthBytesPerSec
+			faults = append(faults, TCPFaultBandwidth)
+		}
+		if rand.Float64() < tcp.HalfOpenProbability {
+			c.HalfOpen = true
+			c.HalfOpenAfter = tcp.HalfOpenAfter.Duration
+		}
+		if rand.Float64() < tcp.ResetProbability {
+			c.Reset = true
+			c.ResetAfter = pickBetween(tcp.ResetAfterMin.Duration, tcp.ResetAfterMax.Duration)
+		}
+	}
+
+	if config.DryRun {
+		if len(faults) > 0 || c.HalfOpen || c.Reset || tcp.LatencyProbability > 0 {
+			slog.Info("dry run, would inject TCP fault", "connection_id", c.ID, "remote_addr", remoteAddr,
+				"refuse", c.Refuse, "bandwidth", c.Bandwidth, "half_open", c.HalfOpen, "reset", c.Reset,
+				"reset_after", c.ResetAfter)
+		}
+		c.Refuse, c.Bandwidth, c.HalfOpen, c.Reset = false, 0, false, false
+		return c
+	}
+
+	c.targeted = true
+	for _, fault := range faults {
+		c.Inject(fault)
+	}
+	return c
+}
+
+// ChunkDelay returns how long to hold the next chunk of data
+func (c *TCPConnection) ChunkDelay() time.Duration {
+	if !c.targeted || rand.Float64() >= c.config.LatencyProbability {
+		return 0
+	}
+	c.cm.stats.recordTCPFault(TCPFaultLatency)
+	return pickBetween(c.config.LatencyMin.Duration, c.config.LatencyMax.Duration)
+}
+
+// Inject logs and counts a fault applied to the connection
+func (c *TCPConnection) Inject(fault string) {
+	slog.Info("injecting TCP fault", "fault", fault, "connection_id", c.ID, "rule", c.cm.name,
+		"remote_addr", c.remote, "backend", c.Backend, "age", time.Since(c.start).Round(time.Millisecond))
+	c.cm.stats.recordTCPFault(fault)
+}
+
+// Dialed reports the outcome of dialing the backend, for passive ejection
+func (c *TCPConnection) Dialed(err error) {
+	if err != nil {
+		slog.Warn("backend dial failed", "connection_id", c.ID, "backend", c.Backend, "error", err)
+	}
+	c.cm.pool.report(c.b, err == nil)
+}
+
+// Count adds bytes forwarded to the backend (sent) and to the client
+func (c *TCPConnection) Count(sent, received int) {
+	c.sent.Add(int64(sent))
+	c.received.Add(int64(received))
+}
+
+// Close logs the connection once both directions are done
+func (c *TCPConnection) Close() {
+	c.b.active.Add(-1)
+	slog.Info("connection", "connection_id", c.ID, "rule", c.cm.name, "remote_addr", c.remote,
+		"backend", c.Backend, "bytes_sent", c.sent.Load(), "bytes_received", c.received.Load(),
+		"duration", time.Since(c.start).Round(time.Millisecond))
+}
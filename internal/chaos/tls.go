@@ -0,0 +1,155 @@
+package chaos
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// TLS faults injected on the proxy listener's handshakes
+const (
+	TLSFaultHandshake = "handshake_failure"
+	TLSFaultExpired   = "expired_certificate"
+	TLSFaultWrongHost = "wrong_hostname"
+	TLSFaultDowngrade = "downgrade"
+)
+
+// TLSVersions maps the version names accepted in configuration to their
+// crypto/tls constants
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSFaultConfig sets the probability of each TLS fault per handshake on
+// the proxy listener. A handshake gets at most one fault, so the
+// probabilities add up to at most 1. It has no effect unless the listener
+// serves TLS.
+type TLSFaultConfig struct {
+	HandshakeFailureProbability float64 `json:"handshake_failure_probability,omitempty"`
+	ExpiredCertProbability      float64 `json:"expired_cert_probability,omitempty"`
+	WrongHostnameProbability    float64 `json:"wrong_hostname_probability,omitempty"`
+	DowngradeProbability        float64 `json:"downgrade_probability,omitempty"`
+
+	// DowngradeVersion is the only protocol version offered when a
+	// downgrade is injected: "1.0", "1.1" or "1.2" (the default)
+	DowngradeVersion string `json:"downgrade_version,omitempty"`
+}
+
+// Enabled reports whether any TLS fault can be injected
+func (t TLSFaultConfig) Enabled() bool {
+	return t.HandshakeFailureProbability > 0 || t.ExpiredCertProbability > 0 ||
+		t.WrongHostnameProbability > 0 || t.DowngradeProbability > 0
+}
+
+// DowngradeTo returns the protocol version used for injected downgrades
+func (t TLSFaultConfig) DowngradeTo() uint16 {
+	if v, ok := TLSVersions[t.DowngradeVersion]; ok {
+		return v
+	}
+	return tls.VersionTLS12
+}
+
+func (t TLSFaultConfig) validate() error {
+	var errs []error
+	probabilities := []struct {
+		name  string
+		value float64
+	}{
+		{"handshake_failure_probability", t.HandshakeFailureProbability},
+		{"expired_cert_probability", t.ExpiredCertProbability},
+		{"wrong_hostname_probability", t.WrongHostnameProbability},
+		{"downgrade_probability", t.DowngradeProbability},
+	}
+	var total float64
+	for _, p := range probabilities {
+		if p.value < 0 || p.value > 1 {
+			errs = append(errs, fmt.Errorf("tls_faults.%s must be between 0 and 1, got %v", p.name, p.value))
+		}
+		total += p.value
+	}
+	// A handshake gets at most one fault
+	if total > 1+probabilityTolerance {
+		errs = append(errs, fmt.Errorf("tls_faults probabilities add up to %v, more than 1", total))
+	}
+	if v, ok := TLSVersions[t.DowngradeVersion]; t.DowngradeVersion != "" && (!ok || v == tls.VersionTLS13) {
+		errs = append(errs, fmt.Errorf("tls_faults.downgrade_version must be 1.0, 1.1 or 1.2, got %q", t.DowngradeVersion))
+	}
+	return errors.Join(errs...)
+}
+
+// UpstreamTLSConfig controls how the proxy connects to HTTPS targets
+type UpstreamTLSConfig struct {
+	// CAFile is a PEM bundle trusted in addition to the system roots
+	CAFile string `json:"ca_file,omitempty"`
+
+	// CertFile and KeyFile present a client certificate to the target
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+
+	// ServerName overrides the SNI name sent and verified
+	ServerName string `json:"server_name,omitempty"`
+
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+}
+
+// enabled reports whether any option differs from the defaults
+func (u UpstreamTLSConfig) enabled() bool {
+	return u != UpstreamTLSConfig{}
+}
+
+// clientConfig builds the TLS client configuration for connections to targets
+func (u UpstreamTLSConfig) clientConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         u.ServerName,
+		InsecureSkipVerify: u.InsecureSkipVerify,
+	}
+
+	if u.CAFile != "" {
+		pem, err := os.ReadFile(u.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading upstream CA: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", u.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if u.CertFile != "" || u.KeyFile != "" {
+		if u.CertFile == "" || u.KeyFile == "" {
+			return nil, errors.New("upstream client certificate requires both cert_file and key_file")
+		}
+		cert, err := tls.LoadX509KeyPair(u.CertFile, u.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading upstream client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// transport returns the HTTP transport used to reach targets, or nil for
+// the default transport
+func (u UpstreamTLSConfig) transport() (http.RoundTripper, error) {
+	if !u.enabled() {
+		return nil, nil
+	}
+	config, err := u.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return transport, nil
+}
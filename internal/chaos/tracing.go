@@ -0,0 +1,58 @@
+package chaos
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/pgaijin66/phailure/internal/chaos")
+
+// startSpan continues the incoming trace context with a span covering the
+// proxied request, and rewrites the trace headers so the upstream service
+// sees the proxy span as its parent
+func startSpan(r *http.Request, rec *requestRecord) (*http.Request, trace.Span) {
+	propagator := otel.GetTextMapPropagator()
+
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "proxy "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("chaos.request_id", rec.ID),
+		),
+	)
+	propagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+
+	return r.WithContext(ctx), span
+}
+
+// addFaultEvent records an injected fault on the request span
+func addFaultEvent(r *http.Request, name string, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(r.Context()).AddEvent(name, trace.WithAttributes(attrs...))
+}
+
+// annotate copies the request outcome onto the span
+func (rec *requestRecord) annotate(span trace.Span) {
+	span.SetAttributes(
+		attribute.String("chaos.rule", rec.Rule),
+		attribute.Bool("chaos.targeted", rec.Targeted),
+		attribute.String("chaos.fault", rec.fault()),
+		attribute.Bool("chaos.dry_run", rec.DryRun),
+		attribute.Int("http.response.status_code", rec.Status),
+	)
+	if rec.UpstreamStatus != 0 {
+		span.SetAttributes(attribute.Int("chaos.upstream_status", rec.UpstreamStatus))
+	}
+	if rec.Backend != "" {
+		span.SetAttributes(attribute.String("chaos.backend", rec.Backend))
+	}
+	if rec.Status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(rec.Status))
+	}
+}
@@ -0,0 +1,187 @@
+package chaos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	spansOnce sync.Once
+	spans     *tracetest.InMemoryExporter
+)
+
+// recordSpans returns the in-memory exporter receiving the spans of the
+// test. The global tracer provider can only be installed once per process.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	spansOnce.Do(func() {
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+		spans = tracetest.NewInMemoryExporter()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)))
+	})
+	spans.Reset()
+	return spans
+}
+
+// onlySpan returns the single span recorded by the test
+func onlySpan(t *testing.T, exporter *tracetest.InMemoryExporter) tracetest.SpanStub {
+	t.Helper()
+	stubs := exporter.GetSpans()
+	if len(stubs) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(stubs))
+	}
+	return stubs[0]
+}
+
+func TestSpanContinuesIncomingTraceparent(t *testing.T) {
+	exporter := recordSpans(t)
+
+	var upstream string
+	cm := newTestProxy(t, quietConfig(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Get("traceparent")
+	}))
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-"+spanID+"-01")
+	cm.ServeHTTP(httptest.NewRecorder(), r)
+
+	span := onlySpan(t, exporter)
+	if got := span.SpanContext.TraceID().String(); got != traceID {
+		t.Errorf("trace ID = %s, want %s", got, traceID)
+	}
+	if got := span.Parent.SpanID().String(); got != spanID {
+		t.Errorf("parent span ID = %s, want %s", got, spanID)
+	}
+	if !span.Parent.IsRemote() {
+		t.Error("parent span is not marked remote")
+	}
+	if span.SpanKind != trace.SpanKindServer {
+		t.Errorf("span kind = %v, want server", span.SpanKind)
+	}
+
+	// The backend continues the trace from the proxy span
+	carrier := propagation.HeaderCarrier(http.Header{"Traceparent": {upstream}})
+	forwarded := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(t.Context(), carrier))
+	if forwarded.TraceID().String() != traceID || forwarded.SpanID() != span.SpanContext.SpanID() {
+		t.Errorf("backend got traceparent %q, want trace %s and span %s", upstream, traceID, span.SpanContext.SpanID())
+	}
+}
+
+func TestSpanStartsTraceWithoutTraceparent(t *testing.T) {
+	exporter := recordSpans(t)
+	cm := newTestProxy(t, quietConfig(), http.NotFoundHandler())
+
+	cm.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	span := onlySpan(t, exporter)
+	if span.Parent.IsValid() {
+		t.Errorf("span has parent %s, want a root span", span.Parent.SpanID())
+	}
+	if !span.SpanContext.TraceID().IsValid() {
+		t.Error("span has no trace ID")
+	}
+}
+
+func TestSpanRecordsFaultEvents(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*ChaosConfig)
+		event string
+		attr  attribute.KeyValue
+	}{
+		{
+			name: "error",
+			setup: func(c *ChaosConfig) {
+				c.ErrorProbability = 1
+				c.ErrorCodes = []int{http.StatusServiceUnavailable}
+			},
+			event: "chaos.error",
+			attr:  attribute.Int("chaos.error_code", http.StatusServiceUnavailable),
+		},
+		{
+			name: "delay",
+			setup: func(c *ChaosConfig) {
+				c.DelayProbability = 1
+				c.DelayMin = Duration{Duration: 5 * time.Millisecond}
+				c.DelayMax = Duration{Duration: 5 * time.Millisecond}
+			},
+			event: "chaos.delay",
+			attr:  attribute.Int64("chaos.delay_ms", 5),
+		},
+		{
+			name: "timeout",
+			setup: func(c *ChaosConfig) {
+				c.TimeoutProbability = 1
+				c.TimeoutDuration = Duration{Duration: 5 * time.Millisecond}
+			},
+			event: "chaos.timeout",
+			attr:  attribute.String("chaos.timeout", "5ms"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := recordSpans(t)
+			config := quietConfig()
+			tt.setup(config)
+			cm := newTestProxy(t, config, http.NotFoundHandler())
+
+			cm.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			span := onlySpan(t, exporter)
+			var found bool
+			for _, event := range span.Events {
+				if event.Name != tt.event {
+					continue
+				}
+				found = true
+				if !hasAttribute(event.Attributes, tt.attr) {
+					t.Errorf("event %s has attributes %v, want %v", tt.event, event.Attributes, tt.attr)
+				}
+			}
+			if !found {
+				t.Errorf("span events %v, want %s", span.Events, tt.event)
+			}
+			if !hasAttribute(span.Attributes, attribute.Bool("chaos.targeted", true)) {
+				t.Errorf("span attributes %v, want chaos.targeted=true", span.Attributes)
+			}
+		})
+	}
+}
+
+func TestSpanWithoutFaultHasNoEvents(t *testing.T) {
+	exporter := recordSpans(t)
+	cm := newTestProxy(t, quietConfig(), http.NotFoundHandler())
+
+	cm.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	span := onlySpan(t, exporter)
+	if len(span.Events) != 0 {
+		t.Errorf("span events %v, want none", span.Events)
+	}
+	if !hasAttribute(span.Attributes, attribute.String("chaos.fault", "none")) {
+		t.Errorf("span attributes %v, want chaos.fault=none", span.Attributes)
+	}
+}
+
+func hasAttribute(attrs []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, attr := range attrs {
+		if attr.Key == want.Key && attr.Value == want.Value {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,8 @@ package chaos
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -34,3 +36,54 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 func (d Duration) MarshalJSON() ([]byte, error) {
 	return json.Marshal(d.Duration.String())
 }
+
+// faultDecision records which faults were chosen for a single request
+type faultDecision struct {
+	Timeout   time.Duration
+	Delay     time.Duration
+	ErrorCode int
+
+	// GRPCStatus replaces ErrorCode on gRPC requests
+	GRPCStatus int
+}
+
+func (d faultDecision) empty() bool {
+	return d.Timeout == 0 && d.Delay == 0 && !d.failed()
+}
+
+// failed reports whether the decision injects an HTTP or gRPC error
+func (d faultDecision) failed() bool {
+	return d.ErrorCode != 0 || d.GRPCStatus != 0
+}
+
+// kinds lists the fault types in the decision, e.g. ["delay", "error"]
+func (d faultDecision) kinds() []string {
+	var kinds []string
+	if d.Timeout > 0 {
+		kinds = append(kinds, "timeout")
+	}
+	if d.Delay > 0 {
+		kinds = append(kinds, "delay")
+	}
+	if d.failed() {
+		kinds = append(kinds, "error")
+	}
+	return kinds
+}
+
+// String renders the decision as a compact list, e.g. "delay=350ms, error=503"
+func (d faultDecision) String() string {
+	var parts []string
+	if d.Timeout > 0 {
+		parts = append(parts, fmt.Sprintf("timeout=%v", d.Timeout))
+	}
+	if d.Delay > 0 {
+		parts = append(parts, fmt.Sprintf("delay=%v", d.Delay))
+	}
+	if d.GRPCStatus != 0 {
+		parts = append(parts, "error="+grpcStatusName(d.GRPCStatus))
+	} else if d.ErrorCode != 0 {
+		parts = append(parts, fmt.Sprintf("error=%d", d.ErrorCode))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,185 @@
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// UDP faults, as counted in statistics
+const (
+	UDPFaultLoss      = "lost"
+	UDPFaultDuplicate = "duplicated"
+	UDPFaultReorder   = "reordered"
+	UDPFaultJitter    = "delayed"
+	UDPFaultCorrupt   = "corrupted"
+)
+
+// UDPConfig controls packet faults in udp mode. Every probability applies
+// to each datagram, in both directions.
+type UDPConfig struct {
+	LossProbability      float64 `json:"loss_probability,omitempty"`
+	DuplicateProbability float64 `json:"duplicate_probability,omitempty"`
+
+	// ReorderProbability holds a datagram back until the next one in the
+	// same direction has been sent, or ReorderWindow (default 100ms) passed
+	ReorderProbability float64  `json:"reorder_probability,omitempty"`
+	ReorderWindow      Duration `json:"reorder_window,omitempty"`
+
+	// JitterProbability delays a datagram by a random duration between
+	// JitterMin and JitterMax
+	JitterProbability float64  `json:"jitter_probability,omitempty"`
+	JitterMin         Duration `json:"jitter_min,omitempty"`
+	JitterMax         Duration `json:"jitter_max,omitempty"`
+
+	// CorruptProbability flips a random bit of the payload
+	CorruptProbability float64 `json:"corrupt_probability,omitempty"`
+}
+
+func (c UDPConfig) validate() error {
+	var errs []error
+	probabilities := []struct {
+		name  string
+		value float64
+	}{
+		{"loss_probability", c.LossProbability},
+		{"duplicate_probability", c.DuplicateProbability},
+		{"reorder_probability", c.ReorderProbability},
+		{"jitter_probability", c.JitterProbability},
+		{"corrupt_probability", c.CorruptProbability},
+	}
+	for _, p := range probabilities {
+		if p.value < 0 || p.value > 1 {
+			errs = append(errs, fmt.Errorf("udp.%s must be between 0 and 1, got %v", p.name, p.value))
+		}
+	}
+	if c.ReorderWindow.Duration < 0 {
+		errs = append(errs, errors.New("udp.reorder_window must not be negative"))
+	}
+	if c.JitterMin.Duration > c.JitterMax.Duration {
+		errs = append(errs, errors.New("udp.jitter_min must not exceed jitter_max"))
+	}
+	if c.JitterProbability > 0 && c.JitterMax.Duration <= 0 {
+		errs = append(errs, errors.New("udp.jitter_max is required when jitter_probability is set"))
+	}
+	return errors.Join(errs...)
+}
+
+// UDPPacketFault is what happens to one datagram
+type UDPPacketFault struct {
+	Drop      bool
+	Duplicate bool
+	Reorder   bool
+	Corrupt   bool
+	Delay     time.Duration
+	// ReorderWindow bounds how long a reordered datagram is held
+	ReorderWindow time.Duration
+}
+
+// UDPFlow is the traffic between one client address and its backend in
+// udp mode
+type UDPFlow struct {
+	ID      string
+	Backend string
+
+	cm       *ChaosMiddleware
+	b        *backend
+	targeted bool
+	remote   string
+	start    time.Time
+	packets  atomic.Int64
+}
+
+// AcceptUDP picks the backend for datagrams from a new client address
+func (cm *ChaosMiddleware) AcceptUDP(remoteAddr string) *UDPFlow {
+	config := cm.Config()
+	b := cm.pool.pick()
+	b.active.Add(1)
+	cm.stats.recordUDPFlow()
+
+	// Only the ip targeting key exists for datagrams
+	r := &http.Request{RemoteAddr: remoteAddr, Header: http.Header{}, URL: &url.URL{}}
+	return &UDPFlow{
+		ID:       newRequestID(),
+		Backend:  b.url.Host,
+		cm:       cm,
+		b:        b,
+		targeted: cm.shouldApplyChaos(config, r),
+		remote:   remoteAddr,
+		start:    time.Now(),
+	}
+}
+
+// PacketFault decides the fault for the next datagram of the flow. The
+// configuration is read for every datagram, so changes apply at once.
+func (f *UDPFlow) PacketFault() UDPPacketFault {
+	f.packets.Add(1)
+	config := f.cm.Config()
+	if !f.targeted {
+		return UDPPacketFault{}
+	}
+
+	udp := config.UDP
+	var fault UDPPacketFault
+	var kinds []string
+	if rand.Float64() < udp.LossProbability {
+		fault.Drop = true
+		kinds = append(kinds, UDPFaultLoss)
+	} else {
+		if rand.Float64() < udp.DuplicateProbability {
+			fault.Duplicate = true
+			kinds = append(kinds, UDPFaultDuplicate)
+		}
+		if rand.Float64() < udp.ReorderProbability {
+			fault.Reorder = true
+			fault.ReorderWindow = udp.ReorderWindow.Duration
+			if fault.ReorderWindow == 0 {
+				fault.ReorderWindow = 100 * time.Millisecond
+			}
+			kinds = append(kinds, UDPFaultReorder)
+		}
+		if rand.Float64() < udp.JitterProbability {
+			fault.Delay = pickBetween(udp.JitterMin.Duration, udp.JitterMax.Duration)
+			kinds = append(kinds, UDPFaultJitter)
+		}
+		if rand.Float64() < udp.CorruptProbability {
+			fault.Corrupt = true
+			kinds = append(kinds, UDPFaultCorrupt)
+		}
+	}
+	if len(kinds) == 0 {
+		return fault
+	}
+
+	// Datagrams are too frequent to log each one above debug level
+	if config.DryRun {
+		slog.Debug("dry run, would inject UDP fault", "faults", kinds, "flow_id", f.ID)
+		return UDPPacketFault{}
+	}
+	slog.Debug("injecting UDP fault", "faults", kinds, "flow_id", f.ID, "delay", fault.Delay)
+	for _, kind := range kinds {
+		f.cm.stats.recordUDPFault(kind)
+	}
+	return fault
+}
+
+// Dialed reports the outcome of opening the backend socket
+func (f *UDPFlow) Dialed(err error) {
+	if err != nil {
+		slog.Warn("backend dial failed", "flow_id", f.ID, "backend", f.Backend, "error", err)
+	}
+	f.cm.pool.report(f.b, err == nil)
+}
+
+// Close logs the flow once it expired
+func (f *UDPFlow) Close() {
+	f.b.active.Add(-1)
+	slog.Info("udp flow", "flow_id", f.ID, "rule", f.cm.name, "remote_addr", f.remote,
+		"backend", f.Backend, "packets", f.packets.Load(),
+		"duration", time.Since(f.start).Round(time.Millisecond))
+}
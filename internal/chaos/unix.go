@@ -0,0 +1,56 @@
+package chaos
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// unixScheme marks targets reached over a Unix domain socket, written
+// unix:///path/to.sock
+const unixScheme = "unix"
+
+// dialURL returns the URL requests for target are rewritten to. The socket
+// path of a unix:// target moves, escaped, into the host: the request path
+// stays the client's and the transport knows which socket to dial.
+func dialURL(target *url.URL) *url.URL {
+	if target.Scheme != unixScheme {
+		return target
+	}
+	return &url.URL{Scheme: unixScheme, Host: url.PathEscape(target.Path)}
+}
+
+// unixTransport sends requests rewritten by dialURL over their socket
+type unixTransport struct {
+	http *http.Transport
+}
+
+func newUnixTransport() *unixTransport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		path, err := url.PathUnescape(host)
+		if err != nil {
+			return nil, err
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+	return &unixTransport{http: transport}
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *unixTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.URL.Scheme = "http"
+	if out.Host == "" {
+		// The escaped socket path is no use to the backend as a Host header
+		out.Host = "localhost"
+	}
+	return t.http.RoundTrip(out)
+}
@@ -0,0 +1,107 @@
+package chaos
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const maxConfigVersions = 100
+
+var (
+	// ErrVersionConflict is returned when an If-Match precondition does not
+	// match the configuration currently in effect
+	ErrVersionConflict = errors.New("configuration was changed by someone else")
+
+	// ErrUnknownVersion is returned when rolling back to a version that is
+	// not (or no longer) stored
+	ErrUnknownVersion = errors.New("unknown configuration version")
+)
+
+// ConfigVersion is a configuration that has been applied at some point
+type ConfigVersion struct {
+	Version   int          `json:"version"`
+	ETag      string       `json:"etag"`
+	AppliedAt time.Time    `json:"applied_at"`
+	Source    string       `json:"source"`
+	Actor     string       `json:"actor,omitempty"`
+	Config    *ChaosConfig `json:"config"`
+}
+
+// versionStore keeps the most recent configuration versions. Callers hold
+// the middleware lock.
+type versionStore struct {
+	versions []ConfigVersion
+	latest   int
+}
+
+func (vs *versionStore) add(config *ChaosConfig, change ConfigChange) ConfigVersion {
+	vs.latest++
+	v := ConfigVersion{
+		Version:   vs.latest,
+		ETag:      configETag(vs.latest, config),
+		AppliedAt: time.Now(),
+		Source:    change.Source,
+		Actor:     change.Actor,
+		Config:    config,
+	}
+
+	vs.versions = append(vs.versions, v)
+	if len(vs.versions) > maxConfigVersions {
+		vs.versions = append([]ConfigVersion(nil), vs.versions[len(vs.versions)-maxConfigVersions:]...)
+	}
+	return v
+}
+
+func (vs *versionStore) current() ConfigVersion {
+	return vs.versions[len(vs.versions)-1]
+}
+
+func (vs *versionStore) get(version int) (ConfigVersion, bool) {
+	for _, v := range vs.versions {
+		if v.Version == version {
+			return v, true
+		}
+	}
+	return ConfigVersion{}, false
+}
+
+// sinceLoad returns the versions applied after the configuration was last
+// loaded at startup or from a file, which a reload overrides
+func (vs *versionStore) sinceLoad() []int {
+	var versions []int
+	for i := len(vs.versions) - 1; i >= 0; i-- {
+		v := vs.versions[i]
+		if v.Source == ConfigSourceStartup || v.Source == ConfigSourceFile {
+			break
+		}
+		versions = append([]int{v.Version}, versions...)
+	}
+	return versions
+}
+
+func (vs *versionStore) list() []ConfigVersion {
+	return append([]ConfigVersion(nil), vs.versions...)
+}
+
+// configETag derives a strong entity tag from the version number and content
+func configETag(version int, config *ChaosConfig) string {
+	data, _ := json.Marshal(config)
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf(`"%d-%s"`, version, hex.EncodeToString(sum[:4]))
+}
+
+// etagMatches implements If-Match comparison, including "*" and lists
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
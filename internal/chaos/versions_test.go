@@ -0,0 +1,82 @@
+package chaos
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		ifMatch func(versions []ConfigVersion) string
+		delay   float64
+		err     error
+	}{
+		{"startup", 1, nil, 0, nil},
+		{"intermediate", 2, nil, 0.1, nil},
+		{"current", 3, nil, 0.2, nil},
+		{"unknown", 99, nil, 0.2, ErrUnknownVersion},
+		{"matching If-Match", 1, func(v []ConfigVersion) string { return v[2].ETag }, 0, nil},
+		{"stale If-Match", 1, func(v []ConfigVersion) string { return v[1].ETag }, 0.2, ErrVersionConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := newTestProxy(t, quietConfig(), http.NotFoundHandler())
+			versions := []ConfigVersion{cm.ConfigVersion()}
+			for _, delay := range []float64{0.1, 0.2} {
+				config := cm.Config().Clone()
+				config.DelayProbability = delay
+				v, _, err := cm.UpdateConfig(config, ConfigChange{Source: ConfigSourceAPI})
+				if err != nil {
+					t.Fatal(err)
+				}
+				versions = append(versions, v)
+			}
+
+			change := ConfigChange{}
+			if tt.ifMatch != nil {
+				change.IfMatch = tt.ifMatch(versions)
+			}
+			v, _, err := cm.Rollback(tt.version, change)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if got := cm.Config().DelayProbability; got != tt.delay {
+				t.Errorf("delay_probability = %v, want %v", got, tt.delay)
+			}
+			if tt.err != nil {
+				if current := cm.ConfigVersion(); current.Version != 3 {
+					t.Errorf("failed rollback left version %d, want 3", current.Version)
+				}
+				return
+			}
+			// A rollback is a new version with the old content
+			if v.Version != 4 || v.Source != ConfigSourceRollback || v.ETag == versions[tt.version-1].ETag {
+				t.Errorf("rollback applied as version %d from %q with ETag %s", v.Version, v.Source, v.ETag)
+			}
+		})
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `"3-abcd"`
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`"3-abcd"`, true},
+		{`W/"3-abcd"`, true},
+		{`*`, true},
+		{`"2-ffff", "3-abcd"`, true},
+		{`"2-ffff"`, false},
+		{`"3-abcd`, false},
+		{`3-abcd`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatches(%s) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
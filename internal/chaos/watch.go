@@ -0,0 +1,145 @@
+package chaos
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigLoader builds a complete configuration, e.g. from flags and a file
+type ConfigLoader func() (*ChaosConfig, error)
+
+// Reloader swaps in configuration built by a ConfigLoader; it is implemented
+// by ChaosMiddleware and Router
+type Reloader interface {
+	Reload(load ConfigLoader, change ConfigChange) error
+}
+
+// Reload loads and validates a new configuration and swaps it in. If the
+// new configuration is invalid the running one is kept and the error is
+// returned. Reloading an unchanged configuration is a no-op. Changes made
+// since the last load, through the API or a rollback, are overridden and
+// their versions logged.
+func (cm *ChaosMiddleware) Reload(load ConfigLoader, change ConfigChange) error {
+	newConfig, err := load()
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+	if err := newConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if len(diffConfigs(cm.Config(), newConfig)) == 0 {
+		slog.Debug("configuration unchanged, nothing to reload", "source", change.Source)
+		return nil
+	}
+
+	cm.mu.RLock()
+	discarded := cm.versions.sinceLoad()
+	cm.mu.RUnlock()
+	if len(discarded) > 0 {
+		slog.Warn("reload overrides configuration changes made since the last load", "route", cm.name,
+			"discarded_versions", discarded, "source", change.Source, "actor", change.Actor)
+	}
+
+	_, _, err = cm.UpdateConfig(newConfig, change)
+	return err
+}
+
+// ConfigFiles tracks the content of the files a configuration is loaded
+// from, so that it is only reloaded when one of them changed. Reloading
+// otherwise would silently undo changes made through the API.
+type ConfigFiles struct {
+	mu    sync.Mutex
+	paths []string
+	last  [sha256.Size]byte
+}
+
+// NewConfigFiles records the current content of paths, skipping empty ones
+func NewConfigFiles(paths ...string) *ConfigFiles {
+	f := &ConfigFiles{}
+	for _, path := range paths {
+		if path != "" {
+			f.paths = append(f.paths, path)
+		}
+	}
+	f.last, _ = f.digest()
+	return f
+}
+
+// Paths returns the tracked files
+func (f *ConfigFiles) Paths() []string {
+	return f.paths
+}
+
+// Changed reports whether any file changed since the last call, or since
+// NewConfigFiles, and remembers the new content. A file that is removed
+// counts as a change.
+func (f *ConfigFiles) Changed() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	digest, err := f.digest()
+	if err != nil {
+		return false, err
+	}
+	if digest == f.last {
+		return false, nil
+	}
+	f.last = digest
+	return true, nil
+}
+
+func (f *ConfigFiles) digest() ([sha256.Size]byte, error) {
+	h := sha256.New()
+	for _, path := range f.paths {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return [sha256.Size]byte{}, err
+		}
+		sum := sha256.Sum256(data)
+		h.Write([]byte(path))
+		h.Write(sum[:])
+	}
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+	return digest, nil
+}
+
+// WatchConfigFiles polls files every interval and reloads the configuration
+// of target through load whenever their content changes. Polling rather
+// than file system notifications also catches atomic symlink swaps such as
+// Kubernetes ConfigMap updates. It returns when ctx is cancelled.
+func WatchConfigFiles(ctx context.Context, target Reloader, files *ConfigFiles, interval time.Duration, load ConfigLoader) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := files.Changed()
+		if err != nil {
+			slog.Warn("cannot read watched config file", "files", files.Paths(), "error", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		slog.Info("config file changed, reloading", "files", files.Paths())
+		change := ConfigChange{Source: ConfigSourceFile, Actor: strings.Join(files.Paths(), ",")}
+		if err := target.Reload(load, change); err != nil {
+			slog.Error("config reload failed, keeping current configuration", "files", files.Paths(), "error", err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package chaos
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fileLoader returns a loader building a quiet configuration whose error
+// probability is read from path
+func fileLoader(path string) ConfigLoader {
+	return func() (*ChaosConfig, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		p, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+		if err != nil {
+			return nil, err
+		}
+		config := quietConfig()
+		config.ErrorProbability = p
+		return config, nil
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigFilesChanged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	writeFile(t, path, "0.1")
+
+	files := NewConfigFiles("", path, filepath.Join(dir, "missing.yaml"))
+	if got := files.Paths(); len(got) != 2 {
+		t.Fatalf("Paths() = %v, want the two non-empty paths", got)
+	}
+
+	steps := []struct {
+		content string
+		changed bool
+	}{
+		{"0.1", false},
+		{"0.2", true},
+		{"0.2", false},
+		{"0.1", true},
+	}
+	for _, step := range steps {
+		writeFile(t, path, step.content)
+		changed, err := files.Changed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != step.changed {
+			t.Errorf("content %q: Changed() = %v, want %v", step.content, changed, step.changed)
+		}
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := files.Changed(); err != nil || !changed {
+		t.Errorf("removed file: Changed() = %v, %v, want true", changed, err)
+	}
+}
+
+func TestVersionsSinceLoad(t *testing.T) {
+	var vs versionStore
+	vs.add(quietConfig(), ConfigChange{Source: ConfigSourceStartup})
+	if got := vs.sinceLoad(); len(got) != 0 {
+		t.Errorf("sinceLoad() after startup = %v, want none", got)
+	}
+
+	vs.add(quietConfig(), ConfigChange{Source: ConfigSourceAPI})
+	vs.add(quietConfig(), ConfigChange{Source: ConfigSourceRollback})
+	if got, want := vs.sinceLoad(), []int{2, 3}; !slices.Equal(got, want) {
+		t.Errorf("sinceLoad() = %v, want %v", got, want)
+	}
+
+	vs.add(quietConfig(), ConfigChange{Source: ConfigSourceFile})
+	vs.add(quietConfig(), ConfigChange{Source: ConfigSourceProfile})
+	if got, want := vs.sinceLoad(), []int{5}; !slices.Equal(got, want) {
+		t.Errorf("sinceLoad() after a file reload = %v, want %v", got, want)
+	}
+}
+
+func TestWatchKeepsAPIChangesUntilFileChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, "0")
+	load := fileLoader(path)
+
+	config, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := newTestProxy(t, config, http.NotFoundHandler())
+	files := NewConfigFiles(path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go WatchConfigFiles(ctx, cm, files, 5*time.Millisecond, load)
+
+	apiConfig := quietConfig()
+	apiConfig.ErrorProbability = 0.5
+	if _, _, err := cm.UpdateConfig(apiConfig, ConfigChange{Source: ConfigSourceAPI}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Several polls with the file untouched must keep the API change
+	time.Sleep(50 * time.Millisecond)
+	if got := cm.Config().ErrorProbability; got != 0.5 {
+		t.Fatalf("error probability = %v after polling an unchanged file, want the API value 0.5", got)
+	}
+
+	writeFile(t, path, "0.2")
+	deadline := time.Now().Add(2 * time.Second)
+	for cm.Config().ErrorProbability != 0.2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("error probability = %v, want 0.2 from the changed file", cm.Config().ErrorProbability)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
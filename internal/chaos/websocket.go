@@ -0,0 +1,439 @@
+package chaos
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WebSocket faults, as counted in statistics
+const (
+	WebSocketFaultReject = "rejected"
+	WebSocketFaultDelay  = "frame_delayed"
+	WebSocketFaultDrop   = "frame_dropped"
+	WebSocketFaultClose  = "closed"
+)
+
+// WebSocket opcodes and the close code used when none is configured
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+
+	defaultWSCloseCode = 1011
+)
+
+// wsCloseGrace is how long the client gets to answer an injected close
+// before the connection is torn down
+const wsCloseGrace = 2 * time.Second
+
+// errInjectedClose ends the backend to client copy after an injected close
+var errInjectedClose = errors.New("chaos: injected WebSocket close")
+
+// WebSocketConfig controls faults on WebSocket connections. The upgrade
+// request also gets the usual delays, errors and timeouts.
+type WebSocketConfig struct {
+	// RejectProbability answers the upgrade with RejectStatus (default 503)
+	RejectProbability float64 `json:"reject_probability,omitempty"`
+	RejectStatus      int     `json:"reject_status,omitempty"`
+
+	// FrameDelayProbability holds a data frame, in either direction, for
+	// a random duration between FrameDelayMin and FrameDelayMax
+	FrameDelayProbability float64  `json:"frame_delay_probability,omitempty"`
+	FrameDelayMin         Duration `json:"frame_delay_min,omitempty"`
+	FrameDelayMax         Duration `json:"frame_delay_max,omitempty"`
+
+	// FrameDropProbability discards a single-frame message in either
+	// direction. Fragmented messages and control frames are never dropped.
+	FrameDropProbability float64 `json:"frame_drop_probability,omitempty"`
+
+	// CloseProbability closes the connection with CloseCode (default
+	// 1011) once CloseAfterMessages messages went through, or after a
+	// random duration between CloseAfterMin and CloseAfterMax, whichever
+	// comes first
+	CloseProbability   float64  `json:"close_probability,omitempty"`
+	CloseCode          int      `json:"close_code,omitempty"`
+	CloseAfterMessages int      `json:"close_after_messages,omitempty"`
+	CloseAfterMin      Duration `json:"close_after_min,omitempty"`
+	CloseAfterMax      Duration `json:"close_after_max,omitempty"`
+}
+
+func (c WebSocketConfig) validate() error {
+	var errs []error
+	probabilities := []struct {
+		name  string
+		value float64
+	}{
+		{"reject_probability", c.RejectProbability},
+		{"frame_delay_probability", c.FrameDelayProbability},
+		{"frame_drop_probability", c.FrameDropProbability},
+		{"close_probability", c.CloseProbability},
+	}
+	for _, p := range probabilities {
+		if p.value < 0 || p.value > 1 {
+			errs = append(errs, fmt.Errorf("websocket.%s must be between 0 and 1, got %v", p.name, p.value))
+		}
+	}
+	if c.RejectStatus != 0 && (c.RejectStatus < 400 || c.RejectStatus > 599) {
+		errs = append(errs, fmt.Errorf("websocket.reject_status must be a 4xx or 5xx status, got %d", c.RejectStatus))
+	}
+	if c.FrameDelayMin.Duration > c.FrameDelayMax.Duration {
+		errs = append(errs, errors.New("websocket.frame_delay_min must not exceed frame_delay_max"))
+	}
+	if c.FrameDelayProbability > 0 && c.FrameDelayMax.Duration <= 0 {
+		errs = append(errs, errors.New("websocket.frame_delay_max is required when frame_delay_probability is set"))
+	}
+	// 1005, 1006 and 1015 are reserved for reporting and never sent
+	if code := c.CloseCode; code != 0 && (code < 1000 || code > 4999 || code == 1005 || code == 1006 || code == 1015) {
+		errs = append(errs, fmt.Errorf("websocket.close_code %d cannot be sent in a close frame", code))
+	}
+	if c.CloseAfterMessages < 0 {
+		errs = append(errs, errors.New("websocket.close_after_messages must not be negative"))
+	}
+	if c.CloseAfterMin.Duration > c.CloseAfterMax.Duration {
+		errs = append(errs, errors.New("websocket.close_after_min must not exceed close_after_max"))
+	}
+	if c.CloseProbability > 0 && c.CloseAfterMessages == 0 && c.CloseAfterMax.Duration <= 0 {
+		errs = append(errs, errors.New("websocket.close_probability needs close_after_messages or close_after_max"))
+	}
+	return errors.Join(errs...)
+}
+
+// isWebSocket reports whether the request asks for a WebSocket upgrade
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// webSocketPlan holds the stream faults chosen for one connection
+type webSocketPlan struct {
+	config     WebSocketConfig
+	closeAfter time.Duration
+	closeAt    int
+}
+
+// planWebSocket decides the faults of a WebSocket upgrade. It returns the
+// status rejecting the upgrade, or 0, and the plan for the stream, or nil
+// when the stream is left alone. The rejection is only counted by the
+// caller, when no other fault takes precedence.
+func (cm *ChaosMiddleware) planWebSocket(config *ChaosConfig, rec *requestRecord) (*webSocketPlan, int) {
+	ws := config.WebSocket
+	if mathrand.Float64() < ws.RejectProbability {
+		status := ws.RejectStatus
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		return nil, status
+	}
+
+	plan := &webSocketPlan{config: ws}
+	if mathrand.Float64() < ws.CloseProbability {
+		plan.closeAt = ws.CloseAfterMessages
+		if ws.CloseAfterMax.Duration > 0 {
+			plan.closeAfter = pickBetween(ws.CloseAfterMin.Duration, ws.CloseAfterMax.Duration)
+		}
+	}
+	if plan.closeAt == 0 && plan.closeAfter == 0 && ws.FrameDelayProbability == 0 && ws.FrameDropProbability == 0 {
+		return nil, 0
+	}
+
+	if config.DryRun {
+		if plan.closeAt > 0 || plan.closeAfter > 0 {
+			slog.Info("dry run, would close WebSocket", "request_id", rec.ID,
+				"after_messages", plan.closeAt, "after", plan.closeAfter)
+		}
+		return nil, 0
+	}
+	return plan, 0
+}
+
+func pickBetween(lo, hi time.Duration) time.Duration {
+	if hi <= lo {
+		return lo
+	}
+	return lo + time.Duration(mathrand.Int63n(int64(hi-lo)))
+}
+
+// webSocketStream wraps the backend connection of an upgraded request.
+// The reverse proxy copies what it reads to the client and what the client
+// sends into Write, so both directions pass through the frame filters.
+type webSocketStream struct {
+	backend   io.ReadWriteCloser
+	plan      *webSocketPlan
+	stats     *statsCollector
+	requestID string
+
+	// Backend to client, through a pipe fed by pump
+	rmu         sync.Mutex
+	fromBackend wsFilter
+	pr          *io.PipeReader
+	pw          *io.PipeWriter
+	clientClose bool
+
+	// Client to backend
+	wmu          sync.Mutex
+	fromClient   wsFilter
+	backendClose bool
+
+	messages  atomic.Int64
+	closing   atomic.Bool
+	closeOnce sync.Once
+	timer     *time.Timer
+}
+
+func newWebSocketStream(backend io.ReadWriteCloser, plan *webSocketPlan, stats *statsCollector, requestID string) *webSocketStream {
+	s := &webSocketStream{backend: backend, plan: plan, stats: stats, requestID: requestID}
+	s.pr, s.pw = io.Pipe()
+	if plan.closeAfter > 0 {
+		s.timer = time.AfterFunc(plan.closeAfter, s.injectClose)
+	}
+	go s.pump()
+	return s
+}
+
+// Read returns backend frames after the faults
+func (s *webSocketStream) Read(p []byte) (int, error) {
+	return s.pr.Read(p)
+}
+
+// Write forwards client frames to the backend after the faults
+func (s *webSocketStream) Write(p []byte) (int, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if err := s.fromClient.feed(p, s.backend, s.onFrame); err != nil {
+		return 0, err
+	}
+	if s.backendClose && s.fromClient.onBoundary() {
+		s.backendClose = false
+		s.backend.Write(wsCloseFrame(s.closeCode(), true))
+	}
+	return len(p), nil
+}
+
+// Close implements the io.Closer interface
+func (s *webSocketStream) Close() error {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.pw.Close()
+	return s.backend.Close()
+}
+
+// pump copies backend frames into the pipe read by the proxy
+func (s *webSocketStream) pump() {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := s.backend.Read(buf)
+		if n > 0 {
+			s.rmu.Lock()
+			werr := s.fromBackend.feed(buf[:n], s.pw, s.onFrame)
+			if werr == nil && s.clientClose && s.fromBackend.onBoundary() {
+				s.closeClient()
+			}
+			s.rmu.Unlock()
+			if werr != nil {
+				s.backend.Close()
+				return
+			}
+		}
+		if err != nil {
+			// After an injected close the grace period ends the pipe
+			if !s.closing.Load() {
+				s.pw.CloseWithError(err)
+			}
+			return
+		}
+	}
+}
+
+// onFrame applies the frame faults and reports whether to drop the frame
+func (s *webSocketStream) onFrame(fin bool, opcode byte) bool {
+	if s.closing.Load() {
+		// Nothing may follow the injected close frames
+		return true
+	}
+	if opcode >= wsOpClose {
+		return false
+	}
+
+	config := s.plan.config
+	if fin && (opcode == wsOpText || opcode == wsOpBinary) && mathrand.Float64() < config.FrameDropProbability {
+		slog.Debug("dropping WebSocket frame", "request_id", s.requestID)
+		s.stats.recordWebSocketFault(WebSocketFaultDrop)
+		return true
+	}
+	if mathrand.Float64() < config.FrameDelayProbability {
+		delay := pickBetween(config.FrameDelayMin.Duration, config.FrameDelayMax.Duration)
+		slog.Debug("delaying WebSocket frame", "request_id", s.requestID, "delay", delay)
+		s.stats.recordWebSocketFault(WebSocketFaultDelay)
+		time.Sleep(delay)
+	}
+
+	if fin && s.plan.closeAt > 0 && s.messages.Add(1) == int64(s.plan.closeAt) {
+		go s.injectClose()
+	}
+	return false
+}
+
+// injectClose sends a close frame to both peers as soon as no frame is
+// half-forwarded in their direction
+func (s *webSocketStream) injectClose() {
+	s.closeOnce.Do(func() {
+		s.closing.Store(true)
+		slog.Info("closing WebSocket", "request_id", s.requestID, "code", s.closeCode(),
+			"messages", s.messages.Load())
+		s.stats.recordWebSocketFault(WebSocketFaultClose)
+
+		s.wmu.Lock()
+		if s.fromClient.onBoundary() {
+			s.backend.Write(wsCloseFrame(s.closeCode(), true))
+		} else {
+			s.backendClose = true
+		}
+		s.wmu.Unlock()
+
+		s.rmu.Lock()
+		if s.fromBackend.onBoundary() {
+			s.closeClient()
+		} else {
+			s.clientClose = true
+		}
+		s.rmu.Unlock()
+	})
+}
+
+// closeClient sends the close frame to the client and ends the connection
+// after the grace period. Called with rmu held.
+func (s *webSocketStream) closeClient() {
+	s.clientClose = false
+	s.pw.Write(wsCloseFrame(s.closeCode(), false))
+	time.AfterFunc(wsCloseGrace, func() { s.pw.CloseWithError(errInjectedClose) })
+}
+
+func (s *webSocketStream) closeCode() int {
+	if s.plan.config.CloseCode != 0 {
+		return s.plan.config.CloseCode
+	}
+	return defaultWSCloseCode
+}
+
+// wsCloseFrame builds a close frame; frames sent to a server are masked
+func wsCloseFrame(code int, masked bool) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, "chaos: injected close"...)
+
+	frame := []byte{0x80 | wsOpClose, byte(len(payload))}
+	if !masked {
+		return append(frame, payload...)
+	}
+	frame[1] |= 0x80
+	key := make([]byte, 4)
+	rand.Read(key)
+	frame = append(frame, key...)
+	for i, b := range payload {
+		frame = append(frame, b^key[i%4])
+	}
+	return frame
+}
+
+// wsFilter follows the frames of one direction of a WebSocket stream and
+// forwards them, minus the dropped ones, without buffering payloads
+type wsFilter struct {
+	header    []byte
+	remaining uint64
+	inPayload bool
+	drop      bool
+}
+
+// feed forwards p to w. onFrame sees each frame header and reports whether
+// to drop the frame.
+func (f *wsFilter) feed(p []byte, w io.Writer, onFrame func(fin bool, opcode byte) bool) error {
+	for len(p) > 0 {
+		if f.inPayload {
+			n := uint64(len(p))
+			if n > f.remaining {
+				n = f.remaining
+			}
+			if !f.drop {
+				if _, err := w.Write(p[:n]); err != nil {
+					return err
+				}
+			}
+			p = p[n:]
+			f.remaining -= n
+			f.inPayload = f.remaining > 0
+			continue
+		}
+
+		need := wsHeaderLen(f.header) - len(f.header)
+		if need > len(p) {
+			need = len(p)
+		}
+		f.header = append(f.header, p[:need]...)
+		p = p[need:]
+		if len(f.header) < wsHeaderLen(f.header) {
+			continue
+		}
+
+		fin, opcode, length := parseWSHeader(f.header)
+		f.drop = onFrame(fin, opcode)
+		if !f.drop {
+			if _, err := w.Write(f.header); err != nil {
+				return err
+			}
+		}
+		f.header = f.header[:0]
+		f.remaining = length
+		f.inPayload = length > 0
+	}
+	return nil
+}
+
+// onBoundary reports whether nothing of a forwarded frame is pending, so
+// that another frame can be inserted
+func (f *wsFilter) onBoundary() bool {
+	return !f.inPayload || f.drop
+}
+
+// wsHeaderLen returns the length of a frame header given its first bytes
+func wsHeaderLen(h []byte) int {
+	if len(h) < 2 {
+		return 2
+	}
+	n := 2
+	switch h[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if h[1]&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+func parseWSHeader(h []byte) (fin bool, opcode byte, length uint64) {
+	fin = h[0]&0x80 != 0
+	opcode = h[0] & 0x0f
+	switch l := h[1] & 0x7f; l {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(h[2:4]))
+	case 127:
+		length = binary.BigEndian.Uint64(h[2:10])
+	default:
+		length = uint64(l)
+	}
+	return fin, opcode, length
+}
@@ -0,0 +1,53 @@
+package chaos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func upgradeRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/socket", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	return r
+}
+
+func TestWebSocketRejectCountedOnlyWhenApplied(t *testing.T) {
+	tests := []struct {
+		name    string
+		adjust  func(*ChaosConfig)
+		status  int
+		counted int64
+	}{
+		{"reject", func(*ChaosConfig) {}, http.StatusTeapot, 1},
+		{"error wins", func(c *ChaosConfig) {
+			c.ErrorProbability = 1
+			c.ErrorCodes = []int{http.StatusInternalServerError}
+		}, http.StatusInternalServerError, 0},
+		{"timeout wins", func(c *ChaosConfig) {
+			c.TimeoutProbability = 1
+			c.TimeoutDuration = Duration{Duration: time.Millisecond}
+		}, http.StatusGatewayTimeout, 0},
+		{"dry run", func(c *ChaosConfig) { c.DryRun = true }, http.StatusOK, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := quietConfig()
+			config.WebSocket = WebSocketConfig{RejectProbability: 1, RejectStatus: http.StatusTeapot}
+			tt.adjust(config)
+			cm := newTestProxy(t, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			w := httptest.NewRecorder()
+			cm.ServeHTTP(w, upgradeRequest())
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			counts := cm.stats.snapshot(false)["websocket_faults"].(map[string]int64)
+			if got := counts[WebSocketFaultReject]; got != tt.counted {
+				t.Errorf("rejected upgrades = %d, want %d", got, tt.counted)
+			}
+		})
+	}
+}
@@ -0,0 +1,549 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/pgaijin66/phailure/internal/chaos"
+)
+
+// Frame types and flags of RFC 9113 seen by the frame interceptor
+const (
+	frameData         = 0x0
+	frameHeaders      = 0x1
+	framePushPromise  = 0x5
+	frameWindowUpdate = 0x8
+	frameContinuation = 0x9
+
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+
+	frameHeaderLen = 9
+)
+
+// maxReadBuffer bounds the client frames waiting for the HTTP/2 server.
+// Once reached, the client is no longer read until the server catches up,
+// so a client ignoring flow control cannot make the proxy buffer without
+// limit.
+const maxReadBuffer = 1 << 20
+
+// maxFrameSize is the SETTINGS_MAX_FRAME_SIZE advertised to clients, the
+// default of RFC 9113. Larger frames end the connection before their
+// payload is read.
+const maxFrameSize = 1 << 14
+
+// errFrameTooLarge fails a connection whose client sent a frame larger
+// than maxFrameSize
+var errFrameTooLarge = errors.New("http2: client frame exceeds SETTINGS_MAX_FRAME_SIZE")
+
+// serveHTTP2 serves an HTTP/2 connection, injecting the stream faults of
+// the route each request belongs to
+func (s *Server) serveHTTP2(conn net.Conn) {
+	fc := newFrameConn(conn, s.decideHTTP2Fault)
+	var c net.Conn = fc
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		c = &tlsFrameConn{frameConn: fc, tls: tlsConn}
+	}
+	s.h2.ServeConn(c, &http2.ServeConnOpts{BaseConfig: s.httpServer})
+}
+
+// decideHTTP2Fault picks the fault for a new stream from the configuration
+// of its route. Management requests are never disturbed.
+func (s *Server) decideHTTP2Fault(r *http.Request) (chaos.HTTP2Fault, bool) {
+	if strings.HasPrefix(r.URL.Path, "/_chaos") {
+		return chaos.HTTP2Fault{}, false
+	}
+	rt := s.router.Match(r)
+	if rt == nil {
+		return chaos.HTTP2Fault{}, false
+	}
+	return rt.Middleware().DecideHTTP2Fault(r)
+}
+
+// frameConn sits between an HTTP/2 client and the HTTP/2 server and
+// rewrites the frames of faulty streams:
+//
+//   - a reset stream gets RST_STREAM towards the client and a CANCEL towards
+//     the server, whose later frames for it are discarded
+//   - GOAWAY rejects the stream and every later one the same way
+//   - a starved stream has its WINDOW_UPDATE frames held back in both
+//     directions until the starvation ends
+//
+// Request headers are decoded to route each stream; header blocks are
+// never dropped so that both HPACK contexts stay in sync.
+type frameConn struct {
+	net.Conn
+	decide func(*http.Request) (chaos.HTTP2Fault, bool)
+
+	// Client to server: frames read by readLoop and queued for Read.
+	// Injected frames wait in rpending while a header block is open. The
+	// read deadline is kept here rather than on the connection, whose
+	// reads belong to readLoop.
+	rmu       sync.Mutex
+	rcond     *sync.Cond
+	rbuf      bytes.Buffer
+	rerr      error
+	rclosed   bool
+	rInBlock  bool
+	rpending  []byte
+	rdeadline time.Time
+	rtimer    *time.Timer
+
+	// Server to client: wbuf holds an incomplete frame written by the
+	// server, wpending frames injected before the server's SETTINGS or
+	// while a header block is open
+	wmu      sync.Mutex
+	wbuf     []byte
+	wStarted bool
+	wInBlock bool
+	wpending []byte
+
+	// Header decoding, only used by readLoop
+	decoder    *hpack.Decoder
+	block      []byte
+	lastStream uint32
+	broken     bool
+
+	// Stream state
+	mu       sync.Mutex
+	dropped  map[uint32]bool
+	starved  map[uint32]*heldFrames
+	goneAway bool
+}
+
+// heldFrames are WINDOW_UPDATE frames of a starved stream
+type heldFrames struct {
+	toServer [][]byte
+	toClient [][]byte
+}
+
+func newFrameConn(conn net.Conn, decide func(*http.Request) (chaos.HTTP2Fault, bool)) *frameConn {
+	c := &frameConn{
+		Conn:    conn,
+		decide:  decide,
+		decoder: hpack.NewDecoder(4096, nil),
+		dropped: map[uint32]bool{},
+		starved: map[uint32]*heldFrames{},
+	}
+	c.rcond = sync.NewCond(&c.rmu)
+	go c.readLoop()
+	return c
+}
+
+// tlsFrameConn exposes the TLS state to the HTTP/2 server, which requires
+// it for connections negotiated with ALPN
+type tlsFrameConn struct {
+	*frameConn
+	tls *tls.Conn
+}
+
+func (c *tlsFrameConn) ConnectionState() tls.ConnectionState {
+	return c.tls.ConnectionState()
+}
+
+// Read returns client frames after interception
+func (c *frameConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for c.rbuf.Len() == 0 && c.rerr == nil {
+		if !c.rdeadline.IsZero() && !time.Now().Before(c.rdeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.rcond.Wait()
+	}
+	if c.rbuf.Len() > 0 {
+		n, err := c.rbuf.Read(p)
+		// readLoop may be waiting for room in the buffer
+		c.rcond.Broadcast()
+		return n, err
+	}
+	return 0, c.rerr
+}
+
+// SetReadDeadline implements the net.Conn interface for Read
+func (c *frameConn) SetReadDeadline(t time.Time) error {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	c.rdeadline = t
+	if c.rtimer != nil {
+		c.rtimer.Stop()
+	}
+	if !t.IsZero() {
+		c.rtimer = time.AfterFunc(time.Until(t), func() {
+			c.rmu.Lock()
+			c.rcond.Broadcast()
+			c.rmu.Unlock()
+		})
+	}
+	c.rcond.Broadcast()
+	return nil
+}
+
+// SetDeadline implements the net.Conn interface
+func (c *frameConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Close closes the connection and wakes readLoop if it waits for room
+func (c *frameConn) Close() error {
+	c.rmu.Lock()
+	c.rclosed = true
+	if c.rtimer != nil {
+		c.rtimer.Stop()
+	}
+	c.rcond.Broadcast()
+	c.rmu.Unlock()
+	return c.Conn.Close()
+}
+
+// readLoop reads whole frames from the client until the connection fails
+func (c *frameConn) readLoop() {
+	err := c.readFrames()
+	c.rmu.Lock()
+	c.rerr = err
+	c.rcond.Broadcast()
+	c.rmu.Unlock()
+}
+
+func (c *frameConn) readFrames() error {
+	preface := make([]byte, len(h2Preface))
+	if _, err := io.ReadFull(c.Conn, preface); err != nil {
+		return err
+	}
+	c.queueFromClient(preface, 0, 0)
+
+	header := make([]byte, frameHeaderLen)
+	for {
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return err
+		}
+		length := frameLength(header)
+		if length > maxFrameSize {
+			c.toClient(goAwayFrame(c.lastStream, http2.ErrCodeFrameSize, "frame too large"))
+			return errFrameTooLarge
+		}
+		frame := make([]byte, frameHeaderLen+length)
+		copy(frame, header)
+		if _, err := io.ReadFull(c.Conn, frame[frameHeaderLen:]); err != nil {
+			return err
+		}
+		c.fromClient(frame)
+	}
+}
+
+// fromClient forwards a client frame to the server, opening faults on new
+// streams and holding WINDOW_UPDATE frames of starved ones
+func (c *frameConn) fromClient(frame []byte) {
+	typ, flags, stream := frame[3], frame[4], frameStream(frame)
+
+	if typ == frameWindowUpdate && c.hold(stream, frame, true) {
+		return
+	}
+	c.queueFromClient(frame, typ, flags)
+
+	if c.broken || (typ != frameHeaders && typ != frameContinuation) {
+		return
+	}
+	fragment, ok := headerFragment(typ, flags, frame[frameHeaderLen:])
+	if !ok {
+		c.broken = true
+		return
+	}
+	c.block = append(c.block, fragment...)
+	if flags&flagEndHeaders == 0 {
+		return
+	}
+
+	fields, err := c.decoder.DecodeFull(c.block)
+	c.block = c.block[:0]
+	if err != nil {
+		// The server reports the compression error; stop interpreting
+		// headers on this connection
+		c.broken = true
+		return
+	}
+	// Client streams have increasing ids; lower ids carry trailers
+	if stream > c.lastStream {
+		previous := c.lastStream
+		c.lastStream = stream
+		c.openStream(stream, previous, fields)
+	}
+}
+
+// openStream decides and starts the fault of a new stream. previous is
+// the last stream opened before it.
+func (c *frameConn) openStream(stream, previous uint32, fields []hpack.HeaderField) {
+	c.mu.Lock()
+	goneAway := c.goneAway
+	if goneAway {
+		c.dropped[stream] = true
+	}
+	c.mu.Unlock()
+	if goneAway {
+		c.toServer(rstStreamFrame(stream, http2.ErrCodeCancel))
+		return
+	}
+
+	fault, ok := c.decide(c.request(fields))
+	if !ok {
+		return
+	}
+
+	switch fault.Kind {
+	case chaos.HTTP2FaultRSTStream:
+		c.mu.Lock()
+		c.dropped[stream] = true
+		c.mu.Unlock()
+		c.toClient(rstStreamFrame(stream, http2.ErrCode(fault.Code)))
+		c.toServer(rstStreamFrame(stream, http2.ErrCodeCancel))
+
+	case chaos.HTTP2FaultGoAway:
+		c.mu.Lock()
+		c.goneAway = true
+		c.dropped[stream] = true
+		c.mu.Unlock()
+		c.toClient(goAwayFrame(previous, http2.ErrCode(fault.Code), "chaos: injected GOAWAY"))
+		c.toServer(rstStreamFrame(stream, http2.ErrCodeCancel))
+
+	case chaos.HTTP2FaultStarvation:
+		c.mu.Lock()
+		c.starved[stream] = &heldFrames{}
+		c.mu.Unlock()
+		time.AfterFunc(fault.Duration, func() { c.release(stream) })
+	}
+}
+
+// request rebuilds the request line and headers of a stream for routing
+// and client targeting
+func (c *frameConn) request(fields []hpack.HeaderField) *http.Request {
+	r := &http.Request{
+		Header:     http.Header{},
+		URL:        &url.URL{},
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		RemoteAddr: c.RemoteAddr().String(),
+	}
+	for _, f := range fields {
+		switch f.Name {
+		case ":method":
+			r.Method = f.Value
+		case ":authority":
+			r.Host = f.Value
+		case ":path":
+			if u, err := url.ParseRequestURI(f.Value); err == nil {
+				r.URL = u
+			}
+		default:
+			if !strings.HasPrefix(f.Name, ":") {
+				r.Header.Add(f.Name, f.Value)
+			}
+		}
+	}
+	if r.Host == "" {
+		r.Host = r.Header.Get("Host")
+	}
+	return r
+}
+
+// Write forwards server frames to the client once complete, dropping those
+// of reset streams and holding WINDOW_UPDATE frames of starved ones
+func (c *frameConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.wbuf = append(c.wbuf, p...)
+	var out []byte
+	for len(c.wbuf) >= frameHeaderLen {
+		size := frameHeaderLen + frameLength(c.wbuf)
+		if len(c.wbuf) < size {
+			break
+		}
+		frame := c.wbuf[:size]
+		c.wbuf = c.wbuf[size:]
+
+		typ, flags := frame[3], frame[4]
+		if c.forwardToClient(frame) {
+			out = append(out, frame...)
+		}
+		switch {
+		case (typ == frameHeaders || typ == framePushPromise || typ == frameContinuation) && flags&flagEndHeaders == 0:
+			c.wInBlock = true
+		case typ == frameContinuation || !c.wStarted:
+			// The server's first frame is its SETTINGS, which must
+			// reach the client before anything else
+			c.wStarted = true
+			c.wInBlock = false
+			out = append(out, c.wpending...)
+			c.wpending = nil
+		}
+	}
+	c.wbuf = append([]byte(nil), c.wbuf...)
+
+	if len(out) > 0 {
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// forwardToClient reports whether a server frame goes to the client
+func (c *frameConn) forwardToClient(frame []byte) bool {
+	typ, stream := frame[3], frameStream(frame)
+	if stream == 0 || typ == frameHeaders || typ == frameContinuation || typ == framePushPromise {
+		return true
+	}
+
+	c.mu.Lock()
+	dropped := c.dropped[stream]
+	c.mu.Unlock()
+	if dropped {
+		// The client never sees this data, so give the connection
+		// window it used back to the server
+		if length := uint32(frameLength(frame)); typ == frameData && length > 0 {
+			c.toServer(windowUpdateFrame(0, length))
+		}
+		return false
+	}
+	if typ == frameWindowUpdate {
+		return !c.hold(stream, append([]byte(nil), frame...), false)
+	}
+	return true
+}
+
+// hold keeps a WINDOW_UPDATE frame of a starved stream for later
+func (c *frameConn) hold(stream uint32, frame []byte, toServer bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	held, ok := c.starved[stream]
+	if !ok {
+		return false
+	}
+	if toServer {
+		held.toServer = append(held.toServer, frame)
+	} else {
+		held.toClient = append(held.toClient, frame)
+	}
+	return true
+}
+
+// release ends the starvation of a stream and delivers the held frames
+func (c *frameConn) release(stream uint32) {
+	c.mu.Lock()
+	held := c.starved[stream]
+	delete(c.starved, stream)
+	c.mu.Unlock()
+
+	for _, frame := range held.toServer {
+		c.toServer(frame)
+	}
+	for _, frame := range held.toClient {
+		c.toClient(frame)
+	}
+}
+
+// queueFromClient passes a frame read from the client to the server,
+// waiting while the server is maxReadBuffer behind
+func (c *frameConn) queueFromClient(frame []byte, typ, flags byte) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for c.rbuf.Len() >= maxReadBuffer && !c.rclosed {
+		c.rcond.Wait()
+	}
+	c.rbuf.Write(frame)
+	switch {
+	case (typ == frameHeaders || typ == frameContinuation) && flags&flagEndHeaders == 0:
+		c.rInBlock = true
+	case typ == frameContinuation:
+		c.rInBlock = false
+		c.rbuf.Write(c.rpending)
+		c.rpending = nil
+	}
+	c.rcond.Broadcast()
+}
+
+// toServer injects a frame towards the server
+func (c *frameConn) toServer(frame []byte) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.rInBlock {
+		c.rpending = append(c.rpending, frame...)
+		return
+	}
+	c.rbuf.Write(frame)
+	c.rcond.Broadcast()
+}
+
+// toClient injects a frame towards the client. Incomplete server frames
+// are still in wbuf, so the frame lands on a frame boundary.
+func (c *frameConn) toClient(frame []byte) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if !c.wStarted || c.wInBlock {
+		c.wpending = append(c.wpending, frame...)
+		return
+	}
+	// A failed write surfaces on the server's next write
+	c.Conn.Write(frame)
+}
+
+// headerFragment strips padding and priority from a HEADERS frame payload
+func headerFragment(typ, flags byte, payload []byte) ([]byte, bool) {
+	if typ != frameHeaders {
+		return payload, true
+	}
+	if flags&flagPadded != 0 {
+		if len(payload) < 1 || int(payload[0]) >= len(payload) {
+			return nil, false
+		}
+		payload = payload[1 : len(payload)-int(payload[0])]
+	}
+	if flags&flagPriority != 0 {
+		if len(payload) < 5 {
+			return nil, false
+		}
+		payload = payload[5:]
+	}
+	return payload, true
+}
+
+func frameLength(header []byte) int {
+	return int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+}
+
+func frameStream(header []byte) uint32 {
+	return binary.BigEndian.Uint32(header[5:9]) & (1<<31 - 1)
+}
+
+func rstStreamFrame(stream uint32, code http2.ErrCode) []byte {
+	var buf bytes.Buffer
+	http2.NewFramer(&buf, nil).WriteRSTStream(stream, code)
+	return buf.Bytes()
+}
+
+func goAwayFrame(lastStream uint32, code http2.ErrCode, debug string) []byte {
+	var buf bytes.Buffer
+	http2.NewFramer(&buf, nil).WriteGoAway(lastStream, code, []byte(debug))
+	return buf.Bytes()
+}
+
+func windowUpdateFrame(stream, increment uint32) []byte {
+	var buf bytes.Buffer
+	http2.NewFramer(&buf, nil).WriteWindowUpdate(stream, increment)
+	return buf.Bytes()
+}
@@ -0,0 +1,433 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/pgaijin66/phailure/internal/chaos"
+)
+
+func TestMain(m *testing.M) {
+	// Every proxied request logs a line; keep test output readable
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// quietConfig returns a valid configuration that injects no request fault
+func quietConfig() *chaos.ChaosConfig {
+	config := chaos.DefaultConfig()
+	config.DelayProbability = 0
+	config.ErrorProbability = 0
+	config.TimeoutProbability = 0
+	return config
+}
+
+// targetedUser is the only client HTTP/2 faults apply to in these tests
+const targetedUser = "chaos"
+
+// h2Proxy is a proxy serving HTTP/2 on a loopback port
+type h2Proxy struct {
+	addr string
+	tls  bool
+}
+
+// startH2Proxy starts a proxy in front of backend that injects faults on
+// the streams of targetedUser, over TLS or cleartext HTTP/2
+func startH2Proxy(t *testing.T, faults chaos.HTTP2FaultConfig, useTLS bool, backend http.Handler) *h2Proxy {
+	t.Helper()
+	upstream := httptest.NewServer(backend)
+	t.Cleanup(upstream.Close)
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := quietConfig()
+	config.HTTP2Faults = faults
+	config.Targeting = chaos.TargetingConfig{Enabled: true, Key: chaos.TargetKeyHeader, KeyName: "X-User-ID", Allow: []string{targetedUser}}
+
+	s, err := New("0", config, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if useTLS {
+		if err := s.EnableTLS(TLSOptions{SelfSigned: true}); err != nil {
+			t.Fatal(err)
+		}
+		s.tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(ln)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return &h2Proxy{addr: ln.Addr().String(), tls: useTLS}
+}
+
+// dial opens a raw connection to the proxy, negotiating h2 over TLS
+func (p *h2Proxy) dial(t *testing.T) net.Conn {
+	t.Helper()
+	var conn net.Conn
+	var err error
+	if p.tls {
+		conn, err = tls.Dial("tcp", p.addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	} else {
+		conn, err = net.Dial("tcp", p.addr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// client opens an HTTP/2 client connection to the proxy. A ClientConn
+// never retries on another connection, so faults reach the test.
+func (p *h2Proxy) client(t *testing.T) *http2.ClientConn {
+	t.Helper()
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(p.dial(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return cc
+}
+
+func (p *h2Proxy) request(t *testing.T, method, path, user string, body []byte) *http.Request {
+	t.Helper()
+	scheme := "http"
+	if p.tls {
+		scheme = "https"
+	}
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, scheme+"://"+p.addr+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "" {
+		req.Header.Set("X-User-ID", user)
+	}
+	return req
+}
+
+// get sends a GET request on cc and returns the body of the response
+func get(cc *http2.ClientConn, req *http.Request) (string, error) {
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func helloBackend() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, "hello")
+	})
+}
+
+// forEachTransport runs test over cleartext HTTP/2 and TLS
+func forEachTransport(t *testing.T, test func(t *testing.T, useTLS bool)) {
+	t.Run("h2c", func(t *testing.T) { test(t, false) })
+	t.Run("tls", func(t *testing.T) { test(t, true) })
+}
+
+func TestHTTP2WithoutFault(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, useTLS bool) {
+		p := startH2Proxy(t, chaos.HTTP2FaultConfig{RSTStreamProbability: 1}, useTLS, helloBackend())
+		cc := p.client(t)
+		for i := 0; i < 3; i++ {
+			body, err := get(cc, p.request(t, http.MethodGet, "/", "someone", nil))
+			if err != nil || body != "hello" {
+				t.Fatalf("untargeted request %d: body %q, error %v", i, body, err)
+			}
+		}
+	})
+}
+
+func TestHTTP2RSTStream(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, useTLS bool) {
+		faults := chaos.HTTP2FaultConfig{RSTStreamProbability: 1, RSTStreamCode: "ENHANCE_YOUR_CALM"}
+		p := startH2Proxy(t, faults, useTLS, helloBackend())
+		cc := p.client(t)
+
+		_, err := get(cc, p.request(t, http.MethodGet, "/", targetedUser, nil))
+		var streamErr http2.StreamError
+		if !errors.As(err, &streamErr) || streamErr.Code != http2.ErrCodeEnhanceYourCalm {
+			t.Fatalf("targeted request: error %v, want RST_STREAM ENHANCE_YOUR_CALM", err)
+		}
+
+		// The connection and both HPACK contexts survive the reset
+		for _, path := range []string{"/", "/_chaos/health"} {
+			user := "someone"
+			if path == "/_chaos/health" {
+				user = targetedUser
+			}
+			if _, err := get(cc, p.request(t, http.MethodGet, path, user, nil)); err != nil {
+				t.Fatalf("request to %s after the reset: %v", path, err)
+			}
+		}
+	})
+}
+
+func TestHTTP2GoAway(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, useTLS bool) {
+		p := startH2Proxy(t, chaos.HTTP2FaultConfig{GoAwayProbability: 1}, useTLS, helloBackend())
+		cc := p.client(t)
+
+		if _, err := get(cc, p.request(t, http.MethodGet, "/", "someone", nil)); err != nil {
+			t.Fatalf("request before GOAWAY: %v", err)
+		}
+		if _, err := get(cc, p.request(t, http.MethodGet, "/", targetedUser, nil)); err == nil {
+			t.Fatal("targeted request succeeded, want it rejected by GOAWAY")
+		}
+		if cc.CanTakeNewRequest() {
+			t.Error("connection still takes new requests after GOAWAY")
+		}
+	})
+}
+
+func TestHTTP2StarvationWithholdsWindowUpdates(t *testing.T) {
+	const starvation = 300 * time.Millisecond
+	// Larger than the initial stream windows of the client (4MB) and of
+	// the server (1MB), so both transfers need WINDOW_UPDATE frames
+	download := bytes.Repeat([]byte("x"), 5<<20)
+	upload := bytes.Repeat([]byte("y"), 2<<20)
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		if n > 0 {
+			io.WriteString(w, "received")
+			return
+		}
+		w.Write(download)
+	})
+
+	forEachTransport(t, func(t *testing.T, useTLS bool) {
+		faults := chaos.HTTP2FaultConfig{StarvationProbability: 1, StarvationDuration: chaos.Duration{Duration: starvation}}
+		p := startH2Proxy(t, faults, useTLS, backend)
+		cc := p.client(t)
+
+		tests := []struct {
+			name   string
+			method string
+			body   []byte
+			want   int
+		}{
+			{"download", http.MethodGet, nil, len(download)},
+			{"upload", http.MethodPost, upload, len("received")},
+		}
+		for _, tt := range tests {
+			for _, user := range []string{"someone", targetedUser} {
+				start := time.Now()
+				body, err := get(cc, p.request(t, tt.method, "/", user, tt.body))
+				elapsed := time.Since(start)
+				if err != nil || len(body) != tt.want {
+					t.Fatalf("%s for %s: %d bytes, error %v", tt.name, user, len(body), err)
+				}
+				if user == targetedUser && elapsed < starvation {
+					t.Errorf("starved %s took %v, want at least %v", tt.name, elapsed, starvation)
+				}
+			}
+		}
+	})
+}
+
+// rawStream sends a request built by hand with the framer, so that the
+// header block can be padded or split, and returns the response status or
+// the code the stream was reset with
+func rawStream(t *testing.T, conn net.Conn, user string, padding uint8, split int) (string, http2.ErrCode) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		t.Fatal(err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	for _, f := range []hpack.HeaderField{
+		{Name: ":method", Value: http.MethodGet},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":authority", Value: "localhost"},
+		{Name: ":path", Value: "/"},
+		{Name: "x-user-id", Value: user},
+		{Name: "x-filler", Value: strings.Repeat("f", 3000)},
+	} {
+		enc.WriteField(f)
+	}
+	fragment := block.Bytes()
+	if split == 0 || split > len(fragment) {
+		split = len(fragment)
+	}
+	err := framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: fragment[:split],
+		EndStream:     true,
+		EndHeaders:    split == len(fragment),
+		PadLength:     padding,
+	})
+	for rest := fragment[split:]; err == nil && len(rest) > 0; {
+		n := min(split, len(rest))
+		err = framer.WriteContinuation(1, n == len(rest), rest[:n])
+		rest = rest[n:]
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				framer.WriteSettingsAck()
+			}
+		case *http2.MetaHeadersFrame:
+			if f.StreamID == 1 {
+				return f.PseudoValue("status"), 0
+			}
+		case *http2.RSTStreamFrame:
+			if f.StreamID == 1 {
+				return "", f.ErrCode
+			}
+		case *http2.GoAwayFrame:
+			t.Fatalf("unexpected GOAWAY %v", f.ErrCode)
+		}
+	}
+}
+
+func TestHTTP2PaddedAndContinuationHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		padding uint8
+		split   int
+	}{
+		{"padded", 200, 0},
+		{"continuation", 0, 500},
+		{"padded continuation", 17, 1000},
+	}
+	forEachTransport(t, func(t *testing.T, useTLS bool) {
+		p := startH2Proxy(t, chaos.HTTP2FaultConfig{RSTStreamProbability: 1}, useTLS, helloBackend())
+		for _, tt := range tests {
+			// The targeted client can only be recognised from a header
+			// block decoded in full, past padding and across frames
+			status, code := rawStream(t, p.dial(t), targetedUser, tt.padding, tt.split)
+			if code != http2.ErrCodeInternal {
+				t.Errorf("%s targeted: status %q, reset %v, want RST_STREAM INTERNAL_ERROR", tt.name, status, code)
+			}
+			status, code = rawStream(t, p.dial(t), "someone", tt.padding, tt.split)
+			if status != "200" {
+				t.Errorf("%s untargeted: status %q, reset %v, want 200", tt.name, status, code)
+			}
+		}
+	})
+}
+
+func TestFrameConnReadDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	fc := newFrameConn(server, nil)
+	defer fc.Close()
+
+	fc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	if _, err := fc.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read past the deadline: %v, want os.ErrDeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Read returned after %v", elapsed)
+	}
+
+	// A timed out read leaves the connection usable
+	fc.SetReadDeadline(time.Time{})
+	go io.WriteString(client, http2.ClientPreface)
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(fc, preface); err != nil || string(preface) != http2.ClientPreface {
+		t.Fatalf("Read after clearing the deadline: %q, %v", preface, err)
+	}
+}
+
+func TestFrameConnBoundsReadBuffer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	fc := newFrameConn(server, nil)
+	defer fc.Close()
+
+	// A client pushing frames the server does not read yet
+	var frames bytes.Buffer
+	framer := http2.NewFramer(&frames, nil)
+	for frames.Len() < 4*maxReadBuffer {
+		framer.WritePing(false, [8]byte{})
+	}
+	sent := append([]byte(http2.ClientPreface), frames.Bytes()...)
+	go client.Write(sent)
+
+	buffered := func() int {
+		fc.rmu.Lock()
+		defer fc.rmu.Unlock()
+		return fc.rbuf.Len()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for buffered() < maxReadBuffer && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Give readLoop time to go past the bound if nothing stops it
+	time.Sleep(300 * time.Millisecond)
+	if buffered := buffered(); buffered > maxReadBuffer+64 {
+		t.Fatalf("%d bytes buffered, want at most about %d", buffered, maxReadBuffer)
+	}
+
+	received := make([]byte, len(sent))
+	if _, err := io.ReadFull(fc, received); err != nil || !bytes.Equal(received, sent) {
+		t.Fatalf("frames changed or lost once read: %v", err)
+	}
+}
+
+func TestFrameConnRejectsOversizeFrames(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	fc := newFrameConn(server, nil)
+	defer fc.Close()
+
+	// The header announces 16 MiB; the payload is never sent
+	header := []byte{0xff, 0xff, 0xff, frameData, 0, 0, 0, 0, 1}
+	go client.Write(append([]byte(http2.ClientPreface), header...))
+
+	fc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(fc, preface); err != nil {
+		t.Fatalf("reading the preface: %v", err)
+	}
+	if n, err := fc.Read(make([]byte, frameHeaderLen)); !errors.Is(err, errFrameTooLarge) {
+		t.Fatalf("Read of an oversize frame: %d bytes, %v, want errFrameTooLarge", n, err)
+	}
+}
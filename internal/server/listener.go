@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// h2Preface opens every HTTP/2 connection from a client
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// handshakeTimeout bounds the TLS handshake and protocol detection of a
+// new connection
+const handshakeTimeout = 10 * time.Second
+
+// serve accepts connections on ln and hands each one to the HTTP/2 server
+// when the client negotiated h2 or sent the h2c preface, and to the
+// HTTP/1 server otherwise
+func (s *Server) serve(ln net.Listener) error {
+	h1 := newConnListener(ln)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				h1.shutdown(err)
+				return
+			}
+			go s.dispatch(conn, h1)
+		}
+	}()
+	return s.httpServer.Serve(h1)
+}
+
+// dispatch detects the protocol of a new connection
+func (s *Server) dispatch(conn net.Conn, h1 *connListener) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	isH2 := false
+	if s.tlsConfig != nil {
+		tlsConn := tls.Server(conn, s.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			slog.Debug("TLS handshake failed", "remote_addr", conn.RemoteAddr().String(), "error", err)
+			conn.Close()
+			return
+		}
+		conn = tlsConn
+		isH2 = tlsConn.ConnectionState().NegotiatedProtocol == "h2"
+	} else if s.h2 != nil {
+		conn, isH2 = detectPreface(conn)
+	}
+
+	conn.SetDeadline(time.Time{})
+	if isH2 && s.h2 != nil {
+		s.serveHTTP2(conn)
+		return
+	}
+	h1.push(conn)
+}
+
+// detectPreface reports whether the client opened a cleartext connection
+// with the HTTP/2 preface. The returned connection replays the bytes read.
+func detectPreface(conn net.Conn) (net.Conn, bool) {
+	r := bufio.NewReaderSize(conn, len(h2Preface))
+	isH2 := true
+	// Stop at the first byte that differs so that short HTTP/1 requests
+	// are not left waiting for more input
+	for n := 1; n <= len(h2Preface); n++ {
+		peek, err := r.Peek(n)
+		if err != nil || peek[n-1] != h2Preface[n-1] {
+			isH2 = false
+			break
+		}
+	}
+	return &bufferedConn{Conn: conn, r: r}, isH2
+}
+
+// bufferedConn is a connection whose first bytes were already read into r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// connListener feeds the HTTP/1 server with connections accepted and
+// classified by serve. Closing it closes the real listener.
+type connListener struct {
+	net.Listener
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	err   error
+}
+
+func newConnListener(ln net.Listener) *connListener {
+	return &connListener{
+		Listener: ln,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+}
+
+// Accept implements the net.Listener interface
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// Close implements the net.Listener interface
+func (l *connListener) Close() error {
+	l.shutdown(net.ErrClosed)
+	return l.Listener.Close()
+}
+
+// shutdown makes Accept fail with err once pending connections are gone
+func (l *connListener) shutdown(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
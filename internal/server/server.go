@@ -2,67 +2,162 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
 	"time"
 
+	"golang.org/x/net/http2"
+
 	"github.com/pgaijin66/phailure/internal/chaos"
 )
 
 // Server represents the HTTP server
 type Server struct {
-	port            string
-	config          *chaos.ChaosConfig
-	targetURL       *url.URL
-	chaosMiddleware *chaos.ChaosMiddleware
-	httpServer      *http.Server
+	config     *chaos.ChaosConfig
+	router     *chaos.Router
+	httpServer *http.Server
+	tlsConfig  *tls.Config
+
+	// h2 serves HTTP/2 connections; nil when HTTP/2 is disabled
+	h2 *http2.Server
+
+	// socketPath is set to listen on a Unix socket instead of a TCP port
+	socketPath string
+	socketMode os.FileMode
 }
 
-// New creates a new server instance
-func New(port string, config *chaos.ChaosConfig, targetURL *url.URL) *Server {
-	rand.New(rand.NewSource(time.Now().UnixNano()))
+// New creates a new server instance proxying every request to targetURL
+func New(port string, config *chaos.ChaosConfig, targetURL *url.URL) (*Server, error) {
+	router, err := chaos.NewRouter(config, &chaos.RouteConfig{Target: targetURL.String()}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithRouter(port, config, router), nil
+}
 
-	chaosMiddleware := chaos.NewChaosMiddleware(config, targetURL)
+// NewWithRouter creates a new server instance that routes requests to
+// several targets
+func NewWithRouter(port string, config *chaos.ChaosConfig, router *chaos.Router) *Server {
+	rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	httpServer := &http.Server{
 		Addr:    ":" + port,
-		Handler: chaosMiddleware,
+		Handler: router,
 	}
+	h2 := &http2.Server{MaxReadFrameSize: maxFrameSize}
+	// Registers h2 for graceful shutdown; the listener does the protocol
+	// negotiation itself
+	http2.ConfigureServer(httpServer, h2)
 
 	return &Server{
-		port:            port,
-		config:          config,
-		targetURL:       targetURL,
-		chaosMiddleware: chaosMiddleware,
-		httpServer:      httpServer,
+		config:     config,
+		router:     router,
+		httpServer: httpServer,
+		h2:         h2,
 	}
 }
 
+// DisableHTTP2 serves HTTP/1.1 only
+func (s *Server) DisableHTTP2() {
+	s.h2 = nil
+}
+
 // Start starts the HTTP server and prints startup information
 func (s *Server) Start() {
 	s.printStartupInfo()
 
-	log.Printf("🚀 Starting chaos proxy on port %s", s.port)
-	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("❌ Server failed to start: %v", err)
+	slog.Info("starting chaos proxy", "addr", s.listenAddr(), "tls", s.tlsConfig != nil, "http2", s.h2 != nil)
+
+	if s.tlsConfig != nil {
+		s.tlsConfig.NextProtos = []string{"http/1.1"}
+		if s.h2 != nil {
+			s.tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
 	}
 
-	log.Println("👋 Chaos proxy stopped")
+	ln, err := s.listen()
+	if err == nil {
+		err = s.serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		slog.Error("server failed to start", "error", err)
+		os.Exit(1)
+	}
+
+	slog.Info("chaos proxy stopped")
+}
+
+// Chaos returns the chaos middleware of the default route
+func (s *Server) Chaos() *chaos.ChaosMiddleware {
+	return s.router.Default().Middleware()
+}
+
+// Router returns the router dispatching requests to their route
+func (s *Server) Router() *chaos.Router {
+	return s.router
 }
 
 // Shutdown gracefully shuts down the server
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.httpServer.Shutdown(ctx)
+	err := s.httpServer.Shutdown(ctx)
+	if closeErr := s.router.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
-func (s *Server) printStartupInfo() {
-	delayMinMs := s.config.DelayMin.Duration.Seconds() * 1000
-	delayMaxMs := s.config.DelayMax.Duration.Seconds() * 1000
+// listenAddr describes where the proxy listens
+func (s *Server) listenAddr() string {
+	if s.socketPath != "" {
+		return "unix://" + s.socketPath
+	}
+	return s.httpServer.Addr
+}
+
+// baseURL is the address clients use to reach the proxy. Over a Unix
+// socket the host is arbitrary, e.g. curl --unix-socket PATH http://localhost/
+func (s *Server) baseURL() string {
+	scheme := "http"
+	if s.tlsConfig != nil {
+		scheme = "https"
+	}
+	if s.socketPath != "" {
+		return scheme + "://localhost"
+	}
+	host, port, _ := net.SplitHostPort(s.httpServer.Addr)
+	if host == "" {
+		host = "localhost"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// routeList describes the routing table for the startup banner
+func (s *Server) routeList() string {
+	routes := s.router.Routes()
+	if len(routes) == 1 {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, rt := range routes {
+		match := rt.Host + rt.PathPrefix
+		if rt.Host == "" && rt.PathPrefix == "" {
+			match = "*"
+		}
+		fmt.Fprintf(&b, "\n🧭 Route %s: %s → %s", rt.Name, match, rt.Backends())
+	}
+	return b.String()
+}
 
-	fmt.Printf(`
+// logo opens the startup banner
+const logo = `
 
 	██████╗ ██╗  ██╗ █████╗ ██╗██╗     ██╗   ██╗██████╗ ███████╗
 	██╔══██╗██║  ██║██╔══██╗██║██║     ██║   ██║██╔══██╗██╔════╝
@@ -71,24 +166,40 @@ func (s *Server) printStartupInfo() {
 	██║     ██║  ██║██║  ██║██║███████╗╚██████╔╝██║  ██║███████╗
 	╚═╝     ╚═╝  ╚═╝╚═╝  ╚═╝╚═╝╚══════╝ ╚═════╝ ╚═╝  ╚═╝╚══════╝
 
-				🔥 API Chaos Engineering Tool 🔥
+				🔥 API Chaos Engineering Tool 🔥`
+
+// listening describes where the proxy listens for the startup banner
+func (s *Server) listening() string {
+	if s.socketPath == "" {
+		return s.baseURL()
+	}
+	return fmt.Sprintf("unix://%s (curl --unix-socket %s %s/)", s.socketPath, s.socketPath, s.baseURL())
+}
+
+func (s *Server) printStartupInfo() {
+	delayMinMs := s.config.DelayMin.Duration.Seconds() * 1000
+	delayMaxMs := s.config.DelayMax.Duration.Seconds() * 1000
+
+	fmt.Printf(`%s
 
 =======================================
-📡 Proxy listening on: http://localhost:%s
-🎯 Target service: %s
+📡 Proxy listening on: %s
+🎯 Target service: %s%s
 ⚡ Delay injection: %.1f%% (%.0fms - %.0fms)
 💥 Error injection: %.1f%% (codes: %v)
 ⏱️ Timeout injection: %.1f%% (%v)
+🧪 Dry run: %v
 
 Management endpoints:
-📊 Stats: http://localhost:%s/_chaos/stats
-⚙️ Config: http://localhost:%s/_chaos/config
-❤️ Health: http://localhost:%s/_chaos/health
+📊 Stats: %s/_chaos/stats
+⚙️ Config: %s/_chaos/config
+❤️ Health: %s/_chaos/health
 
 Press Ctrl+C to stop
-`, s.port, s.targetURL.String(),
+`, logo, s.listening(), s.router.Default().Backends(), s.routeList(),
 		s.config.DelayProbability*100, delayMinMs, delayMaxMs,
 		s.config.ErrorProbability*100, s.config.ErrorCodes,
 		s.config.TimeoutProbability*100, s.config.TimeoutDuration.Duration,
-		s.port, s.port, s.port)
+		s.config.DryRun,
+		s.baseURL(), s.baseURL(), s.baseURL())
 }
@@ -0,0 +1,12 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestNewRejectsInvalidTarget(t *testing.T) {
+	if s, err := New("0", quietConfig(), &url.URL{Path: "relative"}); err == nil || s != nil {
+		t.Fatalf("New with a relative target: %v, %v, want an error", s, err)
+	}
+}
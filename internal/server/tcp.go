@@ -0,0 +1,302 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pgaijin66/phailure/internal/chaos"
+)
+
+// dialTimeout bounds connecting to a TCP backend
+const dialTimeout = 10 * time.Second
+
+// TCPServer forwards raw TCP connections to the targets of the default
+// route with connection-level chaos. The management API is served over
+// HTTP on a separate admin port.
+type TCPServer struct {
+	port   string
+	config *chaos.ChaosConfig
+	router *chaos.Router
+	admin  *http.Server
+
+	mu       sync.Mutex
+	ln       net.Listener
+	conns    map[net.Conn]struct{}
+	closing  bool
+	handlers sync.WaitGroup
+}
+
+// NewTCP creates a TCP proxy listening on port, with the management API on
+// adminPort
+func NewTCP(port, adminPort string, config *chaos.ChaosConfig, router *chaos.Router) *TCPServer {
+	return &TCPServer{
+		port:   port,
+		config: config,
+		router: router,
+		admin: &http.Server{
+			Addr:    ":" + adminPort,
+			Handler: managementOnly(router),
+		},
+		conns: map[net.Conn]struct{}{},
+	}
+}
+
+// managementOnly serves the /_chaos endpoints and nothing else
+func managementOnly(router *chaos.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/_chaos") {
+			http.NotFound(w, r)
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+}
+
+// serveAdmin serves the management API of the tcp and udp modes
+func serveAdmin(admin *http.Server) {
+	if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("admin server failed to start", "error", err)
+		os.Exit(1)
+	}
+}
+
+// Start accepts connections until Shutdown is called
+func (s *TCPServer) Start() {
+	printRawStartupInfo("TCP", s.port, s.router, s.config, s.admin.Addr)
+	slog.Info("starting chaos proxy", "mode", "tcp", "port", s.port, "admin_addr", s.admin.Addr)
+
+	ln, err := net.Listen("tcp", ":"+s.port)
+	if err != nil {
+		slog.Error("server failed to start", "error", err)
+		os.Exit(1)
+	}
+
+	go serveAdmin(s.admin)
+	s.serve(ln)
+
+	slog.Info("chaos proxy stopped")
+}
+
+// serve forwards the connections accepted on ln until it is closed
+func (s *TCPServer) serve(ln net.Listener) {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+
+	for {
+		client, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("accept failed", "error", err)
+			}
+			break
+		}
+		s.handlers.Add(1)
+		go s.handle(client)
+	}
+}
+
+// Shutdown stops accepting connections and waits for open ones to finish
+// until ctx ends, then closes them
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	s.mu.Unlock()
+
+	err := s.admin.Shutdown(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+	}
+
+	if closeErr := s.router.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// track registers a connection to close on shutdown; it reports false when
+// the server is already shutting down
+func (s *TCPServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *TCPServer) untrack(conns ...net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range conns {
+		delete(s.conns, conn)
+	}
+}
+
+// handle forwards one client connection to its backend
+func (s *TCPServer) handle(client net.Conn) {
+	defer s.handlers.Done()
+
+	conn := s.router.Default().Middleware().AcceptTCP(client.RemoteAddr().String())
+	defer conn.Close()
+
+	if conn.Refuse {
+		resetConn(client)
+		return
+	}
+
+	backend, err := net.DialTimeout("tcp", conn.Backend, dialTimeout)
+	conn.Dialed(err)
+	if err != nil {
+		resetConn(client)
+		return
+	}
+	if !s.track(client) || !s.track(backend) {
+		client.Close()
+		backend.Close()
+		return
+	}
+	defer s.untrack(client, backend)
+
+	// Once silent, the backend is gone and nothing reaches the client
+	var silent atomic.Bool
+	var timers []*time.Timer
+	if conn.HalfOpen {
+		timers = append(timers, time.AfterFunc(conn.HalfOpenAfter, func() {
+			conn.Inject(chaos.TCPFaultHalfOpen)
+			silent.Store(true)
+			backend.Close()
+		}))
+	}
+	if conn.Reset {
+		timers = append(timers, time.AfterFunc(conn.ResetAfter, func() {
+			conn.Inject(chaos.TCPFaultReset)
+			resetConn(client)
+			resetConn(backend)
+		}))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pipe(backend, client, conn, &silent, func(n int) { conn.Count(n, 0) })
+	}()
+	pipe(client, backend, conn, &silent, func(n int) { conn.Count(0, n) })
+	wg.Wait()
+
+	for _, t := range timers {
+		t.Stop()
+	}
+	client.Close()
+	backend.Close()
+}
+
+// pipe copies src to dst with the latency and bandwidth faults of conn,
+// then half-closes dst. While silent, data is read and discarded, and the
+// client connection is never closed.
+func pipe(dst, src net.Conn, conn *chaos.TCPConnection, silent *atomic.Bool, count func(int)) {
+	size := 32 << 10
+	if conn.Bandwidth > 0 && conn.Bandwidth/10 < int64(size) {
+		// Small chunks keep a throttled stream smooth
+		size = int(max(conn.Bandwidth/10, 1))
+	}
+	buf := make([]byte, size)
+
+	start := time.Now()
+	var total int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 && !silent.Load() {
+			if d := conn.ChunkDelay(); d > 0 {
+				time.Sleep(d)
+			}
+			if conn.Bandwidth > 0 {
+				total += int64(n)
+				time.Sleep(time.Until(start.Add(transferTime(total, conn.Bandwidth))))
+			}
+			if !silent.Load() {
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					return
+				}
+				count(n)
+			}
+		}
+		if err != nil {
+			if !silent.Load() {
+				closeWrite(dst)
+			}
+			return
+		}
+	}
+}
+
+// transferTime is how long sending total bytes takes at rate bytes per
+// second. It is computed in floating point since total times a second in
+// nanoseconds overflows an int64 past 9 GB.
+func transferTime(total, rate int64) time.Duration {
+	return time.Duration(float64(total) / float64(rate) * float64(time.Second))
+}
+
+// closeWrite half-closes a connection so the peer sees EOF while the other
+// direction keeps flowing
+func closeWrite(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// resetConn closes a connection with a TCP reset instead of a FIN
+func resetConn(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// printRawStartupInfo prints the startup banner of the tcp and udp modes
+func printRawStartupInfo(mode, port string, router *chaos.Router, config *chaos.ChaosConfig, adminAddr string) {
+	fmt.Printf(`%s
+
+=======================================
+📡 %s proxy listening on: :%s
+🎯 Target service: %s
+🧪 Dry run: %v
+
+Management endpoints:
+📊 Stats: http://localhost%s/_chaos/stats
+⚙️ Config: http://localhost%s/_chaos/config
+❤️ Health: http://localhost%s/_chaos/health
+
+Press Ctrl+C to stop
+`, logo, mode, port, router.Default().Backends(), config.DryRun,
+		adminAddr, adminAddr, adminAddr)
+}
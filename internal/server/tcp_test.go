@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pgaijin66/phailure/internal/chaos"
+)
+
+// startTCPEcho starts a backend echoing what it receives until EOF
+func startTCPEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startTCPProxy starts a TCP proxy to an echo backend with the given
+// faults and returns its address
+func startTCPProxy(t *testing.T, faults chaos.TCPConfig) string {
+	t.Helper()
+	config := quietConfig()
+	config.TCP = faults
+	router, err := chaos.NewRouter(config, &chaos.RouteConfig{Target: "tcp://" + startTCPEcho(t)}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewTCP("0", "0", config, router)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return ln.Addr().String()
+}
+
+// dialTCPProxy starts a TCP proxy like startTCPProxy and connects to it
+func dialTCPProxy(t *testing.T, faults chaos.TCPConfig) net.Conn {
+	t.Helper()
+	client, err := net.Dial("tcp", startTCPProxy(t, faults))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+// roundTrip sends payload and reads the echo back
+func roundTrip(conn net.Conn, payload []byte) error {
+	if _, err := conn.Write(payload); err != nil {
+		return err
+	}
+	echo := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		return err
+	}
+	if !bytes.Equal(echo, payload) {
+		return errors.New("echo differs from what was sent")
+	}
+	return nil
+}
+
+func TestTCPForwardsAndHalfCloses(t *testing.T) {
+	client := dialTCPProxy(t, chaos.TCPConfig{})
+	if err := roundTrip(client, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// EOF travels to the backend and back, which then closes its side
+	client.(*net.TCPConn).CloseWrite()
+	if n, err := client.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("read after half-close: %d bytes, %v, want EOF", n, err)
+	}
+}
+
+func TestTCPRefuse(t *testing.T) {
+	// The reset may even arrive before the connection is established
+	client, err := net.Dial("tcp", startTCPProxy(t, chaos.TCPConfig{RefuseProbability: 1}))
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := roundTrip(client, []byte("hello")); err == nil {
+		t.Fatal("refused connection forwarded data")
+	}
+}
+
+func TestTCPLatency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	client := dialTCPProxy(t, chaos.TCPConfig{LatencyProbability: 1,
+		LatencyMin: chaos.Duration{Duration: latency}, LatencyMax: chaos.Duration{Duration: latency}})
+
+	start := time.Now()
+	if err := roundTrip(client, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// Delayed on the way to the backend and on the way back
+	if elapsed := time.Since(start); elapsed < 2*latency {
+		t.Errorf("round trip took %v, want at least %v", elapsed, 2*latency)
+	}
+}
+
+func TestTCPBandwidth(t *testing.T) {
+	const rate = 20000
+	client := dialTCPProxy(t, chaos.TCPConfig{BandwidthBytesPerSec: rate})
+
+	payload := bytes.Repeat([]byte("b"), rate/4)
+	start := time.Now()
+	if err := roundTrip(client, payload); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("%d bytes at %d bytes/s took %v, want at least 200ms", len(payload), rate, elapsed)
+	}
+}
+
+func TestTransferTime(t *testing.T) {
+	tests := []struct {
+		total, rate int64
+		want        time.Duration
+	}{
+		{5000, 20000, 250 * time.Millisecond},
+		{1, 3, time.Second / 3},
+		// Past 9 GB, bytes times nanoseconds per second overflow an int64
+		{10 << 30, 1 << 20, 10240 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := transferTime(tt.total, tt.rate); got != tt.want {
+			t.Errorf("transferTime(%d, %d) = %v, want %v", tt.total, tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestTCPReset(t *testing.T) {
+	const after = 50 * time.Millisecond
+	client := dialTCPProxy(t, chaos.TCPConfig{ResetProbability: 1,
+		ResetAfterMin: chaos.Duration{Duration: after}, ResetAfterMax: chaos.Duration{Duration: after}})
+
+	if err := roundTrip(client, []byte("before")); err != nil {
+		t.Fatalf("round trip before the reset: %v", err)
+	}
+	start := time.Now()
+	_, err := client.Read(make([]byte, 1))
+	if err == nil || err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read after the reset: %v, want a connection reset", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("reset after %v, want about %v", elapsed, after)
+	}
+}
+
+func TestTCPHalfOpen(t *testing.T) {
+	const after = 50 * time.Millisecond
+	client := dialTCPProxy(t, chaos.TCPConfig{HalfOpenProbability: 1, HalfOpenAfter: chaos.Duration{Duration: after}})
+
+	if err := roundTrip(client, []byte("before")); err != nil {
+		t.Fatalf("round trip before the backend vanished: %v", err)
+	}
+	time.Sleep(2 * after)
+
+	// Writes still succeed but nothing comes back, and the connection
+	// is neither closed nor reset
+	if _, err := client.Write([]byte("after")); err != nil {
+		t.Fatalf("write to the half-open connection: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read from the half-open connection: %v, want a timeout", err)
+	}
+}
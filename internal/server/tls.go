@@ -0,0 +1,236 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pgaijin66/phailure/internal/certs"
+	"github.com/pgaijin66/phailure/internal/chaos"
+)
+
+// TLSOptions configures TLS termination on the proxy listener
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+
+	// SelfSigned generates a throwaway certificate for localhost when no
+	// certificate file is given
+	SelfSigned bool
+
+	// ClientCAFile enables mutual TLS: clients must present a certificate
+	// signed by one of these CAs
+	ClientCAFile string
+
+	// CADir holds the local CA that signs self-signed and fault
+	// certificates. Empty keeps the CA in memory only.
+	CADir string
+}
+
+// Enabled reports whether the listener should serve TLS
+func (o TLSOptions) Enabled() bool {
+	return o.CertFile != "" || o.SelfSigned
+}
+
+// EnableTLS makes the server listen with TLS. TLS faults from the default
+// route's configuration are injected on each handshake. The local CA is
+// only loaded, or created, for a self-signed certificate or once a fault
+// certificate is needed.
+func (s *Server) EnableTLS(opts TLSOptions) error {
+	config, ca, err := buildTLSConfig(opts)
+	if err != nil {
+		return err
+	}
+	faults := &tlsFaultInjector{base: config, chaos: s.Chaos(), ca: ca, caDir: opts.CADir}
+	config.GetConfigForClient = faults.configForClient
+	s.tlsConfig = config
+	return nil
+}
+
+// tlsFaultInjector picks the TLS faults for each handshake and serves the
+// matching broken configuration
+type tlsFaultInjector struct {
+	base  *tls.Config
+	chaos *chaos.ChaosMiddleware
+
+	// ca is nil until a fault certificate is needed, unless it already
+	// issued the self-signed certificate
+	ca    *certs.CA
+	caDir string
+
+	once      sync.Once
+	expired   tls.Certificate
+	wrongHost tls.Certificate
+	certErr   error
+}
+
+func (t *tlsFaultInjector) configForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	config := t.chaos.Config()
+	faults := config.TLSFaults
+	if !faults.Enabled() {
+		return nil, nil
+	}
+	remote := hello.Conn.RemoteAddr().String()
+
+	// A single draw picks at most one fault, each with its own
+	// probability, against thresholds adding up the probabilities
+	draw, threshold := rand.Float64(), 0.0
+	below := func(p float64) bool {
+		threshold += p
+		return draw < threshold
+	}
+	var kind string
+	switch {
+	case below(faults.HandshakeFailureProbability):
+		kind = chaos.TLSFaultHandshake
+	case below(faults.ExpiredCertProbability):
+		kind = chaos.TLSFaultExpired
+	case below(faults.WrongHostnameProbability):
+		kind = chaos.TLSFaultWrongHost
+	case below(faults.DowngradeProbability):
+		kind = chaos.TLSFaultDowngrade
+	default:
+		return nil, nil
+	}
+
+	t.chaos.RecordTLSFault(kind, remote, config.DryRun)
+	if config.DryRun {
+		return nil, nil
+	}
+
+	if kind == chaos.TLSFaultHandshake {
+		return nil, errors.New("chaos: injected TLS handshake failure")
+	}
+
+	faulty := t.base.Clone()
+	faulty.GetConfigForClient = nil
+
+	switch kind {
+	case chaos.TLSFaultExpired, chaos.TLSFaultWrongHost:
+		t.once.Do(t.generateFaultCertificates)
+		if t.certErr != nil {
+			return nil, t.certErr
+		}
+		faulty.Certificates = []tls.Certificate{t.expired}
+		if kind == chaos.TLSFaultWrongHost {
+			faulty.Certificates = []tls.Certificate{t.wrongHost}
+		}
+	case chaos.TLSFaultDowngrade:
+		version := faults.DowngradeTo()
+		faulty.MinVersion = version
+		faulty.MaxVersion = version
+	}
+	return faulty, nil
+}
+
+// generateFaultCertificates issues an expired certificate for the names of
+// the real certificate and a valid one for an unrelated host name, both
+// signed by the local CA so that clients trusting it see the actual error
+func (t *tlsFaultInjector) generateFaultCertificates() {
+	if t.ca == nil {
+		if t.ca, t.certErr = loadCA(t.caDir); t.certErr != nil {
+			return
+		}
+	}
+
+	dnsNames := []string{"localhost"}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	if len(t.base.Certificates) > 0 && len(t.base.Certificates[0].Certificate) > 0 {
+		if leaf, err := x509.ParseCertificate(t.base.Certificates[0].Certificate[0]); err == nil {
+			dnsNames, ips = leaf.DNSNames, leaf.IPAddresses
+		}
+	}
+
+	expiredAt := time.Now().Add(-24 * time.Hour)
+	t.expired, t.certErr = t.ca.Issue(dnsNames, ips, expiredAt.Add(-365*24*time.Hour), expiredAt)
+	if t.certErr != nil {
+		return
+	}
+	t.wrongHost, t.certErr = t.ca.IssueFor("wrong-host.phailure.invalid")
+}
+
+// loadCA loads the local CA from dir, creating it if needed
+func loadCA(dir string) (*certs.CA, error) {
+	ca, err := certs.LoadOrCreateCA(dir)
+	if err != nil {
+		return nil, fmt.Errorf("loading local CA: %w", err)
+	}
+	return ca, nil
+}
+
+// buildTLSConfig returns the listener configuration, and the local CA when
+// it issued the certificate
+func buildTLSConfig(opts TLSOptions) (*tls.Config, *certs.CA, error) {
+	var cert tls.Certificate
+	var ca *certs.CA
+	var err error
+
+	switch {
+	case opts.CertFile != "" || opts.KeyFile != "":
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, nil, errors.New("both a certificate and a key file are required")
+		}
+		cert, err = tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("loading TLS certificate: %w", err)
+		}
+	case opts.SelfSigned:
+		if ca, err = loadCA(opts.CADir); err != nil {
+			return nil, nil, err
+		}
+		cert, err = selfSignedCertificate(ca)
+		if err != nil {
+			return nil, nil, fmt.Errorf("generating self-signed certificate: %w", err)
+		}
+	default:
+		return nil, nil, errors.New("no TLS certificate configured")
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if opts.ClientCAFile != "" {
+		pem, err := os.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", opts.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, ca, nil
+}
+
+// selfSignedCertificate issues a certificate from the local CA valid for
+// localhost, the loopback addresses and this host's name
+func selfSignedCertificate(ca *certs.CA) (tls.Certificate, error) {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		hosts = append(hosts, hostname)
+	}
+
+	cert, err := ca.IssueFor(hosts...)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+	slog.Info("generated self-signed certificate", "hosts", hosts,
+		"sha256", hex.EncodeToString(fingerprint[:]), "ca", ca.CertPath)
+	return cert, nil
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pgaijin66/phailure/internal/certs"
+	"github.com/pgaijin66/phailure/internal/chaos"
+)
+
+// writeCertificate writes a certificate for localhost and its key as PEM
+// files, issued by a throwaway CA
+func writeCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	ca, err := certs.LoadOrCreateCA("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.IssueFor("localhost", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestEnableTLSCreatesCAOnlyWhenNeeded(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+	caDir := filepath.Join(dir, "ca")
+	caCert := filepath.Join(caDir, certs.CACertFile)
+
+	config := quietConfig()
+	config.TLSFaults = chaos.TLSFaultConfig{ExpiredCertProbability: 1}
+	s, err := New("0", config, &url.URL{Scheme: "http", Host: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableTLS(TLSOptions{CertFile: certFile, KeyFile: keyFile, CADir: caDir}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(caCert); !os.IsNotExist(err) {
+		t.Fatalf("CA created with a certificate file given: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(ln)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	// The expired certificate fault needs the CA, which is created then
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if leaf := conn.ConnectionState().PeerCertificates[0]; !leaf.NotAfter.Before(time.Now()) {
+		t.Errorf("certificate valid until %v, want an expired one", leaf.NotAfter)
+	}
+	if _, err := os.Stat(caCert); err != nil {
+		t.Errorf("CA not created for the fault certificate: %v", err)
+	}
+}
+
+func TestTLSFaultsAreExclusive(t *testing.T) {
+	config := quietConfig()
+	config.TLSFaults = chaos.TLSFaultConfig{HandshakeFailureProbability: 0.5, ExpiredCertProbability: 0.5}
+	s, err := New("0", config, &url.URL{Scheme: "http", Host: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableTLS(TLSOptions{SelfSigned: true}); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(ln)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	// The probabilities add up to 1, so every handshake gets one fault
+	for i := 0; i < 40; i++ {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			continue
+		}
+		leaf := conn.ConnectionState().PeerCertificates[0]
+		conn.Close()
+		if !leaf.NotAfter.Before(time.Now()) {
+			t.Fatalf("handshake %d got neither fault", i)
+		}
+	}
+
+	config.TLSFaults.WrongHostnameProbability = 0.1
+	if err := config.Validate(); err == nil {
+		t.Error("probabilities adding up to more than 1 accepted")
+	}
+}
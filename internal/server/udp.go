@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pgaijin66/phailure/internal/chaos"
+)
+
+// udpFlowTimeout is how long a client address stays mapped to its backend
+// socket without traffic
+const udpFlowTimeout = time.Minute
+
+// maxDatagram is the largest UDP payload
+const maxDatagram = 64 << 10
+
+// UDPServer forwards datagrams to the targets of the default route with
+// packet-level chaos. Each client address gets its own socket towards the
+// backend so that replies find their way back. The management API is
+// served over HTTP on a separate admin port.
+type UDPServer struct {
+	port   string
+	config *chaos.ChaosConfig
+	router *chaos.Router
+	admin  *http.Server
+
+	// flowTimeout is how long a flow lives without traffic
+	flowTimeout time.Duration
+
+	mu    sync.Mutex
+	conn  *net.UDPConn
+	flows map[string]*udpFlow
+	done  chan struct{}
+
+	// closeDone closes done once, however often Shutdown is called
+	closeDone sync.Once
+}
+
+// udpFlow maps one client address to its backend socket
+type udpFlow struct {
+	client   *net.UDPAddr
+	upstream *net.UDPConn
+	flow     *chaos.UDPFlow
+	lastSeen atomic.Int64
+
+	toBackend udpLink
+	toClient  udpLink
+}
+
+// udpLink is one direction of a flow, holding the datagram kept back for
+// reordering
+type udpLink struct {
+	send func([]byte)
+
+	mu    sync.Mutex
+	held  []byte
+	gen   int
+	timer *time.Timer
+}
+
+// NewUDP creates a UDP proxy listening on port, with the management API on
+// adminPort
+func NewUDP(port, adminPort string, config *chaos.ChaosConfig, router *chaos.Router) *UDPServer {
+	return &UDPServer{
+		port:   port,
+		config: config,
+		router: router,
+		admin: &http.Server{
+			Addr:    ":" + adminPort,
+			Handler: managementOnly(router),
+		},
+		flowTimeout: udpFlowTimeout,
+		flows:       map[string]*udpFlow{},
+		done:        make(chan struct{}),
+	}
+}
+
+// Start forwards datagrams until Shutdown is called
+func (s *UDPServer) Start() {
+	printRawStartupInfo("UDP", s.port, s.router, s.config, s.admin.Addr)
+	slog.Info("starting chaos proxy", "mode", "udp", "port", s.port, "admin_addr", s.admin.Addr)
+
+	addr, err := net.ResolveUDPAddr("udp", ":"+s.port)
+	var conn *net.UDPConn
+	if err == nil {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		slog.Error("server failed to start", "error", err)
+		os.Exit(1)
+	}
+
+	go serveAdmin(s.admin)
+	s.serve(conn)
+
+	slog.Info("chaos proxy stopped")
+}
+
+// serve forwards the datagrams received on conn until it is closed
+func (s *UDPServer) serve(conn *net.UDPConn) {
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	go s.expireFlows()
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("read failed", "error", err)
+			}
+			break
+		}
+		f := s.flowFor(client)
+		if f == nil {
+			continue
+		}
+		f.lastSeen.Store(time.Now().UnixNano())
+		f.toBackend.deliver(f.flow.PacketFault(), append([]byte(nil), buf[:n]...))
+	}
+}
+
+// Shutdown stops the proxy and closes every flow
+func (s *UDPServer) Shutdown(ctx context.Context) error {
+	s.closeDone.Do(func() { close(s.done) })
+	err := s.admin.Shutdown(ctx)
+
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	for key, f := range s.flows {
+		s.closeFlow(key, f)
+	}
+	s.mu.Unlock()
+
+	if closeErr := s.router.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// flowFor returns the flow of a client address, opening a socket to a
+// backend for new clients. It is only called by the read loop, so no other
+// flow for the address can appear while the backend is resolved and dialed
+// without holding mu.
+func (s *UDPServer) flowFor(client *net.UDPAddr) *udpFlow {
+	key := client.String()
+	s.mu.Lock()
+	f, ok := s.flows[key]
+	s.mu.Unlock()
+	if ok {
+		return f
+	}
+
+	flow := s.router.Default().Middleware().AcceptUDP(key)
+	backend, err := net.ResolveUDPAddr("udp", flow.Backend)
+	var upstream *net.UDPConn
+	if err == nil {
+		upstream, err = net.DialUDP("udp", nil, backend)
+	}
+	flow.Dialed(err)
+	if err != nil {
+		flow.Close()
+		return nil
+	}
+
+	f = &udpFlow{client: client, upstream: upstream, flow: flow}
+	f.lastSeen.Store(time.Now().UnixNano())
+	f.toBackend.send = func(p []byte) { upstream.Write(p) }
+	f.toClient.send = func(p []byte) { s.conn.WriteToUDP(p, client) }
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		// Shutdown already closed the flows
+		upstream.Close()
+		flow.Close()
+		return nil
+	default:
+	}
+	s.flows[key] = f
+	go s.readReplies(f)
+	return f
+}
+
+// readReplies forwards the backend's datagrams to the client
+func (s *UDPServer) readReplies(f *udpFlow) {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := f.upstream.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Debug("backend read failed", "flow_id", f.flow.ID, "error", err)
+			}
+			return
+		}
+		f.lastSeen.Store(time.Now().UnixNano())
+		f.toClient.deliver(f.flow.PacketFault(), append([]byte(nil), buf[:n]...))
+	}
+}
+
+// expireFlows closes flows without traffic for flowTimeout
+func (s *UDPServer) expireFlows() {
+	ticker := time.NewTicker(s.flowTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		cutoff := time.Now().Add(-s.flowTimeout).UnixNano()
+		s.mu.Lock()
+		for key, f := range s.flows {
+			if f.lastSeen.Load() < cutoff {
+				s.closeFlow(key, f)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// closeFlow forgets a flow; called with mu held
+func (s *UDPServer) closeFlow(key string, f *udpFlow) {
+	delete(s.flows, key)
+	f.upstream.Close()
+	f.flow.Close()
+}
+
+// deliver sends a datagram according to its fault
+func (l *udpLink) deliver(fault chaos.UDPPacketFault, p []byte) {
+	if fault.Drop {
+		return
+	}
+	if fault.Corrupt && len(p) > 0 {
+		i := rand.Intn(len(p))
+		p[i] ^= 1 << rand.Intn(8)
+	}
+
+	send := func() {
+		l.forward(p, fault)
+		if fault.Duplicate {
+			l.forward(p, chaos.UDPPacketFault{})
+		}
+	}
+	if fault.Delay > 0 {
+		time.AfterFunc(fault.Delay, send)
+		return
+	}
+	send()
+}
+
+// forward sends p, or holds it back when it is to be reordered. A held
+// datagram goes out right after the next one, or when its window ends.
+func (l *udpLink) forward(p []byte, fault chaos.UDPPacketFault) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if fault.Reorder && l.held == nil {
+		l.held = p
+		l.gen++
+		gen := l.gen
+		l.timer = time.AfterFunc(fault.ReorderWindow, func() { l.release(gen) })
+		return
+	}
+	l.send(p)
+	if l.held != nil {
+		l.timer.Stop()
+		l.send(l.held)
+		l.held = nil
+	}
+}
+
+// release sends the held datagram once its reorder window ended, unless it
+// already went out after a later one
+func (l *udpLink) release(gen int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held != nil && l.gen == gen {
+		l.send(l.held)
+		l.held = nil
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pgaijin66/phailure/internal/chaos"
+)
+
+// udpBackend records the datagrams it receives and echoes them when echo
+// is set
+type udpBackend struct {
+	conn     *net.UDPConn
+	received chan udpDatagram
+}
+
+type udpDatagram struct {
+	from    string
+	payload string
+}
+
+func startUDPBackend(t *testing.T, echo bool) *udpBackend {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	b := &udpBackend{conn: conn, received: make(chan udpDatagram, 100)}
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			b.received <- udpDatagram{from: from.String(), payload: string(buf[:n])}
+			if echo {
+				conn.WriteToUDP(buf[:n], from)
+			}
+		}
+	}()
+	return b
+}
+
+// next returns the next datagram the backend received, or fails
+func (b *udpBackend) next(t *testing.T) udpDatagram {
+	t.Helper()
+	select {
+	case d := <-b.received:
+		return d
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend received nothing")
+		return udpDatagram{}
+	}
+}
+
+// none checks that the backend receives nothing for a while
+func (b *udpBackend) none(t *testing.T) {
+	t.Helper()
+	select {
+	case d := <-b.received:
+		t.Fatalf("backend received %q", d.payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// startUDPProxy starts a UDP proxy to backend with the given faults and
+// returns it with a client socket connected to it. adjust runs before the
+// proxy starts.
+func startUDPProxy(t *testing.T, faults chaos.UDPConfig, backend *udpBackend, adjust ...func(*UDPServer)) (*UDPServer, *net.UDPConn) {
+	t.Helper()
+	config := quietConfig()
+	config.UDP = faults
+	router, err := chaos.NewRouter(config, &chaos.RouteConfig{Target: "udp://" + backend.conn.LocalAddr().String()}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewUDP("0", "0", config, router)
+	for _, f := range adjust {
+		f(s)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(conn)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return s, client
+}
+
+func send(t *testing.T, client *net.UDPConn, payloads ...string) {
+	t.Helper()
+	for _, p := range payloads {
+		if _, err := client.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUDPForwardsBothWays(t *testing.T) {
+	backend := startUDPBackend(t, true)
+	_, client := startUDPProxy(t, chaos.UDPConfig{}, backend)
+
+	send(t, client, "ping")
+	if d := backend.next(t); d.payload != "ping" {
+		t.Fatalf("backend received %q", d.payload)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("reply %q, error %v", buf[:n], err)
+	}
+}
+
+func TestUDPLoss(t *testing.T) {
+	backend := startUDPBackend(t, false)
+	_, client := startUDPProxy(t, chaos.UDPConfig{LossProbability: 1}, backend)
+
+	send(t, client, "a", "b", "c")
+	backend.none(t)
+}
+
+func TestUDPDuplicate(t *testing.T) {
+	backend := startUDPBackend(t, false)
+	_, client := startUDPProxy(t, chaos.UDPConfig{DuplicateProbability: 1}, backend)
+
+	send(t, client, "a")
+	for i := 0; i < 2; i++ {
+		if d := backend.next(t); d.payload != "a" {
+			t.Fatalf("datagram %d: %q, want the duplicated a", i, d.payload)
+		}
+	}
+	backend.none(t)
+}
+
+func TestUDPReorder(t *testing.T) {
+	const window = 100 * time.Millisecond
+	backend := startUDPBackend(t, false)
+	_, client := startUDPProxy(t, chaos.UDPConfig{ReorderProbability: 1, ReorderWindow: chaos.Duration{Duration: window}}, backend)
+
+	// 1 is held until 2 went out; 3 is held and released when its window
+	// ends since nothing follows it
+	start := time.Now()
+	send(t, client, "1", "2", "3")
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, backend.next(t).payload)
+	}
+	if want := []string{"2", "1", "3"}; got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Fatalf("backend received %v, want %v", got, want)
+	}
+	if elapsed := time.Since(start); elapsed < window {
+		t.Errorf("last datagram released after %v, want at least the window %v", elapsed, window)
+	}
+}
+
+func TestUDPFlowExpiry(t *testing.T) {
+	backend := startUDPBackend(t, false)
+	s, client := startUDPProxy(t, chaos.UDPConfig{}, backend, func(s *UDPServer) {
+		s.flowTimeout = 40 * time.Millisecond
+	})
+
+	flows := func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.flows)
+	}
+
+	send(t, client, "first")
+	first := backend.next(t)
+	if flows() != 1 {
+		t.Fatalf("%d flows, want 1", flows())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for flows() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle flow never expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The client gets a new flow, with a new socket towards the backend
+	send(t, client, "second")
+	second := backend.next(t)
+	if second.from == first.from {
+		t.Errorf("datagram after expiry came from the expired socket %s", first.from)
+	}
+}
+
+func TestUDPShutdownTwice(t *testing.T) {
+	backend := startUDPBackend(t, false)
+	s, _ := startUDPProxy(t, chaos.UDPConfig{}, backend)
+
+	// The cleanup of startUDPProxy shuts the proxy down once more
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
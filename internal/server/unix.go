@@ -0,0 +1,111 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSocketMode lets the owner and group of the proxy connect to its
+// Unix socket
+const DefaultSocketMode os.FileMode = 0o660
+
+// Listen sets the address the proxy listens on instead of :port, either
+// host:port or unix:///path/to.sock for a Unix domain socket created with
+// the permissions in mode
+func (s *Server) Listen(addr string, mode os.FileMode) error {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		if path == "" {
+			return fmt.Errorf("unix listen address must be unix:///path/to.sock, got %q", addr)
+		}
+		s.socketPath = path
+		s.socketMode = mode
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("listen address must be host:port or unix:///path/to.sock, got %q", addr)
+	}
+	s.httpServer.Addr = addr
+	return nil
+}
+
+// listen opens the proxy listener. A Unix socket is removed when the
+// listener is closed on shutdown.
+func (s *Server) listen() (net.Listener, error) {
+	if s.socketPath == "" {
+		return net.Listen("tcp", s.httpServer.Addr)
+	}
+	if err := removeStaleSocket(s.socketPath); err != nil {
+		return nil, err
+	}
+	return listenUnix(s.socketPath, s.socketMode)
+}
+
+// listenUnix creates a Unix socket with the permissions in mode. The socket
+// is bound in a private directory next to path, which only the proxy's user
+// can enter, and renamed into place once its permissions are set: binding
+// it at path directly would let anyone allowed by the umask connect before
+// the permissions are restricted.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".phailure-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed under its final name instead
+	ln.SetUnlinkOnClose(false)
+	err = os.Chmod(tmp, mode)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: ln, path: path}, nil
+}
+
+// unixListener removes its socket file when closed
+type unixListener struct {
+	*net.UnixListener
+	path string
+	once sync.Once
+}
+
+// Close implements the net.Listener interface
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.once.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// removeStaleSocket deletes a socket file left behind by a proxy that did
+// not shut down cleanly. A socket another process still listens on, or a
+// file that is not a socket, is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
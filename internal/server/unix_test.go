@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixSetsModeBeforeExposingSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.sock")
+	target, _ := url.Parse("http://127.0.0.1:1")
+	s, err := New("0", quietConfig(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Listen("unix://"+path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode = %v, want a socket with 0600", info.Mode())
+	}
+	// Only the socket is left in the directory, not the private one it
+	// was bound in
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %d entries, want only the socket", len(entries))
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial the renamed socket: %v", err)
+	}
+	conn.Close()
+
+	ln.Close()
+	ln.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket still exists after close: %v", err)
+	}
+}
+
+func TestUnixSocketRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	backendPath, proxyPath := filepath.Join(dir, "backend.sock"), filepath.Join(dir, "proxy.sock")
+
+	backendLn, err := net.Listen("unix", backendPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Method+" "+r.URL.RequestURI())
+	})}
+	go backend.Serve(backendLn)
+	t.Cleanup(func() { backend.Close() })
+
+	s, err := New("0", quietConfig(), &url.URL{Scheme: "unix", Path: backendPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Listen("unix://"+proxyPath, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(ln)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	// Like curl --unix-socket, where the host in the URL is arbitrary
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", proxyPath)
+		},
+	}}
+	resp, err := client.Get("http://localhost/orders?page=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "GET /orders?page=2" {
+		t.Errorf("status %d, body %q, want 200 from the backend socket", resp.StatusCode, body)
+	}
+}
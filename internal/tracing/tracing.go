@@ -0,0 +1,64 @@
+package tracing
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// ShutdownFunc flushes pending spans and stops the exporter
+type ShutdownFunc func(context.Context) error
+
+// Config holds the tracing options
+type Config struct {
+	// Endpoint is the OTLP/HTTP collector URL, e.g. http://localhost:4318.
+	// When empty the standard OTEL_EXPORTER_OTLP_* variables are used, and
+	// if those are unset too spans are not exported.
+	Endpoint    string
+	ServiceName string
+}
+
+// Setup installs the W3C trace context propagator and, when an endpoint is
+// configured, a tracer provider exporting spans over OTLP/HTTP. Incoming
+// trace context is always continued, even when export is disabled.
+func Setup(ctx context.Context, cfg Config) (ShutdownFunc, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	if cfg.Endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" &&
+		os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var opts []otlptracehttp.Option
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(newResource(cfg.ServiceName)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+func newResource(serviceName string) *resource.Resource {
+	if serviceName == "" {
+		serviceName = "phailure"
+	}
+	return resource.NewSchemaless(attribute.String("service.name", serviceName))
+}
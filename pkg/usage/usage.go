@@ -14,7 +14,8 @@ func CustomUsage() {
 	fmt.Fprintf(os.Stderr, "       phailure - chaos engineering proxy for testing service resilience\n\n")
 
 	fmt.Fprintf(os.Stderr, "SYNOPSIS\n")
-	fmt.Fprintf(os.Stderr, "       phailure -target=URL [OPTIONS]\n\n")
+	fmt.Fprintf(os.Stderr, "       phailure -target=URL [OPTIONS]\n")
+	fmt.Fprintf(os.Stderr, "       phailure -routes=FILE [-target=URL] [OPTIONS]\n\n")
 
 	fmt.Fprintf(os.Stderr, "DESCRIPTION\n")
 	fmt.Fprintf(os.Stderr, "       phailure is a chaos engineering tool that acts as a proxy between clients\n")
@@ -44,6 +45,51 @@ func CustomUsage() {
 	fmt.Fprintf(os.Stderr, "           # Test specific error codes\n")
 	fmt.Fprintf(os.Stderr, "           phailure -target=http://localhost:3000 \\\n")
 	fmt.Fprintf(os.Stderr, "                  -error-codes=503,504 -error-prob=0.3\n\n")
+	fmt.Fprintf(os.Stderr, "           # Front several services, each with its own chaos settings\n")
+	fmt.Fprintf(os.Stderr, "           phailure -routes=routes.yaml -target=http://localhost:3000\n\n")
+	fmt.Fprintf(os.Stderr, "           # Balance over a pool and make the second instance slow\n")
+	fmt.Fprintf(os.Stderr, "           phailure -target=http://app1:3000,http://app2:3000 -health-path=/healthz\n")
+	fmt.Fprintf(os.Stderr, "           curl -X POST http://localhost:8080/_chaos/config \\\n")
+	fmt.Fprintf(os.Stderr, "                -d '{\"backend_faults\": [{\"backend\": \"2\", \"delay_min\": \"2s\", \"delay_max\": \"3s\", \"delay_probability\": 1}]}'\n\n")
+	fmt.Fprintf(os.Stderr, "           # Serve HTTPS with a certificate from the local CA, expire it on 10%% of handshakes\n")
+	fmt.Fprintf(os.Stderr, "           phailure -target=http://localhost:3000 -tls-self-signed\n")
+	fmt.Fprintf(os.Stderr, "           curl --cacert ~/.phailure/ca.pem -X POST https://localhost:8080/_chaos/config \\\n")
+	fmt.Fprintf(os.Stderr, "                -d '{\"tls_faults\": {\"expired_cert_probability\": 0.1}}'\n\n")
+	fmt.Fprintf(os.Stderr, "           # Reach an HTTPS target with a private CA and a client certificate\n")
+	fmt.Fprintf(os.Stderr, "           phailure -target=https://api.internal -upstream-ca=ca.pem \\\n")
+	fmt.Fprintf(os.Stderr, "                  -upstream-cert=client.pem -upstream-key=client-key.pem\n\n")
+	fmt.Fprintf(os.Stderr, "           # Front a cleartext HTTP/2 service and refuse 10%% of its streams\n")
+	fmt.Fprintf(os.Stderr, "           phailure -target=h2c://localhost:50051\n")
+	fmt.Fprintf(os.Stderr, "           curl -X POST http://localhost:8080/_chaos/config \\\n")
+	fmt.Fprintf(os.Stderr, "                -d '{\"http2_faults\": {\"rst_stream_probability\": 0.1, \"rst_stream_code\": \"REFUSED_STREAM\"}}'\n\n")
+	fmt.Fprintf(os.Stderr, "           # Fail one gRPC method with RESOURCE_EXHAUSTED, leave the others alone\n")
+	fmt.Fprintf(os.Stderr, "           phailure -target=h2c://localhost:50051 -error-prob=0 -delay-prob=0 -timeout-prob=0\n")
+	fmt.Fprintf(os.Stderr, "           curl -X POST http://localhost:8080/_chaos/config -d '{\"grpc\": {\"methods\": [{\n")
+	fmt.Fprintf(os.Stderr, "                \"method\": \"/orders.OrderService/CreateOrder\", \"error_probability\": 0.5,\n")
+	fmt.Fprintf(os.Stderr, "                \"status_codes\": [\"RESOURCE_EXHAUSTED\"]}]}}'\n\n")
+	fmt.Fprintf(os.Stderr, "           # Close WebSocket connections with 1012 after 50 messages\n")
+	fmt.Fprintf(os.Stderr, "           curl -X POST http://localhost:8080/_chaos/config \\\n")
+	fmt.Fprintf(os.Stderr, "                -d '{\"websocket\": {\"close_probability\": 1, \"close_after_messages\": 50, \"close_code\": 1012}}'\n\n")
+	fmt.Fprintf(os.Stderr, "           # End Server-Sent Events streams after 20 events to exercise reconnects\n")
+	fmt.Fprintf(os.Stderr, "           curl -X POST http://localhost:8080/_chaos/config \\\n")
+	fmt.Fprintf(os.Stderr, "                -d '{\"streaming\": {\"cut_probability\": 1, \"cut_after_events\": 20}}'\n\n")
+	fmt.Fprintf(os.Stderr, "           # Proxy Postgres as raw TCP, reset 10%% of connections within a minute\n")
+	fmt.Fprintf(os.Stderr, "           phailure -mode=tcp -port=15432 -target=localhost:5432 -admin-port=8081\n")
+	fmt.Fprintf(os.Stderr, "           curl -X POST http://localhost:8081/_chaos/config \\\n")
+	fmt.Fprintf(os.Stderr, "                -d '{\"tcp\": {\"reset_probability\": 0.1, \"reset_after_max\": \"1m\"}}'\n\n")
+	fmt.Fprintf(os.Stderr, "           # Lose 5%% of DNS datagrams and delay some by up to 200ms\n")
+	fmt.Fprintf(os.Stderr, "           phailure -mode=udp -port=5353 -target=8.8.8.8:53 -admin-port=8081\n")
+	fmt.Fprintf(os.Stderr, "           curl -X POST http://localhost:8081/_chaos/config -d '{\"udp\": {\"loss_probability\": 0.05,\n")
+	fmt.Fprintf(os.Stderr, "                \"jitter_probability\": 0.2, \"jitter_max\": \"200ms\"}}'\n\n")
+	fmt.Fprintf(os.Stderr, "           # Forward proxy for every outbound call, intercepting HTTPS to one host\n")
+	fmt.Fprintf(os.Stderr, "           phailure -mode=forward -error-prob=0.1 -mitm -mitm-hosts=api.example.com\n")
+	fmt.Fprintf(os.Stderr, "           curl -x http://localhost:8080 --cacert ~/.phailure/ca.pem https://api.example.com/\n\n")
+	fmt.Fprintf(os.Stderr, "           # Between a sidecar and its app, both on Unix sockets\n")
+	fmt.Fprintf(os.Stderr, "           phailure -listen=unix:///run/phailure.sock -target=unix:///run/app.sock\n")
+	fmt.Fprintf(os.Stderr, "           curl --unix-socket /run/phailure.sock http://localhost/_chaos/stats\n\n")
+	fmt.Fprintf(os.Stderr, "           # Start from a named profile, switch to another at runtime\n")
+	fmt.Fprintf(os.Stderr, "           phailure -target=http://localhost:3000 -profile=flaky-network\n")
+	fmt.Fprintf(os.Stderr, "           curl -X POST http://localhost:8080/_chaos/profiles/regional-outage/apply\n\n")
 
 	fmt.Fprintf(os.Stderr, "       Gradual chaos increase:\n")
 	fmt.Fprintf(os.Stderr, "           # Start with low chaos\n")
@@ -53,8 +99,28 @@ func CustomUsage() {
 	fmt.Fprintf(os.Stderr, "                -H \"Content-Type: application/json\" \\\n")
 	fmt.Fprintf(os.Stderr, "                -d '{\"error_probability\": 0.1}'\n\n")
 
+	fmt.Fprintf(os.Stderr, "       Affecting a consistent slice of users:\n")
+	fmt.Fprintf(os.Stderr, "           # 10%% of user IDs always go through chaos, the rest never do\n")
+	fmt.Fprintf(os.Stderr, "           phailure -target=http://localhost:3000 \\\n")
+	fmt.Fprintf(os.Stderr, "                  -target-by=header:X-User-ID -target-fraction=0.1 -error-prob=0.5\n\n")
+
+	fmt.Fprintf(os.Stderr, "       Previewing chaos against a shared environment:\n")
+	fmt.Fprintf(os.Stderr, "           # Faults are logged and reported in X-Chaos-Would-Apply, never injected\n")
+	fmt.Fprintf(os.Stderr, "           phailure -target=http://localhost:3000 -dry-run -error-prob=0.2\n\n")
+
+	fmt.Fprintf(os.Stderr, "       Shipping logs to a log pipeline:\n")
+	fmt.Fprintf(os.Stderr, "           # One JSON event per request with fault, status and latency\n")
+	fmt.Fprintf(os.Stderr, "           phailure -target=http://localhost:3000 -log-format=json -log-level=info\n\n")
+
+	fmt.Fprintf(os.Stderr, "       Exporting traces:\n")
+	fmt.Fprintf(os.Stderr, "           # Spans continue incoming traceparent and carry chaos.* fault events\n")
+	fmt.Fprintf(os.Stderr, "           phailure -target=http://localhost:3000 -otlp-endpoint=http://localhost:4318\n\n")
+
 	fmt.Fprintf(os.Stderr, "       Using configuration file:\n")
-	fmt.Fprintf(os.Stderr, "           phailure -config=chaos-config.json\n\n")
+	fmt.Fprintf(os.Stderr, "           phailure -config=chaos-config.json\n")
+	fmt.Fprintf(os.Stderr, "           phailure -config=chaos-config.yaml   # or .toml\n\n")
+	fmt.Fprintf(os.Stderr, "           # The file is watched for changes; force a reload with SIGHUP\n")
+	fmt.Fprintf(os.Stderr, "           kill -HUP $(pgrep phailure)\n\n")
 
 	fmt.Fprintf(os.Stderr, "OPTIONS\n")
 	flag.PrintDefaults()
@@ -62,11 +128,39 @@ func CustomUsage() {
 	fmt.Fprintf(os.Stderr, "\nCHAOS MANAGEMENT ENDPOINTS\n")
 	fmt.Fprintf(os.Stderr, "       phailure provides HTTP endpoints for runtime management:\n\n")
 	fmt.Fprintf(os.Stderr, "       GET /_chaos/stats\n")
-	fmt.Fprintf(os.Stderr, "              Get request statistics and chaos injection counts\n\n")
+	fmt.Fprintf(os.Stderr, "              Get request statistics and chaos injection counts by route,\n")
+	fmt.Fprintf(os.Stderr, "              method, fault and status, with latency percentiles\n\n")
+	fmt.Fprintf(os.Stderr, "       DELETE /_chaos/stats\n")
+	fmt.Fprintf(os.Stderr, "              Reset request statistics\n\n")
 	fmt.Fprintf(os.Stderr, "       GET /_chaos/config\n")
 	fmt.Fprintf(os.Stderr, "              Get current chaos configuration\n\n")
 	fmt.Fprintf(os.Stderr, "       POST /_chaos/config\n")
-	fmt.Fprintf(os.Stderr, "              Update chaos configuration at runtime\n\n")
+	fmt.Fprintf(os.Stderr, "              Update chaos configuration at runtime (POST merges, PUT replaces);\n")
+	fmt.Fprintf(os.Stderr, "              send If-Match with the ETag from GET to avoid lost updates\n\n")
+	fmt.Fprintf(os.Stderr, "       GET /_chaos/config/versions\n")
+	fmt.Fprintf(os.Stderr, "              List stored configuration versions\n\n")
+	fmt.Fprintf(os.Stderr, "       POST /_chaos/config/rollback?version=N\n")
+	fmt.Fprintf(os.Stderr, "              Restore configuration version N as a new version\n\n")
+	fmt.Fprintf(os.Stderr, "       GET /_chaos/config/history\n")
+	fmt.Fprintf(os.Stderr, "              Audit trail of configuration changes, newest first;\n")
+	fmt.Fprintf(os.Stderr, "              filter with source and limit parameters\n\n")
+	fmt.Fprintf(os.Stderr, "       GET /_chaos/routes\n")
+	fmt.Fprintf(os.Stderr, "              List routes from -routes with their targets and request counts\n\n")
+	fmt.Fprintf(os.Stderr, "       /_chaos/routes/NAME/...\n")
+	fmt.Fprintf(os.Stderr, "              Any management endpoint for a single route, e.g.\n")
+	fmt.Fprintf(os.Stderr, "              /_chaos/routes/orders/config\n\n")
+	fmt.Fprintf(os.Stderr, "       GET /_chaos/backends\n")
+	fmt.Fprintf(os.Stderr, "              Health, ejection and load of each backend in the target pool\n\n")
+	fmt.Fprintf(os.Stderr, "       GET /_chaos/profiles\n")
+	fmt.Fprintf(os.Stderr, "              List built-in and custom chaos profiles\n\n")
+	fmt.Fprintf(os.Stderr, "       POST /_chaos/profiles/NAME/apply\n")
+	fmt.Fprintf(os.Stderr, "              Apply a profile on top of the current configuration\n\n")
+	fmt.Fprintf(os.Stderr, "       GET /_chaos/events\n")
+	fmt.Fprintf(os.Stderr, "              Stream request outcomes as Server-Sent Events; filter with\n")
+	fmt.Fprintf(os.Stderr, "              fault, status, method, path, rule and min_latency parameters\n\n")
+	fmt.Fprintf(os.Stderr, "       GET /_chaos/capture.har\n")
+	fmt.Fprintf(os.Stderr, "              Export captured traffic as HAR 1.2 (requires -capture);\n")
+	fmt.Fprintf(os.Stderr, "              DELETE clears the capture buffer\n\n")
 	fmt.Fprintf(os.Stderr, "       GET /_chaos/health\n")
 	fmt.Fprintf(os.Stderr, "              Health check endpoint\n\n")
 
@@ -98,10 +192,37 @@ func CustomUsage() {
 	fmt.Fprintf(os.Stderr, "           curl http://localhost:8080/_chaos/config\n\n")
 	fmt.Fprintf(os.Stderr, "           # Health check\n")
 	fmt.Fprintf(os.Stderr, "           curl http://localhost:8080/_chaos/health\n\n")
+	fmt.Fprintf(os.Stderr, "           # Show where each configuration value comes from\n")
+	fmt.Fprintf(os.Stderr, "           phailure -config=chaos.yaml -print-config\n\n")
+
+	fmt.Fprintf(os.Stderr, "CONFIGURATION\n")
+	fmt.Fprintf(os.Stderr, "       Settings are layered; each layer overrides the ones before it:\n\n")
+	fmt.Fprintf(os.Stderr, "           1. Built-in defaults\n")
+	fmt.Fprintf(os.Stderr, "           2. The -profile profile\n")
+	fmt.Fprintf(os.Stderr, "           3. ~/.phailure/config.{json,yaml,yml,toml}\n")
+	fmt.Fprintf(os.Stderr, "           4. The -config file\n")
+	fmt.Fprintf(os.Stderr, "           5. PHAILURE_* environment variables\n")
+	fmt.Fprintf(os.Stderr, "           6. Flags given on the command line\n\n")
+	fmt.Fprintf(os.Stderr, "       Use -print-config to see the effective configuration and its sources.\n\n")
+
+	fmt.Fprintf(os.Stderr, "ENVIRONMENT\n")
+	fmt.Fprintf(os.Stderr, "       PHAILURE_<FIELD>\n")
+	fmt.Fprintf(os.Stderr, "              Sets a configuration field, e.g. PHAILURE_DELAY_PROBABILITY=0.2;\n")
+	fmt.Fprintf(os.Stderr, "              nested fields use a double underscore, e.g.\n")
+	fmt.Fprintf(os.Stderr, "              PHAILURE_TARGETING__FRACTION=0.1\n\n")
+	fmt.Fprintf(os.Stderr, "       PHAILURE_<FLAG>\n")
+	fmt.Fprintf(os.Stderr, "              Sets any other flag not given on the command line, e.g.\n")
+	fmt.Fprintf(os.Stderr, "              PHAILURE_TARGET, PHAILURE_PORT or PHAILURE_LOG_LEVEL\n\n")
 
 	fmt.Fprintf(os.Stderr, "FILES\n")
 	fmt.Fprintf(os.Stderr, "       ~/.phailure/config.json\n")
-	fmt.Fprintf(os.Stderr, "              Default configuration file location\n\n")
+	fmt.Fprintf(os.Stderr, "              Default configuration file, read when present (also .yaml,\n")
+	fmt.Fprintf(os.Stderr, "              .yml or .toml)\n\n")
+	fmt.Fprintf(os.Stderr, "       ~/.phailure/profiles/\n")
+	fmt.Fprintf(os.Stderr, "              Custom chaos profiles, one JSON, YAML or TOML file per profile\n\n")
+	fmt.Fprintf(os.Stderr, "       ~/.phailure/ca.pem, ~/.phailure/ca-key.pem\n")
+	fmt.Fprintf(os.Stderr, "              Local CA issuing -tls-self-signed and TLS fault certificates,\n")
+	fmt.Fprintf(os.Stderr, "              created on first use\n\n")
 
 	fmt.Fprintf(os.Stderr, "EXIT STATUS\n")
 	fmt.Fprintf(os.Stderr, "       0      Success\n")